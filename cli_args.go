@@ -7,10 +7,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -21,12 +25,25 @@ type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, ro, reverse, aessiv, nonempty, raw64,
-	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info bool
+	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
+	fsck, xattr, addkey, listkeys, reencrypt, reversewrite, xchacha, nfc, base32, compress,
+	lastblockmarker, dirmanifest bool
 	masterkey, mountpoint, cipherdir, cpuprofile, extpass,
-	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace,
+	removekey, label, kdf, blocksize string
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// Maximum number of goroutines that decrypt a read request
+	decryptworkers int
+	// Size of the decrypted block cache in MiB
+	cachesize int
+	// Encrypted names longer than this are hashed into long names
+	longnamemax int
+	// "-exclude" and "-exclude-from" can be passed multiple times
+	exclude, excludeFrom multipleStrings
+	// Unmount after this long without file access. Zero disables it.
+	idle time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
@@ -34,6 +51,23 @@ type argContainer struct {
 	_ctlsockFd net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _blockSize is the parsed "-blocksize" in bytes. Zero if not passed.
+	_blockSize uint64
+}
+
+// multipleStrings collects the values of a flag that can be passed multiple
+// times, like "-exclude".
+type multipleStrings []string
+
+// String implements flag.Value.
+func (s *multipleStrings) String() string {
+	return strings.Join(*s, ", ")
+}
+
+// Set implements flag.Value.
+func (s *multipleStrings) Set(val string) error {
+	*s = append(*s, val)
+	return nil
 }
 
 var flagSet *flag.FlagSet
@@ -89,6 +123,22 @@ func prefixOArgs(osArgs []string) []string {
 	return newArgs
 }
 
+// parseBlockSize parses a block size like "65536", "64K" or "64k" and checks
+// that contentenc supports it.
+func parseBlockSize(s string) (uint64, error) {
+	var mult uint64 = 1
+	if strings.HasSuffix(s, "K") || strings.HasSuffix(s, "k") {
+		mult = 1024
+		s = s[:len(s)-1]
+	}
+	bs, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	bs *= mult
+	return bs, contentenc.CheckBlockSize(bs)
+}
+
 // parseCliOpts - parse command line options (i.e. arguments that start with "-")
 func parseCliOpts() (args argContainer) {
 	os.Args = prefixOArgs(os.Args)
@@ -119,17 +169,29 @@ func parseCliOpts() (args argContainer) {
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
+	flagSet.BoolVar(&args.reversewrite, "reversewrite", false, "Make a reverse mount writable")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
+	flagSet.BoolVar(&args.compress, "compress", false, "Compress file content blocks with LZ4 before encrypting them")
+	flagSet.BoolVar(&args.lastblockmarker, "lastblockmarker", false, "Mark the last block of each file to detect truncation")
+	flagSet.BoolVar(&args.dirmanifest, "dirmanifest", false, "Keep an authenticated manifest of the entries of each directory")
+	flagSet.BoolVar(&args.base32, "base32", false, "Encode encrypted file names in lower-case base32 (for case-insensitive storage)")
+	flagSet.BoolVar(&args.xchacha, "xchacha", false, "XChaCha20-Poly1305 encryption")
+	flagSet.BoolVar(&args.nfc, "nfc", false, "Normalize file names to Unicode NFC before encrypting them")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
+	flagSet.BoolVar(&args.xattr, "xattr", false, "Encrypt extended attributes")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.addkey, "addkey", false, "Add a key slot with a new password")
+	flagSet.BoolVar(&args.listkeys, "listkeys", false, "List the key slots")
+	flagSet.BoolVar(&args.reencrypt, "reencrypt", false, "Re-encrypt CIPHERDIR with a new master key")
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
@@ -141,6 +203,19 @@ func parseCliOpts() (args argContainer) {
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.removekey, "removekey", "", "Remove the key slot with the specified label")
+	flagSet.StringVar(&args.label, "label", "", "Label of the key slot created by -addkey")
+	flagSet.StringVar(&args.blocksize, "blocksize", "", "Plaintext block size for -init, a power of two from 4K to 64K")
+	flagSet.StringVar(&args.kdf, "kdf", "", "Password hashing algorithm for -init, -passwd and -addkey: "+
+		configfile.KDFScrypt+" (default) or "+configfile.KDFArgon2id)
+	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view (gitignore syntax, can be passed multiple times)")
+	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclude patterns (can be passed multiple times)")
+	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after the specified idle duration, "+
+		"for example \"30m\" or \"2h45m\". 0 disables auto-unmount")
+	flagSet.IntVar(&args.longnamemax, "longnamemax", syscall.NAME_MAX, "Hash encrypted names that are longer than this (with -init)")
+	flagSet.IntVar(&args.cachesize, "cachesize", 0, "Size of the decrypted block cache in MiB. 0 disables the cache")
+	flagSet.IntVar(&args.decryptworkers, "decryptworkers", 0, "Number of goroutines used to decrypt a large read. "+
+		"0 selects the number of CPUs, but at most 4")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
@@ -173,6 +248,81 @@ func parseCliOpts() (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if (len(args.exclude) > 0 || len(args.excludeFrom) > 0) && !args.reverse {
+		tlog.Fatal.Printf("-exclude and -exclude-from only work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.blocksize != "" {
+		args._blockSize, err = parseBlockSize(args.blocksize)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid -blocksize: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.cachesize < 0 {
+		tlog.Fatal.Printf("Invalid -cachesize: must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.decryptworkers < 0 {
+		tlog.Fatal.Printf("Invalid -decryptworkers: must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.xchacha && (args.aessiv || args.reverse) {
+		tlog.Fatal.Printf("-xchacha cannot be combined with -aessiv or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.longnamemax != syscall.NAME_MAX {
+		if args.plaintextnames {
+			tlog.Fatal.Printf("-longnamemax cannot be combined with -plaintextnames")
+			os.Exit(exitcodes.Usage)
+		}
+		if err = nametransform.CheckLongNameMax(args.longnamemax, args.base32); err != nil {
+			tlog.Fatal.Printf("Invalid -longnamemax: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.base32 && args.plaintextnames {
+		tlog.Fatal.Printf("-base32 cannot be combined with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reversewrite && !args.reverse {
+		tlog.Fatal.Printf("-reversewrite requires -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.compress && args.reverse {
+		tlog.Fatal.Printf("-compress cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.compress {
+		if args._blockSize == 0 {
+			args._blockSize = contentenc.CompressDefaultBS
+		} else if args._blockSize < contentenc.CompressMinBS {
+			tlog.Fatal.Printf("-compress needs a -blocksize of at least %dK", contentenc.CompressMinBS/1024)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.lastblockmarker && args.reverse {
+		tlog.Fatal.Printf("-lastblockmarker cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirmanifest && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-dirmanifest cannot be combined with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirmanifest && !args.hkdf {
+		tlog.Fatal.Printf("-dirmanifest requires HKDF and cannot be combined with -hkdf=false")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nfc && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-nfc cannot be combined with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.kdf {
+	case "", configfile.KDFScrypt, configfile.KDFArgon2id:
+	default:
+		tlog.Fatal.Printf("Invalid -kdf %q. Valid values: %s, %s", args.kdf, configfile.KDFScrypt, configfile.KDFArgon2id)
+		os.Exit(exitcodes.Usage)
+	}
 	// "-forcedecode" only works with openssl. Check compilation and command line parameters
 	if args.forcedecode == true {
 		if stupidgcm.BuiltWithoutOpenssl == true {
@@ -183,6 +333,10 @@ func parseCliOpts() (args argContainer) {
 			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible because they use different crypto libs (openssl vs native Go)")
 			os.Exit(exitcodes.Usage)
 		}
+		if args.xchacha {
+			tlog.Fatal.Printf("The -forcedecode and -xchacha flags are incompatible because they use different crypto libs (openssl vs native Go)")
+			os.Exit(exitcodes.Usage)
+		}
 		if args.reverse == true {
 			tlog.Fatal.Printf("The reverse mode and the -forcedecode option are not compatible")
 			os.Exit(exitcodes.Usage)
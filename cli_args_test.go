@@ -69,3 +69,17 @@ func TestPrefixOArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBlockSize(t *testing.T) {
+	for in, want := range map[string]uint64{"4096": 4096, "8K": 8192, "64k": 65536} {
+		have, err := parseBlockSize(in)
+		if err != nil || have != want {
+			t.Errorf("%q: have=%d err=%v, want=%d", in, have, err, want)
+		}
+	}
+	for _, in := range []string{"", "K", "4000", "128K", "-4K"} {
+		if _, err := parseBlockSize(in); err == nil {
+			t.Errorf("%q should be rejected", in)
+		}
+	}
+}
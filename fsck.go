@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/rfjakob/gocryptfs/internal/ciphertree"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fsckObj holds the crypto helpers and the error count of a running fsck.
+type fsckObj struct {
+	tree *ciphertree.Tree
+	// errorCount is the number of problems found so far
+	errorCount int
+}
+
+// report prints a problem with the ciphertext path "cPath" and counts it.
+func (ck *fsckObj) report(cPath string, format string, v ...interface{}) {
+	ck.errorCount++
+	fmt.Printf("fsck: %s: %s\n", cPath, fmt.Sprintf(format, v...))
+}
+
+// dir checks the directory "cPath" (relative ciphertext path) and everything
+// below it.
+func (ck *fsckObj) dir(cPath string) {
+	tlog.Debug.Printf("fsck: dir %q", cPath)
+	absPath := ck.tree.Abs(cPath)
+	fd, err := os.Open(absPath)
+	if err != nil {
+		ck.report(cPath, "could not open directory: %v", err)
+		return
+	}
+	entries, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		ck.report(cPath, "could not read directory: %v", err)
+		return
+	}
+	var iv []byte
+	if !ck.tree.PlaintextNames {
+		iv, err = nametransform.ReadDirIV(absPath)
+		if err != nil {
+			ck.report(cPath, "could not read %s: %v", nametransform.DirIVFilename, err)
+			// Without the IV we cannot decrypt any name in here, but we can
+			// still check the file contents.
+		}
+	}
+	if ck.tree.Manifests != nil && iv != nil {
+		ck.manifest(cPath)
+	}
+	have := make(map[string]bool, len(entries))
+	for _, cName := range entries {
+		have[cName] = true
+	}
+	nfcNames := make(map[string]string, len(entries))
+	for _, cName := range entries {
+		cChild := filepath.Join(cPath, cName)
+		if ck.tree.IsMetadata(cPath, cName) &&
+			nametransform.NameType(cName) != nametransform.LongNameFilename {
+			continue
+		}
+		pName := cName
+		if !ck.tree.PlaintextNames {
+			isLong := nametransform.LongNameNone
+			if ck.tree.LongNames {
+				isLong = nametransform.NameType(cName)
+			}
+			if isLong == nametransform.LongNameFilename {
+				// The matching content file must exist
+				content := cName[:len(cName)-len(nametransform.LongNameSuffix)]
+				if !have[content] {
+					ck.report(cChild, "orphaned %s file, %q is missing",
+						nametransform.LongNameSuffix, content)
+				}
+				continue
+			}
+			pName = ""
+			if iv != nil {
+				pName = ck.name(cChild, cName, isLong, iv, have)
+			}
+		}
+		if pName != "" {
+			ck.normalization(cChild, pName, nfcNames)
+		}
+		var st syscall.Stat_t
+		err = syscall.Lstat(ck.tree.Abs(cChild), &st)
+		if err != nil {
+			ck.report(cChild, "Lstat failed: %v", err)
+			continue
+		}
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			ck.dir(cChild)
+		case syscall.S_IFREG:
+			ck.file(cChild)
+		case syscall.S_IFLNK:
+			ck.symlink(cChild)
+		}
+	}
+}
+
+// manifest checks that the manifest of the directory "cPath" is authentic and
+// lists exactly the entries that are in the directory.
+func (ck *fsckObj) manifest(cPath string) {
+	absPath := ck.tree.Abs(cPath)
+	m, err := ck.tree.Manifests.Read(absPath)
+	if err != nil {
+		ck.report(cPath, "invalid %s: %v", dirmanifest.Filename, err)
+		return
+	}
+	actual, err := dirmanifest.Scan(absPath, cPath == "")
+	if err != nil {
+		ck.report(cPath, "could not scan directory: %v", err)
+		return
+	}
+	for _, d := range m.Diff(actual) {
+		ck.report(cPath, "does not match %s: %s", dirmanifest.Filename, d)
+	}
+}
+
+// name checks that the name "cName" of the entry "cChild" decrypts using the
+// directory IV "iv". For long names, the matching ".name" file must exist and
+// hash to "cName".
+// Returns the decrypted name, or an empty string if there was a problem.
+func (ck *fsckObj) name(cChild string, cName string, isLong int, iv []byte, have map[string]bool) string {
+	if isLong == nametransform.LongNameContent {
+		if !have[cName+nametransform.LongNameSuffix] {
+			ck.report(cChild, "long name without %s file", nametransform.LongNameSuffix)
+			return ""
+		}
+		cNameLong, err := nametransform.ReadLongName(ck.tree.Abs(cChild))
+		if err != nil {
+			ck.report(cChild, "could not read %s file: %v", nametransform.LongNameSuffix, err)
+			return ""
+		}
+		if ck.tree.NameTransform.HashLongName(cNameLong) != cName {
+			ck.report(cChild, "%s file content does not match the hashed name",
+				nametransform.LongNameSuffix)
+			return ""
+		}
+		cName = cNameLong
+	}
+	pName, err := ck.tree.NameTransform.DecryptName(cName, iv)
+	if err != nil {
+		ck.report(cChild, "could not decrypt name: %v", err)
+		return ""
+	}
+	return pName
+}
+
+// normalization checks the plaintext name "pName" of the entry "cChild" for
+// Unicode normalization problems. Names that only differ in their
+// normalization form (NFC on Linux, NFD on macOS) look the same to the user
+// but are different files. "nfcNames" maps the NFC form of the names seen so
+// far in the directory to the names.
+func (ck *fsckObj) normalization(cChild string, pName string, nfcNames map[string]string) {
+	nfcName := norm.NFC.String(pName)
+	if ck.tree.NFC && nfcName != pName {
+		// All lookups are normalized, so this file cannot be accessed
+		ck.report(cChild, "name %q is not in Unicode NFC form", pName)
+	}
+	if other, found := nfcNames[nfcName]; found {
+		ck.report(cChild, "name %q conflicts with %q, they only differ in Unicode normalization",
+			pName, other)
+		return
+	}
+	nfcNames[nfcName] = pName
+}
+
+// fsckReadBlocks is the number of ciphertext blocks file() reads in one go.
+const fsckReadBlocks = 32
+
+// file checks the header and all content blocks of the regular file "cPath".
+func (ck *fsckObj) file(cPath string) {
+	tlog.Debug.Printf("fsck: file %q", cPath)
+	fd, err := os.Open(ck.tree.Abs(cPath))
+	if err != nil {
+		ck.report(cPath, "could not open file: %v", err)
+		return
+	}
+	defer fd.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := fd.ReadAt(buf, 0)
+	if err == io.EOF && n == 0 {
+		// Empty files have no header
+		return
+	}
+	if err != nil {
+		ck.report(cPath, "could not read file header: %v", err)
+		return
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		ck.report(cPath, "invalid file header: %v", err)
+		return
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		ck.report(cPath, "could not stat file: %v", err)
+		return
+	}
+	cipherBS := int(ck.tree.ContentEnc.CipherBS())
+	buf = make([]byte, fsckReadBlocks*cipherBS)
+	var blockNo uint64
+	for {
+		off := int64(ck.tree.ContentEnc.BlockNoToCipherOff(blockNo))
+		n, err = fd.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			ck.report(cPath, "read error at offset %d: %v", off, err)
+			return
+		}
+		for cBlock := buf[:n]; len(cBlock) > 0; blockNo++ {
+			l := cipherBS
+			if len(cBlock) < l {
+				l = len(cBlock)
+			}
+			last := off+int64(n-len(cBlock)+l) >= fi.Size()
+			_, err2 := ck.tree.ContentEnc.DecryptContentBlock(cBlock[:l], blockNo, h.ID, last)
+			if err2 == contentenc.ErrTruncated {
+				ck.report(cPath, "truncated file: block #%d is not marked as the last block", blockNo)
+			} else if err2 != nil {
+				ck.report(cPath, "corrupt block #%d: %v", blockNo, err2)
+			}
+			cBlock = cBlock[l:]
+		}
+		if err == io.EOF || n < len(buf) {
+			return
+		}
+	}
+}
+
+// symlink checks that the target of the symlink "cPath" decrypts.
+func (ck *fsckObj) symlink(cPath string) {
+	cTarget, err := os.Readlink(ck.tree.Abs(cPath))
+	if err != nil {
+		ck.report(cPath, "Readlink failed: %v", err)
+		return
+	}
+	if _, err = ck.tree.DecryptSymlinkTarget(cTarget); err != nil {
+		ck.report(cPath, "could not decrypt symlink target: %v", err)
+	}
+}
+
+// fsck checks the whole CIPHERDIR for corruption and exits with
+// exitcodes.FsckErrors if it found any problems.
+// This is called when you pass the "-fsck" option.
+func fsck(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	tree := ciphertree.New(args.cipherdir, masterkey,
+		confFile, ciphertree.CryptoBackend(confFile, args.openssl), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	ck := fsckObj{tree: tree}
+	// DecryptBlock and friends log every failure as a warning. We report
+	// the problems ourselves.
+	tlog.Warn.Enabled = false
+	ck.dir("")
+	tlog.Warn.Enabled = true
+	if ck.errorCount > 0 {
+		tlog.Fatal.Printf("fsck: found %d problems", ck.errorCount)
+		os.Exit(exitcodes.FsckErrors)
+	}
+	tlog.Info.Println(tlog.ColorGreen + "fsck: no problems found" + tlog.ColorReset)
+	os.Exit(0)
+}
@@ -0,0 +1,7 @@
+// +build !go1.9
+
+package main
+
+// Cause an early compile error on Go 1.8 and lower. We need Go 1.9 for
+// golang.org/x/crypto/argon2, which uses math/bits.
+import "You_need_Go_1.9_or_higher_to_compile_gocryptfs"
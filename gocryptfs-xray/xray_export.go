@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/ciphertree"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// exportObj holds the crypto helpers and the error count of a running
+// -decrypt or -encrypt.
+type exportObj struct {
+	tree *ciphertree.Tree
+	// forceDecode passes through blocks that fail the integrity check
+	// instead of giving up on the file
+	forceDecode bool
+	// errorCount is the number of files and directories that could not be
+	// processed
+	errorCount int
+	// corruptBlocks is the number of corrupt blocks that were written out
+	// because of forcedecode
+	corruptBlocks int
+}
+
+// report prints a problem with "path" and counts it.
+func (ex *exportObj) report(path string, format string, v ...interface{}) {
+	ex.errorCount++
+	fmt.Fprintf(os.Stderr, "%s: %s\n", path, fmt.Sprintf(format, v...))
+}
+
+// findCipherdir walks up from "path" until it finds a directory that
+// contains a gocryptfs.conf. Returns the CIPHERDIR and "path" relative to it.
+func findCipherdir(path string) (cipherdir string, cPath string, err error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	for dir := absPath; ; dir = filepath.Dir(dir) {
+		_, err = os.Stat(filepath.Join(dir, configfile.ConfDefaultName))
+		if err == nil {
+			cPath, err = filepath.Rel(dir, absPath)
+			if cPath == "." {
+				cPath = ""
+			}
+			return dir, cPath, err
+		}
+		if dir == "/" {
+			return "", "", fmt.Errorf("%s: no %s found in any parent directory",
+				path, configfile.ConfDefaultName)
+		}
+	}
+}
+
+// newExportObj asks for the password and sets up the crypto helpers for the
+// CIPHERDIR that "path" is in. Returns the ciphertext path of "path",
+// relative to the CIPHERDIR.
+func newExportObj(path string, extpass string, forceDecode bool) (*exportObj, string) {
+	cipherdir, cPath, err := findCipherdir(path)
+	if err != nil {
+		errExit(err)
+	}
+	pw := readpassword.Once(extpass)
+	masterkey, confFile, err := configfile.LoadConfFile(filepath.Join(cipherdir, configfile.ConfDefaultName), pw)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitcodes.Exit(err)
+	}
+	cryptoBackend := ciphertree.CryptoBackend(confFile, false)
+	if forceDecode {
+		// Only openssl can return the plaintext of a corrupt block, just
+		// like for the -forcedecode mount option.
+		if stupidgcm.BuiltWithoutOpenssl {
+			errExit(fmt.Errorf("-forcedecode requires openssl support, but %s was compiled without it", myName))
+		}
+		if cryptoBackend != cryptocore.BackendGoGCM {
+			errExit(fmt.Errorf("-forcedecode is not supported for %s filesystems", cryptoBackend))
+		}
+		cryptoBackend = cryptocore.BackendOpenSSL
+	}
+	ex := &exportObj{
+		tree:        ciphertree.New(cipherdir, masterkey, confFile, cryptoBackend, forceDecode),
+		forceDecode: forceDecode,
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	return ex, cPath
+}
+
+// setTimes copies the access and modification times of "st" to "path".
+// Errors are only logged, the data is what matters.
+func setTimes(path string, st *syscall.Stat_t) {
+	ts := syscallcompat.StatTimes(st)
+	err := syscall.UtimesNano(path, ts[:])
+	if err != nil {
+		tlog.Warn.Printf("%s: could not set times: %v", path, err)
+	}
+}
+
+// readBlocks returns the number of blocks decryptContents() and
+// encryptContents() process in one go. The results go back into PReqPool and
+// CReqPool, so this must not exceed the size of a FUSE request.
+func (ex *exportObj) readBlocks() int {
+	return fuse.MAX_KERNEL_WRITE / int(ex.tree.ContentEnc.PlainBS())
+}
+
+// decrypt decrypts the ciphertext path "cPath" (a file, symlink or a whole
+// directory tree) and stores the plaintext as "outPath".
+func (ex *exportObj) decrypt(cPath string, outPath string) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(ex.tree.Abs(cPath), &st)
+	if err != nil {
+		ex.report(cPath, "Lstat failed: %v", err)
+		return
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		ex.decryptDir(cPath, outPath, &st)
+	case syscall.S_IFREG:
+		ex.decryptFile(cPath, outPath, &st)
+	case syscall.S_IFLNK:
+		ex.decryptSymlink(cPath, outPath)
+	default:
+		ex.report(cPath, "skipping special file with mode %#o", st.Mode)
+	}
+}
+
+// decryptDir decrypts the directory "cPath" and everything below it into
+// "outPath". "outPath" may already exist.
+func (ex *exportObj) decryptDir(cPath string, outPath string, st *syscall.Stat_t) {
+	// Make sure we can write into the directory until we are done
+	err := os.Mkdir(outPath, 0700)
+	if err != nil && !os.IsExist(err) {
+		ex.report(cPath, "could not create %q: %v", outPath, err)
+		return
+	}
+	entries, err := ex.tree.ReadDir(cPath)
+	if err != nil {
+		ex.report(cPath, "could not read directory: %v", err)
+		return
+	}
+	for _, cName := range entries {
+		cChild := filepath.Join(cPath, cName)
+		pName, err := ex.tree.DecryptName(cPath, cName)
+		if err != nil {
+			ex.report(cChild, "could not decrypt name: %v", err)
+			continue
+		}
+		ex.decrypt(cChild, filepath.Join(outPath, pName))
+	}
+	err = os.Chmod(outPath, os.FileMode(st.Mode&07777))
+	if err != nil {
+		ex.report(cPath, "could not set permissions of %q: %v", outPath, err)
+	}
+	setTimes(outPath, st)
+}
+
+// decryptFile decrypts the contents of the regular file "cPath" into the new
+// file "outPath". Without forcedecode, a file that fails the integrity check
+// is deleted again.
+func (ex *exportObj) decryptFile(cPath string, outPath string, st *syscall.Stat_t) {
+	in, err := os.Open(ex.tree.Abs(cPath))
+	if err != nil {
+		ex.report(cPath, "could not open file: %v", err)
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		ex.report(cPath, "could not create %q: %v", outPath, err)
+		return
+	}
+	err = ex.decryptContents(in, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		ex.report(cPath, "%v", err)
+		os.Remove(outPath)
+		return
+	}
+	err = os.Chmod(outPath, os.FileMode(st.Mode&07777))
+	if err != nil {
+		ex.report(cPath, "could not set permissions of %q: %v", outPath, err)
+	}
+	setTimes(outPath, st)
+}
+
+// decryptContents decrypts the ciphertext file "in" and writes the plaintext
+// to "out".
+func (ex *exportObj) decryptContents(in *os.File, out *os.File) error {
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := in.ReadAt(buf, 0)
+	if err == io.EOF && n == 0 {
+		// Empty files have no header
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read file header: %v", err)
+	}
+	var fileID []byte
+	h, err := contentenc.ParseHeader(buf)
+	if err == nil {
+		fileID = h.ID
+	} else if ex.forceDecode {
+		// The file ID only goes into the authentication tag. The blocks
+		// still decrypt with a damaged ID, so we skip the 2-byte version
+		// field and use whatever is there.
+		tlog.Warn.Printf("invalid file header, overriden by forcedecode")
+		fileID = buf[2:]
+		ex.corruptBlocks++
+	} else {
+		return fmt.Errorf("invalid file header: %v", err)
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	cipherBS := int(ex.tree.ContentEnc.CipherBS())
+	overhead := int(ex.tree.ContentEnc.BlockOverhead())
+	cBuf := make([]byte, ex.readBlocks()*cipherBS)
+	var blockNo uint64
+	for {
+		off := int64(ex.tree.ContentEnc.BlockNoToCipherOff(blockNo))
+		n, err = in.ReadAt(cBuf, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read error at offset %d: %v", off, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		ciphertext := cBuf[:n]
+		eof := off+int64(n) >= fi.Size()
+		for len(ciphertext) > 0 {
+			failuresBefore := ex.tree.ContentEnc.AuthFailures()
+			plaintext, err2 := ex.tree.ContentEnc.DecryptBlocks(ciphertext, blockNo, fileID, eof)
+			if err2 == contentenc.ErrTruncated && ex.forceDecode {
+				// The blocks are fine, only the end of the file is missing
+				tlog.Warn.Printf("%v, overriden by forcedecode", err2)
+				ex.tree.ContentEnc.PReqPool.Put(plaintext)
+				plaintext, err2 = ex.tree.ContentEnc.DecryptBlocks(ciphertext, blockNo, fileID, false)
+			}
+			// DecryptBlocks only tells us about the last corrupt block it
+			// passed through, so we count them ourselves.
+			corrupt := int(ex.tree.ContentEnc.AuthFailures() - failuresBefore)
+			done := len(ciphertext)
+			if err2 != nil && !(ex.forceDecode && err2 == stupidgcm.ErrAuth) {
+				// DecryptBlocks stopped at the block that failed
+				bad := ex.tree.ContentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
+				if !ex.forceDecode {
+					ex.tree.ContentEnc.PReqPool.Put(plaintext)
+					return fmt.Errorf("corrupt block #%d: %v", blockNo+bad, err2)
+				}
+				// Not even openssl could make sense of the block. Replace it
+				// with zeros to keep the following data at the right offset.
+				tlog.Warn.Printf("corrupt block #%d: %v, replaced with zeros due to forcedecode",
+					blockNo+bad, err2)
+				done = int(bad) * cipherBS
+				l := len(ciphertext) - done
+				if l > cipherBS {
+					l = cipherBS
+				}
+				if l > overhead {
+					plaintext = append(plaintext, make([]byte, l-overhead)...)
+				}
+				done += l
+			}
+			_, err3 := out.Write(plaintext)
+			ex.tree.ContentEnc.PReqPool.Put(plaintext)
+			if err3 != nil {
+				return err3
+			}
+			ex.corruptBlocks += corrupt
+			blockNo += uint64((done + cipherBS - 1) / cipherBS)
+			ciphertext = ciphertext[done:]
+		}
+		if err == io.EOF || n < len(cBuf) {
+			return nil
+		}
+	}
+}
+
+// decryptSymlink decrypts the target of the symlink "cPath" and creates the
+// plaintext symlink "outPath".
+func (ex *exportObj) decryptSymlink(cPath string, outPath string) {
+	target, err := os.Readlink(ex.tree.Abs(cPath))
+	if err != nil {
+		ex.report(cPath, "Readlink failed: %v", err)
+		return
+	}
+	pTarget, err := ex.tree.DecryptSymlinkTarget(target)
+	if err == stupidgcm.ErrAuth && ex.forceDecode {
+		tlog.Warn.Printf("%s: corrupt symlink target, overriden by forcedecode", cPath)
+		ex.corruptBlocks++
+	} else if err != nil {
+		ex.report(cPath, "could not decrypt symlink target: %v", err)
+		return
+	}
+	target = string(pTarget)
+	err = os.Symlink(target, outPath)
+	if err != nil {
+		ex.report(cPath, "could not create %q: %v", outPath, err)
+	}
+}
+
+// encrypt encrypts the plaintext path "inPath" (a file, symlink or a whole
+// directory tree) and stores it under the relative plaintext path "pPath".
+// The parent directory of "pPath" must already exist in the CIPHERDIR.
+func (ex *exportObj) encrypt(inPath string, pPath string) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(inPath, &st)
+	if err != nil {
+		ex.report(inPath, "Lstat failed: %v", err)
+		return
+	}
+	cPath := pPath
+	if !ex.tree.PlaintextNames {
+		cPath, err = ex.tree.NameTransform.EncryptPathDirIV(pPath, ex.tree.Root)
+		if err != nil {
+			ex.report(inPath, "could not encrypt name: %v", err)
+			return
+		}
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR, syscall.S_IFREG, syscall.S_IFLNK:
+	default:
+		ex.report(inPath, "skipping special file with mode %#o", st.Mode)
+		return
+	}
+	_, err = os.Lstat(ex.tree.Abs(cPath))
+	if err == nil {
+		ex.report(inPath, "%q already exists", pPath)
+		return
+	}
+	if !ex.tree.PlaintextNames && nametransform.IsLongContent(filepath.Base(cPath)) {
+		dirfd, err := os.Open(ex.tree.Abs(nametransform.Dir(cPath)))
+		if err != nil {
+			ex.report(inPath, "could not open parent directory: %v", err)
+			return
+		}
+		err = ex.tree.NameTransform.WriteLongName(dirfd, filepath.Base(cPath), pPath)
+		dirfd.Close()
+		if err != nil {
+			ex.report(inPath, "could not write %s file: %v", nametransform.LongNameSuffix, err)
+			return
+		}
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		ex.encryptDir(inPath, pPath, cPath, &st)
+	case syscall.S_IFREG:
+		ex.encryptFile(inPath, cPath, &st)
+	case syscall.S_IFLNK:
+		ex.encryptSymlink(inPath, cPath)
+	}
+}
+
+// encryptDir creates the ciphertext directory "cPath" and encrypts everything
+// below the plaintext directory "inPath" into it.
+func (ex *exportObj) encryptDir(inPath string, pPath string, cPath string, st *syscall.Stat_t) {
+	err := os.Mkdir(ex.tree.Abs(cPath), 0700)
+	if err != nil {
+		ex.report(inPath, "could not create directory: %v", err)
+		return
+	}
+	if !ex.tree.PlaintextNames {
+		err = nametransform.WriteDirIV(ex.tree.Abs(cPath))
+		if err != nil {
+			ex.report(inPath, "could not create %s: %v", nametransform.DirIVFilename, err)
+			return
+		}
+	}
+	fd, err := os.Open(inPath)
+	if err != nil {
+		ex.report(inPath, "could not open directory: %v", err)
+		return
+	}
+	entries, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		ex.report(inPath, "could not read directory: %v", err)
+		return
+	}
+	sort.Strings(entries)
+	for _, name := range entries {
+		ex.encrypt(filepath.Join(inPath, name), filepath.Join(pPath, name))
+	}
+	err = os.Chmod(ex.tree.Abs(cPath), os.FileMode(st.Mode&07777))
+	if err != nil {
+		ex.report(inPath, "could not set permissions: %v", err)
+	}
+	setTimes(ex.tree.Abs(cPath), st)
+}
+
+// encryptFile encrypts the contents of the plaintext file "inPath" into the
+// new ciphertext file "cPath".
+func (ex *exportObj) encryptFile(inPath string, cPath string, st *syscall.Stat_t) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		ex.report(inPath, "could not open file: %v", err)
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(ex.tree.Abs(cPath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		ex.report(inPath, "could not create file: %v", err)
+		return
+	}
+	err = ex.encryptContents(in, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		ex.report(inPath, "%v", err)
+		return
+	}
+	err = os.Chmod(ex.tree.Abs(cPath), os.FileMode(st.Mode&07777))
+	if err != nil {
+		ex.report(inPath, "could not set permissions: %v", err)
+	}
+	setTimes(ex.tree.Abs(cPath), st)
+}
+
+// encryptContents encrypts the plaintext file "in" and writes the ciphertext,
+// including a new file header, to "out".
+func (ex *exportObj) encryptContents(in *os.File, out *os.File) error {
+	plainBS := int(ex.tree.ContentEnc.PlainBS())
+	pBuf := make([]byte, ex.readBlocks()*plainBS)
+	// Peeking tells us if a full read was the end of the file
+	br := bufio.NewReaderSize(in, plainBS)
+	var fileID []byte
+	var blockNo uint64
+	for {
+		n, err := io.ReadFull(br, pBuf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if fileID == nil {
+			// Empty files have no header, so we only write it once we have
+			// data.
+			h := contentenc.RandomHeader()
+			if _, err2 := out.Write(h.Pack()); err2 != nil {
+				return err2
+			}
+			fileID = h.ID
+		}
+		var blocks [][]byte
+		for p := pBuf[:n]; len(p) > 0; {
+			l := plainBS
+			if len(p) < l {
+				l = len(p)
+			}
+			blocks = append(blocks, p[:l])
+			p = p[l:]
+		}
+		eof := n < len(pBuf)
+		if !eof {
+			_, err = br.Peek(1)
+			eof = err == io.EOF
+		}
+		ciphertext := ex.tree.ContentEnc.EncryptBlocks(blocks, blockNo, fileID, eof)
+		_, err2 := out.Write(ciphertext)
+		ex.tree.ContentEnc.CReqPool.Put(ciphertext)
+		if err2 != nil {
+			return err2
+		}
+		blockNo += uint64(len(blocks))
+		if eof {
+			return nil
+		}
+	}
+}
+
+// encryptSymlink creates the ciphertext symlink "cPath" with the encrypted
+// target of the plaintext symlink "inPath".
+func (ex *exportObj) encryptSymlink(inPath string, cPath string) {
+	target, err := os.Readlink(inPath)
+	if err != nil {
+		ex.report(inPath, "Readlink failed: %v", err)
+		return
+	}
+	err = os.Symlink(ex.tree.EncryptSymlinkTarget([]byte(target)), ex.tree.Abs(cPath))
+	if err != nil {
+		ex.report(inPath, "could not create symlink: %v", err)
+	}
+}
+
+// exportTree implements "-decrypt": it decrypts "path" inside a CIPHERDIR into
+// the directory "outDir". Exits with exit code 1 if anything could not be
+// decrypted.
+func exportTree(path string, outDir string, extpass string, forceDecode bool) {
+	ex, cPath := newExportObj(path, extpass, forceDecode)
+	outPath := outDir
+	if cPath != "" {
+		err := os.MkdirAll(outDir, 0700)
+		if err != nil {
+			errExit(err)
+		}
+		pPath, err := ex.tree.DecryptPath(cPath)
+		if err != nil {
+			errExit(fmt.Errorf("%s: could not decrypt name: %v", path, err))
+		}
+		outPath = filepath.Join(outDir, filepath.Base(pPath))
+	}
+	// We report the problems ourselves
+	tlog.Warn.Enabled = forceDecode
+	ex.decrypt(cPath, outPath)
+	tlog.Warn.Enabled = true
+	if ex.corruptBlocks > 0 {
+		fmt.Fprintf(os.Stderr, "%d corrupt blocks were decrypted anyway due to -forcedecode\n",
+			ex.corruptBlocks)
+	}
+	if ex.errorCount > 0 {
+		fmt.Fprintf(os.Stderr, "%d files or directories could not be decrypted\n", ex.errorCount)
+	}
+	if ex.errorCount > 0 || ex.corruptBlocks > 0 {
+		os.Exit(1)
+	}
+}
+
+// importTree implements "-encrypt": it encrypts the plaintext file or
+// directory tree "inPath" into the ciphertext directory "path" inside a
+// CIPHERDIR. Exits with exit code 1 if anything could not be encrypted.
+func importTree(inPath string, path string, extpass string) {
+	ex, cPath := newExportObj(path, extpass, false)
+	if ex.tree.Manifests != nil {
+		// The imported entries would be missing from the manifests
+		errExit(fmt.Errorf("-encrypt does not support filesystems with directory manifests, " +
+			"copy the files into the mounted filesystem instead"))
+	}
+	fi, err := os.Stat(ex.tree.Abs(cPath))
+	if err != nil {
+		errExit(err)
+	}
+	if !fi.IsDir() {
+		errExit(fmt.Errorf("%s: not a directory", path))
+	}
+	pDir, err := ex.tree.DecryptPath(cPath)
+	if err != nil {
+		errExit(fmt.Errorf("%s: could not decrypt name: %v", path, err))
+	}
+	name := filepath.Base(filepath.Clean(inPath))
+	if name == "/" || name == "." || name == ".." {
+		errExit(fmt.Errorf("%s: cannot determine the name to import as", inPath))
+	}
+	ex.encrypt(inPath, filepath.Join(pDir, name))
+	if ex.errorCount > 0 {
+		fmt.Fprintf(os.Stderr, "%d files or directories could not be encrypted\n", ex.errorCount)
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
@@ -16,9 +18,7 @@ import (
 )
 
 const (
-	ivLen     = contentenc.DefaultIVBits / 8
-	blockSize = contentenc.DefaultBS + ivLen + cryptocore.AuthTagLen
-	myName    = "gocryptfs-xray"
+	myName = "gocryptfs-xray"
 )
 
 func errExit(err error) {
@@ -33,18 +33,40 @@ func prettyPrintHeader(h *contentenc.FileHeader) {
 
 func main() {
 	dumpmasterkey := flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
+	decrypt := flag.Bool("decrypt", false, "Decrypt a file or directory tree into OUTDIR")
+	encrypt := flag.Bool("encrypt", false, "Encrypt a file or directory tree into CIPHERDIR")
+	forcedecode := flag.Bool("forcedecode", false, "With -decrypt: write out blocks that fail the integrity check")
+	extpass := flag.String("extpass", "", "Use external program for the password prompt")
+	xchacha := flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 (192-bit IVs) when dumping FILE")
+	blocksize := flag.Uint64("blocksize", 0, "Assume this plaintext block size when dumping FILE")
 	flag.Parse()
-	if flag.NArg() != 1 {
+	nArgs := 1
+	if *decrypt || *encrypt {
+		nArgs = 2
+	}
+	if flag.NArg() != nArgs || *decrypt && *encrypt {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] FILE\n"+
+			"       %s -decrypt [OPTIONS] CIPHERDIR/PATH OUTDIR\n"+
+			"       %s -encrypt [OPTIONS] PATH CIPHERDIR/DIR\n"+
 			"\n"+
-			"Options:\n", myName)
+			"Options:\n", myName, myName, myName)
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n"+
 			"Examples:\n"+
 			"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
-			"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n")
+			"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
+			"  gocryptfs-xray -decrypt myfs/mCXnISiv7nEmyc0glGuhTQ /tmp/rescued\n"+
+			"  gocryptfs-xray -encrypt /tmp/rescued/photos myfs\n")
 		os.Exit(1)
 	}
+	if *decrypt {
+		exportTree(flag.Arg(0), flag.Arg(1), *extpass, *forcedecode)
+		return
+	}
+	if *encrypt {
+		importTree(flag.Arg(0), flag.Arg(1), *extpass)
+		return
+	}
 	fn := flag.Arg(0)
 	fd, err := os.Open(fn)
 	if err != nil {
@@ -52,15 +74,36 @@ func main() {
 	}
 	defer fd.Close()
 	if *dumpmasterkey {
-		dumpMasterKey(fn)
+		dumpMasterKey(fn, *extpass)
 	} else {
-		inspectCiphertext(fd)
+		// Use the settings of the CIPHERDIR that FILE is in, if we find it.
+		// The config file can be read without the password.
+		ivBits := contentenc.DefaultIVBits
+		plainBS := uint64(contentenc.DefaultBS)
+		compress := false
+		if cipherdir, _, err := findCipherdir(fn); err == nil {
+			_, cf, err := configfile.LoadConfFile(filepath.Join(cipherdir, configfile.ConfDefaultName), "")
+			if err == nil {
+				plainBS = cf.PlainBS()
+				compress = cf.IsFeatureFlagSet(configfile.FlagCompression)
+				if cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+					ivBits = contentenc.XChaCha20Poly1305IVBits
+				}
+			}
+		}
+		if *xchacha {
+			ivBits = contentenc.XChaCha20Poly1305IVBits
+		}
+		if *blocksize != 0 {
+			plainBS = *blocksize
+		}
+		inspectCiphertext(fd, ivBits/8, plainBS, compress)
 	}
 }
 
-func dumpMasterKey(fn string) {
+func dumpMasterKey(fn string, extpass string) {
 	tlog.Info.Enabled = false
-	pw := readpassword.Once("")
+	pw := readpassword.Once(extpass)
 	masterkey, _, err := configfile.LoadConfFile(fn, pw)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -69,7 +112,15 @@ func dumpMasterKey(fn string) {
 	fmt.Println(hex.EncodeToString(masterkey))
 }
 
-func inspectCiphertext(fd *os.File) {
+// inspectCiphertext prints the header and the IV and tag of each block of the
+// ciphertext file "fd". "ivLen" is the IV length in bytes, "plainBS" the
+// plaintext block size. "compress" is true if the blocks carry a compression
+// header.
+func inspectCiphertext(fd *os.File, ivLen int, plainBS uint64, compress bool) {
+	blockSize := int64(plainBS) + int64(ivLen) + cryptocore.AuthTagLen
+	if compress {
+		blockSize += contentenc.BlockHeaderLen
+	}
 	headerBytes := make([]byte, contentenc.HeaderLen)
 	n, err := fd.ReadAt(headerBytes, 0)
 	if err == io.EOF && n == 0 {
@@ -88,7 +139,7 @@ func inspectCiphertext(fd *os.File) {
 	prettyPrintHeader(header)
 	var i int64
 	for i = 0; ; i++ {
-		blockLen := int64(blockSize)
+		blockLen := blockSize
 		off := contentenc.HeaderLen + i*blockSize
 		iv := make([]byte, ivLen)
 		_, err := fd.ReadAt(iv, off)
@@ -97,8 +148,24 @@ func inspectCiphertext(fd *os.File) {
 		} else if err != nil {
 			errExit(err)
 		}
+		var method string
 		tag := make([]byte, cryptocore.AuthTagLen)
-		_, err = fd.ReadAt(tag, off+blockSize-cryptocore.AuthTagLen)
+		tagOff := off + blockSize - cryptocore.AuthTagLen
+		if compress {
+			hdr := make([]byte, contentenc.BlockHeaderLen)
+			if _, err = fd.ReadAt(hdr, off+int64(ivLen)); err != nil && err != io.EOF {
+				errExit(err)
+			}
+			method = fmt.Sprintf(" Method: %d", hdr[0])
+			if hdr[0] == contentenc.BlockLZ4 {
+				// The tag follows the compressed data
+				method = " Method: lz4"
+				tagOff = off + int64(ivLen) + contentenc.BlockHeaderLen + int64(binary.BigEndian.Uint16(hdr[1:]))
+			} else if hdr[0] == contentenc.BlockStored {
+				method = " Method: stored"
+			}
+		}
+		_, err = fd.ReadAt(tag, tagOff)
 		if err == io.EOF {
 			fi, err2 := fd.Stat()
 			if err2 != nil {
@@ -112,7 +179,7 @@ func inspectCiphertext(fd *os.File) {
 		} else if err != nil {
 			errExit(err)
 		}
-		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d\n",
-			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, blockLen)
+		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d%s\n",
+			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, blockLen, method)
 	}
 }
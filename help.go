@@ -7,7 +7,7 @@ import (
 )
 
 const tUsage = "" +
-	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
+	"Usage: " + tlog.ProgramName + " -init|-passwd|-info|-fsck|-addkey|-listkeys|-reencrypt [OPTIONS] CIPHERDIR\n" +
 	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
@@ -17,12 +17,15 @@ func helpShort() {
 	fmt.Printf(tUsage)
 	fmt.Printf(`
 Common Options (use -hh to show all):
+  -addkey            Add a key slot with a new password
   -aessiv            Use AES-SIV encryption (with -init)
   -allow_other       Allow other users to access the mount
+  -blocksize         Plaintext block size (with -init), 4K to 64K
   -config            Custom path to config file
   -ctlsock           Create control socket at location
   -extpass           Call external program to prompt for the password
   -fg                Stay in the foreground
+  -fsck              Check the filesystem for corruption
   -fusedebug         Debug FUSE calls
   -h, -help          This short help text
   -hh                Long help text with all options
@@ -39,6 +42,7 @@ Common Options (use -hh to show all):
   -ro                Mount read-only
   -speed             Run crypto speed test
   -version           Print version information
+  -xchacha           Use XChaCha20-Poly1305 encryption (with -init)
   --                 Stop option parsing
 `)
 }
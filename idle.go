@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// idleMonitor unmounts "mountpoint" once no file has been read or written for
+// "idle" and no file is open. Directory listings and stat() do not count as
+// activity.
+func idleMonitor(idle time.Duration, srv *fuse.Server, mountpoint string) {
+	// Check ten times per idle period, but not more often than once a second
+	interval := idle / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastOpCount uint64
+	lastActive := time.Now()
+	for range ticker.C {
+		opCount := openfiletable.ReadOpCount() + openfiletable.WriteOpCount()
+		if opCount != lastOpCount || openfiletable.CountOpenFiles() > 0 {
+			lastOpCount = opCount
+			lastActive = time.Now()
+			continue
+		}
+		if time.Since(lastActive) < idle {
+			continue
+		}
+		tlog.Info.Printf("Filesystem idle for %v, unmounting", idle)
+		unmount(srv, mountpoint)
+		return
+	}
+}
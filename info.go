@@ -37,9 +37,29 @@ func info(filename string) {
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
-	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
-	s := cf.ScryptObject
-	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if cf.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		for _, slot := range cf.KeySlots {
+			if a := slot.Argon2idObject; a != nil {
+				fmt.Printf("KeySlot:      %q EncryptedKey=%dB Argon2id Salt=%dB Memory=%dKiB Time=%d Parallelism=%d KeyLen=%d\n",
+					slot.Label, len(slot.EncryptedKey), len(a.Salt), a.Memory, a.Time, a.Parallelism, a.KeyLen)
+				continue
+			}
+			s := slot.ScryptObject
+			fmt.Printf("KeySlot:      %q EncryptedKey=%dB Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+				slot.Label, len(slot.EncryptedKey), len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+		}
+	} else {
+		fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
+		if a := cf.Argon2idObject; a != nil {
+			fmt.Printf("Argon2idObject: Salt=%dB Memory=%dKiB Time=%d Parallelism=%d KeyLen=%d\n",
+				len(a.Salt), a.Memory, a.Time, a.Parallelism, a.KeyLen)
+		} else {
+			s := cf.ScryptObject
+			fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+				len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+		}
+	}
+	fmt.Printf("BlockSize:    %d\n", cf.PlainBS())
+	fmt.Printf("LongNameMax:  %d\n", cf.NameMax())
 	os.Exit(0)
 }
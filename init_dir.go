@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
@@ -39,7 +43,31 @@ func initDir(args *argContainer) {
 	password := readpassword.Twice(args.extpass)
 	readpassword.CheckTrailingGarbage()
 	creator := tlog.ProgramName + " " + GitVersion
-	err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator, args.aessiv)
+	// The root directory manifest is authenticated with a key derived from
+	// the master key, so we need to know it.
+	var masterkey []byte
+	if args.dirmanifest {
+		masterkey = cryptocore.RandBytes(cryptocore.KeyLen)
+	}
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:          args.config,
+		Password:          password,
+		PlaintextNames:    args.plaintextnames,
+		LogN:              args.scryptn,
+		KDF:               args.kdf,
+		Creator:           creator,
+		AESSIV:            args.aessiv,
+		Xattr:             args.xattr,
+		XChaCha20Poly1305: args.xchacha,
+		BlockSize:         args._blockSize,
+		NFC:               args.nfc,
+		Base32:            args.base32,
+		LongNameMax:       args.longnamemax,
+		Compress:          args.compress,
+		LastBlockMarker:   args.lastblockmarker,
+		DirManifest:       args.dirmanifest,
+		MasterKey:         masterkey,
+	})
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.WriteConf)
@@ -53,6 +81,22 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	}
+	// ... and a gocryptfs.dirmanifest with "-dirmanifest"
+	if args.dirmanifest {
+		var cf *configfile.ConfFile
+		// An empty password only reads the feature flags
+		_, cf, err = configfile.LoadConfFile(args.config, "")
+		if err == nil {
+			err = writeRootManifest(args.cipherdir, masterkey, cf.IsFeatureFlagSet(configfile.FlagHKDF))
+		}
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Init)
+		}
+	}
 	mountArgs := ""
 	fsName := "gocryptfs"
 	if args.reverse {
@@ -75,3 +119,25 @@ func initDir(args *argContainer) {
 		tlog.ProgramName, mountArgs, friendlyPath)
 	os.Exit(0)
 }
+
+// newManifestKeeper returns the directory manifest helper for "masterkey".
+// The manifest key is derived with HKDF, so "useHKDF" must be true.
+func newManifestKeeper(masterkey []byte, useHKDF bool) *dirmanifest.Keeper {
+	// Only the derived manifest key is used, the content cipher does not
+	// matter.
+	cc := cryptocore.New(masterkey, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, useHKDF, false)
+	return dirmanifest.NewKeeper(cc.ManifestKey)
+}
+
+// writeRootManifest creates the empty manifest of the root directory of the
+// new filesystem in "cipherdir". "useHKDF" comes from the config file.
+func writeRootManifest(cipherdir string, masterkey []byte, useHKDF bool) error {
+	if !useHKDF {
+		return errors.New("directory manifests require HKDF")
+	}
+	iv, err := nametransform.ReadDirIV(cipherdir)
+	if err != nil {
+		return err
+	}
+	return newManifestKeeper(masterkey, useHKDF).Write(cipherdir, dirmanifest.New(iv, true))
+}
@@ -0,0 +1,140 @@
+// Package blockcache implements a bounded LRU cache of decrypted file content
+// blocks. It is used by fusefrontend to avoid decrypting the same blocks
+// over and over again for small random reads ("-cachesize").
+package blockcache
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+// cacheEntry is a cached plaintext block
+type cacheEntry struct {
+	qIno    openfiletable.QIno
+	blockNo uint64
+	// fileID is the file ID the block was encrypted with. A block is only
+	// returned for the same file ID, so a new file header (for example
+	// after truncating the file to zero) makes the old entries unreachable.
+	fileID []byte
+	// Plaintext content of the block. Only the last block of a file is
+	// shorter than the block size.
+	data []byte
+}
+
+// BlockCache stores up to "maxBlocks" plaintext blocks.
+type BlockCache struct {
+	sync.Mutex
+	maxBlocks int
+	// lru holds *cacheEntry values, the most recently used one at the front
+	lru *list.List
+	// files indexes the list elements by file and block number. Having
+	// a map per file makes dropping all blocks of a file cheap.
+	files map[openfiletable.QIno]map[uint64]*list.Element
+}
+
+// New returns a BlockCache that holds up to "maxBlocks" blocks.
+func New(maxBlocks int) *BlockCache {
+	return &BlockCache{
+		maxBlocks: maxBlocks,
+		lru:       list.New(),
+		files:     make(map[openfiletable.QIno]map[uint64]*list.Element),
+	}
+}
+
+// Get appends the cached plaintext of block "blockNo" of file "qi" to "dst".
+// Returns false if the block is not in the cache, or was cached with a
+// different file ID.
+func (c *BlockCache) Get(qi openfiletable.QIno, fileID []byte, blockNo uint64, dst []byte) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el := c.files[qi][blockNo]
+	if el == nil {
+		return dst, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !bytes.Equal(e.fileID, fileID) {
+		c.remove(el)
+		return dst, false
+	}
+	c.lru.MoveToFront(el)
+	return append(dst, e.data...), true
+}
+
+// Put stores a copy of "data" as the plaintext of block "blockNo" of file
+// "qi". The least recently used block is evicted if the cache is full.
+func (c *BlockCache) Put(qi openfiletable.QIno, fileID []byte, blockNo uint64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if el := c.files[qi][blockNo]; el != nil {
+		c.remove(el)
+	}
+	var buf []byte
+	if c.lru.Len() >= c.maxBlocks {
+		el := c.lru.Back()
+		if el == nil {
+			// maxBlocks is zero
+			return
+		}
+		// Recycle the memory of the evicted block
+		buf = el.Value.(*cacheEntry).data[:0]
+		c.remove(el)
+	}
+	e := &cacheEntry{
+		qIno:    qi,
+		blockNo: blockNo,
+		fileID:  append([]byte{}, fileID...),
+		data:    append(buf, data...),
+	}
+	m := c.files[qi]
+	if m == nil {
+		m = make(map[uint64]*list.Element)
+		c.files[qi] = m
+	}
+	m[blockNo] = c.lru.PushFront(e)
+}
+
+// Delete drops blocks "firstBlockNo" to "firstBlockNo+count-1" of file "qi"
+// from the cache.
+func (c *BlockCache) Delete(qi openfiletable.QIno, firstBlockNo uint64, count uint64) {
+	c.Lock()
+	defer c.Unlock()
+	m := c.files[qi]
+	if m == nil {
+		return
+	}
+	for blockNo := firstBlockNo; blockNo < firstBlockNo+count; blockNo++ {
+		if el := m[blockNo]; el != nil {
+			c.remove(el)
+		}
+	}
+}
+
+// Purge drops all blocks of file "qi" from the cache.
+func (c *BlockCache) Purge(qi openfiletable.QIno) {
+	c.Lock()
+	defer c.Unlock()
+	for _, el := range c.files[qi] {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of cached blocks.
+func (c *BlockCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// remove drops the list element "el" from the cache.
+// Caller must hold the lock.
+func (c *BlockCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	m := c.files[e.qIno]
+	delete(m, e.blockNo)
+	if len(m) == 0 {
+		delete(c.files, e.qIno)
+	}
+}
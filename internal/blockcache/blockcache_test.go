@@ -0,0 +1,82 @@
+package blockcache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+var (
+	qi1    = openfiletable.QIno{Dev: 1, Ino: 1}
+	qi2    = openfiletable.QIno{Dev: 1, Ino: 2}
+	fileID = []byte("0123456789abcdef")
+)
+
+func TestGetPut(t *testing.T) {
+	c := New(10)
+	if _, ok := c.Get(qi1, fileID, 0, nil); ok {
+		t.Error("empty cache returned a block")
+	}
+	data := []byte("foo")
+	c.Put(qi1, fileID, 0, data)
+	// The cache must keep its own copy
+	data[0] = 'x'
+	have, ok := c.Get(qi1, fileID, 0, []byte("bar"))
+	if !ok || string(have) != "barfoo" {
+		t.Errorf("got %q, %v", have, ok)
+	}
+	if _, ok = c.Get(qi2, fileID, 0, nil); ok {
+		t.Error("got a block of the wrong file")
+	}
+	// A different file ID means the file has a new header
+	if _, ok = c.Get(qi1, []byte("fedcba9876543210"), 0, nil); ok {
+		t.Error("got a block with the wrong file ID")
+	}
+	if c.Len() != 0 {
+		t.Errorf("block with the wrong file ID was not dropped, len=%d", c.Len())
+	}
+}
+
+// Test that the least recently used block is evicted
+func TestEvict(t *testing.T) {
+	c := New(3)
+	for i := uint64(0); i < 3; i++ {
+		c.Put(qi1, fileID, i, []byte{byte(i)})
+	}
+	c.Get(qi1, fileID, 0, nil)
+	c.Put(qi1, fileID, 3, []byte{3})
+	if c.Len() != 3 {
+		t.Errorf("wrong len %d", c.Len())
+	}
+	if _, ok := c.Get(qi1, fileID, 1, nil); ok {
+		t.Error("block 1 should have been evicted")
+	}
+	for _, i := range []uint64{0, 2, 3} {
+		have, ok := c.Get(qi1, fileID, i, nil)
+		if !ok || !bytes.Equal(have, []byte{byte(i)}) {
+			t.Errorf("block %d: got %v, %v", i, have, ok)
+		}
+	}
+}
+
+func TestDeletePurge(t *testing.T) {
+	c := New(10)
+	for i := uint64(0); i < 4; i++ {
+		c.Put(qi1, fileID, i, []byte("x"))
+		c.Put(qi2, fileID, i, []byte("x"))
+	}
+	c.Delete(qi1, 1, 2)
+	for i, want := range []bool{true, false, false, true} {
+		if _, ok := c.Get(qi1, fileID, uint64(i), nil); ok != want {
+			t.Errorf("Delete: block %d: want %v", i, want)
+		}
+	}
+	c.Purge(qi1)
+	if c.Len() != 4 {
+		t.Errorf("Purge dropped the wrong blocks, len=%d", c.Len())
+	}
+	if _, ok := c.Get(qi2, fileID, 3, nil); !ok {
+		t.Error("Purge dropped a block of the wrong file")
+	}
+}
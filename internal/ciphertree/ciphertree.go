@@ -0,0 +1,240 @@
+// Package ciphertree gives access to a CIPHERDIR without mounting it.
+//
+// The offline tools ("-fsck", "-reencrypt" and gocryptfs-xray) work on the
+// ciphertext directly. They set up their crypto helpers from the config
+// file, recognize gocryptfs metadata and walk the directory tree through
+// this package, so that every feature flag is handled in one place.
+package ciphertree
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// Tree is an unlocked CIPHERDIR.
+type Tree struct {
+	// Root is the absolute path to the CIPHERDIR
+	Root string
+	// PlaintextNames is true if the filesystem does not encrypt file names
+	PlaintextNames bool
+	// LongNames is true if long encrypted names are hashed
+	LongNames bool
+	// NFC is true if file names are normalized to Unicode NFC
+	NFC bool
+	// Xattr is true if extended attributes are encrypted
+	Xattr bool
+	// Filename encryption helper
+	NameTransform *nametransform.NameTransform
+	// Content encryption helper
+	ContentEnc *contentenc.ContentEnc
+	// Directory manifest helper. Nil if the filesystem has no manifests.
+	Manifests *dirmanifest.Keeper
+	// extraRoot and extra contain names that AddMetadata() has declared
+	// gocryptfs metadata, in the root directory and in every directory.
+	extraRoot map[string]bool
+	extra     map[string]bool
+}
+
+// CryptoBackend returns the content encryption backend that "confFile" asks
+// for. For AES-GCM, "openssl" selects OpenSSL instead of Go.
+func CryptoBackend(confFile *configfile.ConfFile, openssl bool) cryptocore.AEADTypeEnum {
+	if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		return cryptocore.BackendAESSIV
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		return cryptocore.BackendXChaCha20Poly1305
+	}
+	if openssl {
+		return cryptocore.BackendOpenSSL
+	}
+	return cryptocore.BackendGoGCM
+}
+
+// New sets up the crypto helpers for "masterkey" according to the feature
+// flags in "confFile". "root" is the CIPHERDIR. The caller is responsible for
+// purging "masterkey" from memory.
+func New(root string, masterkey []byte, confFile *configfile.ConfFile, backend cryptocore.AEADTypeEnum, forceDecode bool) *Tree {
+	useHKDF := confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+	cc := cryptocore.New(masterkey, backend, contentenc.BackendIVBits(backend), useHKDF, forceDecode)
+	t := &Tree{
+		Root:           root,
+		PlaintextNames: confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:      confFile.IsFeatureFlagSet(configfile.FlagLongNames),
+		NFC:            confFile.IsFeatureFlagSet(configfile.FlagNFC),
+		Xattr:          confFile.IsFeatureFlagSet(configfile.FlagXattr),
+		ContentEnc: contentenc.New(cc, confFile.PlainBS(), forceDecode,
+			confFile.IsFeatureFlagSet(configfile.FlagCompression)),
+		extraRoot: make(map[string]bool),
+		extra:     make(map[string]bool),
+	}
+	t.ContentEnc.SetLastBlockMarker(confFile.IsFeatureFlagSet(configfile.FlagLastBlockMarker))
+	t.NameTransform = nametransform.New(cc.EMECipher, t.LongNames, confFile.NameMax(),
+		confFile.IsFeatureFlagSet(configfile.FlagRaw64), t.NFC,
+		confFile.IsFeatureFlagSet(configfile.FlagBase32))
+	if confFile.IsFeatureFlagSet(configfile.FlagDirManifest) {
+		t.Manifests = dirmanifest.NewKeeper(cc.ManifestKey)
+	}
+	return t
+}
+
+// Abs returns the absolute path of the relative ciphertext path "cPath".
+func (t *Tree) Abs(cPath string) string {
+	return filepath.Join(t.Root, cPath)
+}
+
+// AddMetadata declares "name" a gocryptfs-internal file, either only in the
+// root directory or in every directory. Used for files like a config file
+// at a custom location.
+func (t *Tree) AddMetadata(name string, rootOnly bool) {
+	if rootOnly {
+		t.extraRoot[name] = true
+	} else {
+		t.extra[name] = true
+	}
+}
+
+// IsMetadata returns true if "cName" in the ciphertext directory "cDir" is a
+// gocryptfs-internal file rather than an encrypted entry.
+func (t *Tree) IsMetadata(cDir string, cName string) bool {
+	if cDir == "" && (cName == configfile.ConfDefaultName || t.extraRoot[cName]) {
+		return true
+	}
+	if t.extra[cName] {
+		return true
+	}
+	if t.PlaintextNames {
+		return false
+	}
+	if cName == nametransform.DirIVFilename {
+		return true
+	}
+	if t.Manifests != nil && dirmanifest.IsSpecial(cName, cDir == "") {
+		return true
+	}
+	return t.LongNames && nametransform.NameType(cName) == nametransform.LongNameFilename
+}
+
+// ReadDir returns the entries of the ciphertext directory "cDir" without
+// gocryptfs metadata, sorted by name.
+func (t *Tree) ReadDir(cDir string) ([]string, error) {
+	fd, err := os.Open(t.Abs(cDir))
+	if err != nil {
+		return nil, err
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	entries := names[:0]
+	for _, name := range names {
+		if !t.IsMetadata(cDir, name) {
+			entries = append(entries, name)
+		}
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// WalkFunc is called by Walk for every entry with its relative ciphertext
+// path and its Lstat result.
+type WalkFunc func(cPath string, st *syscall.Stat_t) error
+
+// Walk calls "fn" for every entry in the ciphertext directory "cDir" and
+// below, skipping gocryptfs metadata. Directories are visited before their
+// contents. Walk stops at the first error and returns it.
+func (t *Tree) Walk(cDir string, fn WalkFunc) error {
+	entries, err := t.ReadDir(cDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range entries {
+		cPath := filepath.Join(cDir, name)
+		var st syscall.Stat_t
+		if err = syscall.Lstat(t.Abs(cPath), &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: cPath, Err: err}
+		}
+		if err = fn(cPath, &st); err != nil {
+			return err
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err = t.Walk(cPath, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DecryptName decrypts the name "cName" of an entry in the ciphertext
+// directory "cDir", reading the ".name" file for long names.
+func (t *Tree) DecryptName(cDir string, cName string) (string, error) {
+	if t.PlaintextNames {
+		return cName, nil
+	}
+	iv, err := nametransform.ReadDirIV(t.Abs(cDir))
+	if err != nil {
+		return "", err
+	}
+	return t.DecryptNameIV(cDir, cName, iv)
+}
+
+// DecryptNameIV is like DecryptName, but takes the directory IV "iv" of
+// "cDir" instead of reading it.
+func (t *Tree) DecryptNameIV(cDir string, cName string, iv []byte) (string, error) {
+	if t.LongNames && nametransform.IsLongContent(cName) {
+		var err error
+		cName, err = nametransform.ReadLongName(t.Abs(filepath.Join(cDir, cName)))
+		if err != nil {
+			return "", err
+		}
+	}
+	return t.NameTransform.DecryptName(cName, iv)
+}
+
+// DecryptPath decrypts the relative ciphertext path "cPath" component by
+// component.
+func (t *Tree) DecryptPath(cPath string) (string, error) {
+	if cPath == "" {
+		return "", nil
+	}
+	pDir, err := t.DecryptPath(nametransform.Dir(cPath))
+	if err != nil {
+		return "", err
+	}
+	pName, err := t.DecryptName(nametransform.Dir(cPath), filepath.Base(cPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(pDir, pName), nil
+}
+
+// DecryptSymlinkTarget decrypts the symlink target "cTarget". With
+// forcedecode, a corrupt target is returned together with the error.
+func (t *Tree) DecryptSymlinkTarget(cTarget string) ([]byte, error) {
+	if t.PlaintextNames {
+		return []byte(cTarget), nil
+	}
+	// Symlinks are encrypted like file contents (GCM) and base64-encoded
+	cBinTarget, err := t.NameTransform.B64.DecodeString(cTarget)
+	if err != nil {
+		return nil, err
+	}
+	return t.ContentEnc.DecryptBlock(cBinTarget, 0, nil)
+}
+
+// EncryptSymlinkTarget encrypts the symlink target "target".
+func (t *Tree) EncryptSymlinkTarget(target []byte) string {
+	if t.PlaintextNames {
+		return string(target)
+	}
+	return t.NameTransform.B64.EncodeToString(t.ContentEnc.EncryptBlock(target, 0, nil))
+}
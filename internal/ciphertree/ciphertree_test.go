@@ -0,0 +1,92 @@
+package ciphertree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newTestTree creates a CIPHERDIR with a config file and returns the tree
+// for it.
+func newTestTree(t *testing.T) *Tree {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-ciphertree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename: conf,
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(dir); err != nil {
+		t.Fatal(err)
+	}
+	return New(dir, key, cf, CryptoBackend(cf, false), false)
+}
+
+func TestWalk(t *testing.T) {
+	tree := newTestTree(t)
+	defer os.RemoveAll(tree.Root)
+	iv, err := nametransform.ReadDirIV(tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cDir := tree.NameTransform.EncryptName("dir", iv)
+	if err = os.Mkdir(tree.Abs(cDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(tree.Abs(cDir)); err != nil {
+		t.Fatal(err)
+	}
+	iv2, err := nametransform.ReadDirIV(tree.Abs(cDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cLink := filepath.Join(cDir, tree.NameTransform.EncryptName("link", iv2))
+	if err = os.Symlink(tree.EncryptSymlinkTarget([]byte("target")), tree.Abs(cLink)); err != nil {
+		t.Fatal(err)
+	}
+	// The config file and the gocryptfs.diriv files are skipped
+	var seen []string
+	err = tree.Walk("", func(cPath string, st *syscall.Stat_t) error {
+		seen = append(seen, cPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != cDir || seen[1] != cLink {
+		t.Fatalf("wrong entries: %v", seen)
+	}
+	pPath, err := tree.DecryptPath(cLink)
+	if err != nil || pPath != "dir/link" {
+		t.Errorf("DecryptPath: got %q, err=%v", pPath, err)
+	}
+	cTarget, err := os.Readlink(tree.Abs(cLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := tree.DecryptSymlinkTarget(cTarget)
+	if err != nil || string(target) != "target" {
+		t.Errorf("DecryptSymlinkTarget: got %q, err=%v", target, err)
+	}
+	// A tree with another key cannot decrypt the target
+	other := New(tree.Root, cryptocore.RandBytes(cryptocore.KeyLen), &configfile.ConfFile{}, cryptocore.BackendGoGCM, false)
+	if _, err = other.DecryptSymlinkTarget(cTarget); err == nil {
+		t.Error("symlink target decrypted with the wrong key")
+	}
+}
@@ -0,0 +1,95 @@
+package configfile
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// Argon2idDefaultMemory is the default argon2id memory parameter in KiB.
+	// Together with the time and parallelism defaults, this is the second
+	// recommended option from RFC9106, section 4.
+	Argon2idDefaultMemory = 64 * 1024
+	// Argon2idDefaultTime is the default number of argon2id passes.
+	Argon2idDefaultTime = 3
+	// Argon2idDefaultParallelism is the default number of argon2id lanes.
+	Argon2idDefaultParallelism = 4
+	// The OWASP Password Storage Cheat Sheet lists m=19MiB, t=2, p=1 as the
+	// minimum configuration. We reject all lower values that we might get
+	// through modified config files.
+	argon2idMinMemory      = 19 * 1024
+	argon2idMinTime        = 2
+	argon2idMinParallelism = 1
+	// We always generate 32-byte salts. Anything smaller than that is rejected.
+	argon2idMinSaltLen = 32
+)
+
+// Argon2idKDF is an instance of the argon2id key deriviation function.
+type Argon2idKDF struct {
+	// Salt is the random salt that is passed to argon2id
+	Salt []byte
+	// Memory is the memory cost in KiB
+	Memory uint32
+	// Time is the number of passes over the memory
+	Time uint32
+	// Parallelism is the number of lanes (threads)
+	Parallelism uint8
+	// KeyLen is the output data length
+	KeyLen int
+}
+
+// NewArgon2idKDF returns a new instance of Argon2idKDF with the default
+// parameters.
+func NewArgon2idKDF() Argon2idKDF {
+	return Argon2idKDF{
+		Salt:        cryptocore.RandBytes(cryptocore.KeyLen),
+		Memory:      Argon2idDefaultMemory,
+		Time:        Argon2idDefaultTime,
+		Parallelism: Argon2idDefaultParallelism,
+		KeyLen:      cryptocore.KeyLen,
+	}
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2idKDF) DeriveKey(pw string) []byte {
+	if err := a.validateParams(); err != nil {
+		tlog.Fatal.Printf("Fatal: %v", err)
+		os.Exit(exitcodes.Argon2idParams)
+	}
+
+	return argon2.IDKey([]byte(pw), a.Salt, a.Time, a.Memory, a.Parallelism, uint32(a.KeyLen))
+}
+
+// validateParams checks that all parameters are at or above hardcoded limits.
+// If not, it returns an error with the exit code Argon2idParams.
+// This makes sure we do not get weak parameters passed through a
+// rougue gocryptfs.conf.
+func (a *Argon2idKDF) validateParams() error {
+	if a.Memory < argon2idMinMemory {
+		return exitcodes.NewErr(fmt.Sprintf("argon2id parameter Memory below minimum: value=%d, min=%d", a.Memory, argon2idMinMemory),
+			exitcodes.Argon2idParams)
+	}
+	if a.Time < argon2idMinTime {
+		return exitcodes.NewErr(fmt.Sprintf("argon2id parameter Time below minimum: value=%d, min=%d", a.Time, argon2idMinTime),
+			exitcodes.Argon2idParams)
+	}
+	if a.Parallelism < argon2idMinParallelism {
+		return exitcodes.NewErr(fmt.Sprintf("argon2id parameter Parallelism below minimum: value=%d, min=%d", a.Parallelism, argon2idMinParallelism),
+			exitcodes.Argon2idParams)
+	}
+	if len(a.Salt) < argon2idMinSaltLen {
+		return exitcodes.NewErr(fmt.Sprintf("argon2id salt length below minimum: value=%d, min=%d", len(a.Salt), argon2idMinSaltLen),
+			exitcodes.Argon2idParams)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		return exitcodes.NewErr(fmt.Sprintf("argon2id parameter KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen),
+			exitcodes.Argon2idParams)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test creating a config file with argon2id and switching it to scrypt
+func TestArgon2id(t *testing.T) {
+	fn := "config_test/tmp.conf"
+	err := CreateConfFile(&CreateArgs{
+		Filename: fn,
+		Password: "test",
+		KDF:      KDFArgon2id,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagArgon2id) || cf.Argon2idObject == nil || cf.KDF() != KDFArgon2id {
+		t.Fatal("argon2id is not used")
+	}
+	if _, _, err = LoadConfFile(fn, "wrong"); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	cf.EncryptKey(key, "test", KDFScrypt, 10)
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key2, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Error("wrong master key")
+	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) || cf.Argon2idObject != nil || cf.ScryptLogN() != 10 {
+		t.Error("config was not switched to scrypt")
+	}
+}
+
+// Test that the Argon2id feature flag tracks the key slots
+func TestArgon2idKeySlots(t *testing.T) {
+	fn := "config_test/tmp.conf"
+	err := CreateConfFile(&CreateArgs{
+		Filename: fn,
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.AddKeySlot(key, "second", KDFArgon2id, 0, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag should be set")
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pw := range []string{"test", "second"} {
+		if _, _, err = LoadConfFile(fn, pw); err != nil {
+			t.Errorf("password %q: %v", pw, err)
+		}
+	}
+	if err = cf.RemoveKeySlot("second"); err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag should be cleared")
+	}
+}
+
+func BenchmarkArgon2id(b *testing.B) {
+	kdf := NewArgon2idKDF()
+	for i := 0; i < b.N; i++ {
+		kdf.DeriveKey("test")
+	}
+}
@@ -6,15 +6,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 import "os"
 
 const (
+	// KDFScrypt selects scrypt for password hashing. This is the default.
+	KDFScrypt = "scrypt"
+	// KDFArgon2id selects argon2id for password hashing.
+	KDFArgon2id = "argon2id"
 	// ConfDefaultName is the default configuration file name.
 	// The dot "." is not used in base64url (RFC4648), hence
 	// we can never clash with an encrypted file.
@@ -32,10 +39,23 @@ type ConfFile struct {
 	// technical info is contained in FeatureFlags.
 	Creator string
 	// EncryptedKey holds an encrypted AES key, unlocked using a password
-	// hashed with scrypt
+	// hashed with scrypt or argon2id. Empty if the KeySlots feature flag is set.
 	EncryptedKey []byte
-	// ScryptObject stores parameters for scrypt hashing (key derivation)
+	// ScryptObject stores parameters for scrypt hashing (key derivation).
+	// Empty if the KeySlots feature flag is set or if argon2id is used.
 	ScryptObject ScryptKDF
+	// Argon2idObject stores parameters for argon2id hashing. If set, it is
+	// used instead of ScryptObject.
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
+	// KeySlots holds independently encrypted copies of the master key. Only
+	// used if the KeySlots feature flag is set.
+	KeySlots []KeySlot `json:",omitempty"`
+	// BlockSize is the plaintext block size of file contents. Only used if
+	// the BlockSize feature flag is set, 4096 bytes otherwise.
+	BlockSize uint64 `json:",omitempty"`
+	// LongNameMax is the longest encrypted name that is stored as it is.
+	// Only used if the LongNameMax feature flag is set, 255 bytes otherwise.
+	LongNameMax int `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
@@ -45,21 +65,59 @@ type ConfFile struct {
 	FeatureFlags []string
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
+	// activeSlot is the index of the key slot that EncryptKey() writes to.
+	// This is the slot that was unlocked by LoadConfFile(). Not exported to
+	// JSON.
+	activeSlot int
+}
+
+// CreateArgs exists because the argument list to CreateConfFile kept growing.
+type CreateArgs struct {
+	Filename       string
+	Password       string
+	PlaintextNames bool
+	LogN           int
+	Creator        string
+	AESSIV         bool
+	// Xattr enables extended attribute encryption
+	Xattr bool
+	// XChaCha20Poly1305 selects XChaCha20-Poly1305 content encryption
+	XChaCha20Poly1305 bool
+	// KDF is KDFScrypt or KDFArgon2id. Empty means KDFScrypt.
+	KDF string
+	// BlockSize is the plaintext block size. Zero means
+	// contentenc.DefaultBS.
+	BlockSize uint64
+	// NFC enables Unicode NFC normalization of file names
+	NFC bool
+	// Base32 selects lower-case base32 for encrypted file names
+	Base32 bool
+	// LongNameMax is the long name threshold. Zero means 255.
+	LongNameMax int
+	// Compress enables compression of file content blocks
+	Compress bool
+	// LastBlockMarker enables authentication of the file length
+	LastBlockMarker bool
+	// DirManifest enables authenticated directory manifests
+	DirManifest bool
+	// MasterKey is the master key to store. Nil means that a new random key
+	// is generated.
+	MasterKey []byte
 }
 
 // CreateConfFile - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func CreateConfFile(filename string, password string, plaintextNames bool, logN int, creator string, aessiv bool) error {
+// "Password" and write it to "Filename".
+// Uses scrypt with cost parameter "LogN", or argon2id if "KDF" says so.
+func CreateConfFile(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
@@ -67,17 +125,67 @@ func CreateConfFile(filename string, password string, plaintextNames bool, logN
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
+	if args.Xattr {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXattr])
+	}
+	if args.XChaCha20Poly1305 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXChaCha20Poly1305])
+	}
+	if args.NFC {
+		if args.PlaintextNames {
+			return fmt.Errorf("NFC normalization requires encrypted file names")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNFC])
+	}
+	if args.Base32 {
+		if args.PlaintextNames {
+			return fmt.Errorf("base32 name encoding requires encrypted file names")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBase32])
+	}
+	if args.LongNameMax != 0 && args.LongNameMax != syscall.NAME_MAX {
+		if args.PlaintextNames {
+			return fmt.Errorf("a long name threshold requires encrypted file names")
+		}
+		if err := nametransform.CheckLongNameMax(args.LongNameMax, args.Base32); err != nil {
+			return err
+		}
+		cf.LongNameMax = args.LongNameMax
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNameMax])
+	}
+	if args.BlockSize != 0 && args.BlockSize != contentenc.DefaultBS {
+		if err := contentenc.CheckBlockSize(args.BlockSize); err != nil {
+			return err
+		}
+		cf.BlockSize = args.BlockSize
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBlockSize])
+	}
+	if args.Compress {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagCompression])
+	}
+	if args.LastBlockMarker {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLastBlockMarker])
+	}
+	if args.DirManifest {
+		if args.PlaintextNames {
+			return fmt.Errorf("directory manifests require encrypted file names")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirManifest])
+	}
 
 	// Generate new random master key
-	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	key := args.MasterKey
+	if key == nil {
+		key = cryptocore.RandBytes(cryptocore.KeyLen)
+	}
 
 	// Encrypt it using the password
-	// This sets ScryptObject and EncryptedKey
+	// This sets ScryptObject or Argon2idObject, and EncryptedKey
 	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-	cf.EncryptKey(key, password, logN)
+	cf.EncryptKey(key, args.Password, args.KDF, args.LogN)
 
 	// Write file to disk
 	return cf.WriteFile()
@@ -146,43 +254,204 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 
 		return nil, nil, fmt.Errorf("Deprecated filesystem")
 	}
+	if cf.IsFeatureFlagSet(FlagBlockSize) {
+		if err := contentenc.CheckBlockSize(cf.BlockSize); err != nil {
+			return nil, nil, err
+		}
+	} else if cf.BlockSize != 0 {
+		return nil, nil, fmt.Errorf("BlockSize is set, but feature flag %q is not", knownFlags[FlagBlockSize])
+	}
+	if cf.IsFeatureFlagSet(FlagLongNameMax) {
+		err := nametransform.CheckLongNameMax(cf.LongNameMax, cf.IsFeatureFlagSet(FlagBase32))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if cf.LongNameMax != 0 {
+		return nil, nil, fmt.Errorf("LongNameMax is set, but feature flag %q is not", knownFlags[FlagLongNameMax])
+	}
+	if cf.IsFeatureFlagSet(FlagKeySlots) && len(cf.KeySlots) == 0 {
+		return nil, nil, fmt.Errorf("Feature flag %q is set, but there are no key slots", knownFlags[FlagKeySlots])
+	}
 	if password == "" {
 		// We have validated the config file, but without a password we cannot
 		// decrypt the master key. Return only the parsed config.
 		return nil, &cf, nil
 	}
 
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		key, err := cf.unlockKeySlots(password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &cf, nil
+	}
+	kdf := pickKDF(&cf.ScryptObject, cf.Argon2idObject)
+	// Refuse weak parameters from a rogue config file
+	if err := kdf.validateParams(); err != nil {
+		return nil, nil, err
+	}
+	key, err := cf.decryptKey(cf.EncryptedKey, kdf, password)
+	if err != nil {
+		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		return nil, nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+
+	return key, &cf, err
+}
+
+// kdf is implemented by ScryptKDF and Argon2idKDF
+type kdf interface {
+	DeriveKey(pw string) []byte
+	validateParams() error
+}
+
+// pickKDF returns the KDF a key has been encrypted with: argon2id if its
+// parameters are stored, scrypt otherwise.
+func pickKDF(scryptObject *ScryptKDF, argon2idObject *Argon2idKDF) kdf {
+	if argon2idObject != nil {
+		return argon2idObject
+	}
+	return scryptObject
+}
+
+// decryptKey decrypts the master key "encryptedKey" using a hash
+// generated from "password" by "kdf". The caller must have checked the
+// parameters of "kdf" using validateParams().
+func (cf *ConfFile) decryptKey(encryptedKey []byte, kdf kdf, password string) ([]byte, error) {
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptHash := kdf.DeriveKey(password)
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	key, err := ce.DecryptBlock(encryptedKey, 0, nil)
 	tlog.Warn.Enabled = true
-	if err != nil {
-		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
-	}
-
-	return key, &cf, err
+	return key, err
 }
 
-// EncryptKey - encrypt "key" using an scrypt hash generated from "password"
+// EncryptKey - encrypt "key" using a hash generated from "password"
 // and store it in cf.EncryptedKey.
-// Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
-func (cf *ConfFile) EncryptKey(key []byte, password string, logN int) {
+// "kdf" selects the hash function. For KDFScrypt (or ""), scrypt with cost
+// parameter logN is used and the parameters are stored in cf.ScryptObject.
+// For KDFArgon2id, argon2id with the default parameters is used and the
+// parameters are stored in cf.Argon2idObject.
+// If the KeySlots feature flag is set, the key is stored in the key slot
+// that has been unlocked by LoadConfFile (or the last one added by
+// AddKeySlot) instead.
+func (cf *ConfFile) EncryptKey(key []byte, password string, kdf string, logN int) {
+	slot := cf.WrapKey(key, password, kdf, logN)
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		cf.KeySlots[cf.activeSlot].ScryptObject = slot.ScryptObject
+		cf.KeySlots[cf.activeSlot].Argon2idObject = slot.Argon2idObject
+		cf.KeySlots[cf.activeSlot].EncryptedKey = slot.EncryptedKey
+	} else {
+		cf.ScryptObject = slot.ScryptObject
+		cf.Argon2idObject = slot.Argon2idObject
+		cf.EncryptedKey = slot.EncryptedKey
+	}
+	cf.updateArgon2idFlag()
+}
+
+// WrapKey encrypts "key" like EncryptKey, but returns the result as an
+// unlabeled KeySlot instead of storing it in the config file.
+func (cf *ConfFile) WrapKey(key []byte, password string, kdf string, logN int) KeySlot {
 	// Generate derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	var slot KeySlot
+	var scryptHash []byte
+	switch kdf {
+	case KDFArgon2id:
+		a := NewArgon2idKDF()
+		slot.Argon2idObject = &a
+		scryptHash = a.DeriveKey(password)
+	case KDFScrypt, "":
+		slot.ScryptObject = NewScryptKDF(logN)
+		scryptHash = slot.ScryptObject.DeriveKey(password)
+	default:
+		log.Panicf("unknown KDF %q", kdf)
+	}
 
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	slot.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	return slot
+}
+
+// UnwrapKey decrypts the key in "slot" using "password".
+func (cf *ConfFile) UnwrapKey(slot *KeySlot, password string) ([]byte, error) {
+	kdf := pickKDF(&slot.ScryptObject, slot.Argon2idObject)
+	if err := kdf.validateParams(); err != nil {
+		return nil, err
+	}
+	return cf.decryptKey(slot.EncryptedKey, kdf, password)
+}
+
+// KDF returns KDFScrypt or KDFArgon2id, depending on what the key that
+// EncryptKey writes to is currently encrypted with.
+func (cf *ConfFile) KDF() string {
+	a := cf.Argon2idObject
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		a = cf.KeySlots[cf.activeSlot].Argon2idObject
+	}
+	if a != nil {
+		return KDFArgon2id
+	}
+	return KDFScrypt
+}
+
+// ScryptLogN returns the scrypt cost parameter of the key that EncryptKey
+// writes to. If that key uses argon2id, ScryptDefaultLogN is returned.
+func (cf *ConfFile) ScryptLogN() int {
+	if cf.KDF() != KDFScrypt {
+		return ScryptDefaultLogN
+	}
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		return cf.KeySlots[cf.activeSlot].ScryptObject.LogN()
+	}
+	return cf.ScryptObject.LogN()
+}
+
+// updateArgon2idFlag sets the Argon2id feature flag if any key uses argon2id
+// and clears it otherwise. Versions of gocryptfs that do not know argon2id
+// will then refuse the config file instead of failing on the empty
+// ScryptObject.
+func (cf *ConfFile) updateArgon2idFlag() {
+	used := cf.Argon2idObject != nil
+	for _, slot := range cf.KeySlots {
+		if slot.Argon2idObject != nil {
+			used = true
+		}
+	}
+	flag := knownFlags[FlagArgon2id]
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != flag {
+			flags = append(flags, f)
+		}
+	}
+	if used {
+		flags = append(flags, flag)
+	}
+	cf.FeatureFlags = flags
+}
+
+// PlainBS returns the plaintext block size of the filesystem.
+func (cf *ConfFile) PlainBS() uint64 {
+	if cf.IsFeatureFlagSet(FlagBlockSize) {
+		return cf.BlockSize
+	}
+	return contentenc.DefaultBS
+}
+
+// NameMax returns the longest encrypted name that is not hashed into a long
+// name.
+func (cf *ConfFile) NameMax() int {
+	if cf.IsFeatureFlagSet(FlagLongNameMax) {
+		return cf.LongNameMax
+	}
+	return syscall.NAME_MAX
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
@@ -227,6 +496,6 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 		IVLen = contentenc.DefaultIVBits
 	}
 	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
-	ce := contentenc.New(cc, 4096, false)
+	ce := contentenc.New(cc, 4096, false, false)
 	return ce
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -33,6 +34,31 @@ func TestLoadV2(t *testing.T) {
 	}
 }
 
+// Weak KDF parameters in a config file must be reported as an error instead
+// of exiting the process.
+func TestLoadWeakScrypt(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ScryptObject.N = 1 << 4
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", "test")
+	if _, ok := err.(exitcodes.Err); !ok {
+		t.Errorf("want an exitcodes.Err, got %v", err)
+	}
+}
+
 func TestLoadV2PwdError(t *testing.T) {
 	if !testing.Verbose() {
 		tlog.Warn.Enabled = false
@@ -60,7 +86,11 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", false)
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,7 +111,12 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", true, 10, "test", false)
+	err := CreateConfFile(&CreateArgs{
+		Filename:       "config_test/tmp.conf",
+		Password:       "test",
+		PlaintextNames: true,
+		LogN:           10,
+		Creator:        "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,7 +137,12 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", true)
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		AESSIV:   true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,6 +155,81 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfFileXattr(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		Xattr:    true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagXattr) {
+		t.Error("Xattr flag should be set but is not")
+	}
+}
+
+func TestCreateConfFileBlockSize(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  "test",
+		LogN:      10,
+		Creator:   "test",
+		BlockSize: 65536})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagBlockSize) || c.PlainBS() != 65536 {
+		t.Errorf("wrong block size %d", c.PlainBS())
+	}
+	err = CreateConfFile(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  "test",
+		LogN:      10,
+		Creator:   "test",
+		BlockSize: 5000})
+	if err == nil {
+		t.Error("invalid block size should be rejected")
+	}
+}
+
+func TestCreateConfFileLongNameMax(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename:    "config_test/tmp.conf",
+		Password:    "test",
+		LogN:        10,
+		Creator:     "test",
+		LongNameMax: 143})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagLongNameMax) || c.NameMax() != 143 {
+		t.Errorf("wrong long name threshold %d", c.NameMax())
+	}
+	err = CreateConfFile(&CreateArgs{
+		Filename:    "config_test/tmp.conf",
+		Password:    "test",
+		LogN:        10,
+		Creator:     "test",
+		LongNameMax: 20})
+	if err == nil {
+		t.Error("invalid long name threshold should be rejected")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
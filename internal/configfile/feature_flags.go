@@ -22,21 +22,64 @@ const (
 	// FlagHKDF enables HKDF-derived keys for use with GCM, EME and SIV
 	// instead of directly using the master key (GCM and EME) or the SHA-512
 	// hashed master key (SIV).
-	// Note that this flag does not change the password hashing algorithm
-	// which always is scrypt.
+	// Note that this flag does not change the password hashing algorithm.
 	FlagHKDF
+	// FlagXattr indicates that extended attributes are encrypted and stored
+	// as "user.gocryptfs.*" attributes on the backing files.
+	FlagXattr
+	// FlagKeySlots indicates that the master key is stored in one or more
+	// key slots (ConfFile.KeySlots) instead of in ConfFile.EncryptedKey.
+	FlagKeySlots
+	// FlagArgon2id indicates that at least one password is hashed with
+	// argon2id instead of scrypt.
+	FlagArgon2id
+	// FlagXChaCha20Poly1305 selects the XChaCha20-Poly1305 content
+	// encryption backend with 192-bit IVs.
+	FlagXChaCha20Poly1305
+	// FlagBlockSize indicates that file contents use the plaintext block
+	// size stored in ConfFile.BlockSize instead of 4096 bytes.
+	FlagBlockSize
+	// FlagNFC indicates that plaintext file names are normalized to Unicode
+	// NFC before they are encrypted.
+	FlagNFC
+	// FlagBase32 indicates that encrypted file names are encoded in
+	// lower-case base32 instead of base64, for case-insensitive storage.
+	FlagBase32
+	// FlagLongNameMax indicates that encrypted names longer than
+	// ConfFile.LongNameMax instead of 255 bytes are hashed into long names.
+	FlagLongNameMax
+	// FlagCompression indicates that file content blocks are compressed
+	// before they are encrypted.
+	FlagCompression
+	// FlagLastBlockMarker indicates that the last block of each file is
+	// marked in its authenticated data, so truncation is detected.
+	FlagLastBlockMarker
+	// FlagDirManifest indicates that every directory has an authenticated
+	// manifest of its entries.
+	FlagDirManifest
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
-	FlagAESSIV:         "AESSIV",
-	FlagRaw64:          "Raw64",
-	FlagHKDF:           "HKDF",
+	FlagPlaintextNames:    "PlaintextNames",
+	FlagDirIV:             "DirIV",
+	FlagEMENames:          "EMENames",
+	FlagGCMIV128:          "GCMIV128",
+	FlagLongNames:         "LongNames",
+	FlagAESSIV:            "AESSIV",
+	FlagRaw64:             "Raw64",
+	FlagHKDF:              "HKDF",
+	FlagXattr:             "Xattr",
+	FlagKeySlots:          "KeySlots",
+	FlagArgon2id:          "Argon2id",
+	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagBlockSize:         "BlockSize",
+	FlagNFC:               "NFC",
+	FlagBase32:            "Base32",
+	FlagLongNameMax:       "LongNameMax",
+	FlagCompression:       "Compression",
+	FlagLastBlockMarker:   "LastBlockMarker",
+	FlagDirManifest:       "DirManifest",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
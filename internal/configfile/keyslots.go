@@ -0,0 +1,139 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// DefaultKeySlotLabel is the label that the existing password gets when a
+// filesystem is converted to the key slot format.
+const DefaultKeySlotLabel = "default"
+
+// KeySlot holds a copy of the master key, encrypted with a key that is
+// derived from one password.
+type KeySlot struct {
+	// Label identifies the key slot for "-removekey"
+	Label string
+	// EncryptedKey holds the encrypted master key
+	EncryptedKey []byte
+	// ScryptObject stores the parameters used to hash the password
+	ScryptObject ScryptKDF
+	// Argon2idObject stores the argon2id parameters. If set, it is used
+	// instead of ScryptObject.
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
+}
+
+// unlockKeySlots tries "password" on all key slots and returns the master
+// key from the first one that it unlocks. That slot becomes the active slot.
+func (cf *ConfFile) unlockKeySlots(password string) ([]byte, error) {
+	for i := range cf.KeySlots {
+		slot := &cf.KeySlots[i]
+		kdf := pickKDF(&slot.ScryptObject, slot.Argon2idObject)
+		if err := kdf.validateParams(); err != nil {
+			return nil, err
+		}
+		key, err := cf.decryptKey(slot.EncryptedKey, kdf, password)
+		if err == nil {
+			tlog.Debug.Printf("unlocked key slot %q", slot.Label)
+			cf.activeSlot = i
+			return key, nil
+		}
+	}
+	tlog.Warn.Printf("failed to unlock master key: password does not match any of %d key slots", len(cf.KeySlots))
+	return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+}
+
+// findKeySlot returns the index of the key slot "label" or -1 if it does not
+// exist.
+func (cf *ConfFile) findKeySlot(label string) int {
+	for i := range cf.KeySlots {
+		if cf.KeySlots[i].Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// convertToKeySlots moves the single encrypted master key into a key slot
+// labeled DefaultKeySlotLabel and sets the KeySlots feature flag.
+func (cf *ConfFile) convertToKeySlots() {
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		return
+	}
+	cf.KeySlots = []KeySlot{{
+		Label:          DefaultKeySlotLabel,
+		EncryptedKey:   cf.EncryptedKey,
+		ScryptObject:   cf.ScryptObject,
+		Argon2idObject: cf.Argon2idObject,
+	}}
+	cf.EncryptedKey = nil
+	cf.ScryptObject = ScryptKDF{}
+	cf.Argon2idObject = nil
+	cf.activeSlot = 0
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeySlots])
+}
+
+// AddKeySlot encrypts "key" using "password" and stores it in a new key slot
+// called "label". If "label" is empty, a free name like "key1" is picked.
+// "kdf" and "logN" select the password hash like for EncryptKey().
+// The filesystem is converted to the key slot format if it is not already.
+// Returns the label of the new slot. Call WriteFile() to persist the change.
+func (cf *ConfFile) AddKeySlot(key []byte, password string, kdf string, logN int, label string) (string, error) {
+	if label == "" {
+		for i := 1; ; i++ {
+			label = fmt.Sprintf("key%d", i)
+			if cf.findKeySlot(label) < 0 {
+				break
+			}
+		}
+	}
+	cf.convertToKeySlots()
+	if cf.findKeySlot(label) >= 0 {
+		return "", fmt.Errorf("key slot %q already exists", label)
+	}
+	cf.KeySlots = append(cf.KeySlots, KeySlot{Label: label})
+	cf.activeSlot = len(cf.KeySlots) - 1
+	cf.EncryptKey(key, password, kdf, logN)
+	return label, nil
+}
+
+// RemoveKeySlot deletes the key slot "label". The last remaining key slot
+// cannot be removed. Call WriteFile() to persist the change.
+func (cf *ConfFile) RemoveKeySlot(label string) error {
+	if !cf.IsFeatureFlagSet(FlagKeySlots) {
+		return fmt.Errorf("the filesystem has a single key and no key slots")
+	}
+	i := cf.findKeySlot(label)
+	if i < 0 {
+		return fmt.Errorf("key slot %q does not exist", label)
+	}
+	if len(cf.KeySlots) == 1 {
+		return fmt.Errorf("refusing to remove the last key slot %q", label)
+	}
+	cf.KeySlots = append(cf.KeySlots[:i], cf.KeySlots[i+1:]...)
+	if cf.activeSlot >= i && cf.activeSlot > 0 {
+		cf.activeSlot--
+	}
+	cf.updateArgon2idFlag()
+	return nil
+}
+
+// DropOtherKeySlots removes all key slots except the one that has been
+// unlocked and returns the labels of the removed slots. Call WriteFile() to
+// persist the change.
+func (cf *ConfFile) DropOtherKeySlots() (removed []string) {
+	if !cf.IsFeatureFlagSet(FlagKeySlots) {
+		return nil
+	}
+	for i, slot := range cf.KeySlots {
+		if i != cf.activeSlot {
+			removed = append(removed, slot.Label)
+		}
+	}
+	cf.KeySlots = cf.KeySlots[cf.activeSlot : cf.activeSlot+1]
+	cf.activeSlot = 0
+	cf.updateArgon2idFlag()
+	return removed
+}
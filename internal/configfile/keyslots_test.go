@@ -0,0 +1,109 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+func TestKeySlots(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	fn := "config_test/tmp.conf"
+	err := CreateConfFile(&CreateArgs{
+		Filename: fn,
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, err := cf.AddKeySlot(key, "second", KDFScrypt, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label != "key1" {
+		t.Errorf("wrong auto-generated label %q", label)
+	}
+	if _, err = cf.AddKeySlot(key, "third", KDFScrypt, 10, DefaultKeySlotLabel); err == nil {
+		t.Error("adding a duplicate label should fail")
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// Both passwords must unlock the same master key
+	for _, pw := range []string{"test", "second"} {
+		key2, cf2, err := LoadConfFile(fn, pw)
+		if err != nil {
+			t.Fatalf("password %q: %v", pw, err)
+		}
+		if !bytes.Equal(key, key2) {
+			t.Errorf("password %q: wrong master key", pw)
+		}
+		if !cf2.IsFeatureFlagSet(FlagKeySlots) || len(cf2.EncryptedKey) != 0 {
+			t.Error("config was not converted to key slots")
+		}
+	}
+	// Revoke the original password
+	if err = cf.RemoveKeySlot(DefaultKeySlotLabel); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.RemoveKeySlot("key1"); err == nil {
+		t.Error("removing the last key slot should fail")
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadConfFile(fn, "test"); err == nil {
+		t.Error("removed password still works")
+	}
+	// Changing the password only affects the slot that was unlocked
+	key2, cf, err := LoadConfFile(fn, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.EncryptKey(key2, "changed", cf.KDF(), cf.ScryptLogN())
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadConfFile(fn, "changed"); err != nil {
+		t.Error(err)
+	}
+}
+
+// A key wrapped with WrapKey is only unwrapped by the same password
+func TestWrapKey(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	fn := "config_test/tmp.conf"
+	err := CreateConfFile(&CreateArgs{
+		Filename: fn,
+		Password: "test",
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x55}, 32)
+	for _, kdf := range []string{KDFScrypt, KDFArgon2id} {
+		slot := cf.WrapKey(key, "wrap", kdf, 10)
+		have, err := cf.UnwrapKey(&slot, "wrap")
+		if err != nil || !bytes.Equal(have, key) {
+			t.Errorf("%s: wrong key, err=%v", kdf, err)
+		}
+		if _, err = cf.UnwrapKey(&slot, "test"); err == nil {
+			t.Errorf("%s: wrong password was accepted", kdf)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package configfile
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"os"
@@ -62,7 +63,10 @@ func NewScryptKDF(logN int) ScryptKDF {
 
 // DeriveKey returns a new key from a supplied password.
 func (s *ScryptKDF) DeriveKey(pw string) []byte {
-	s.validateParams()
+	if err := s.validateParams(); err != nil {
+		tlog.Fatal.Printf("Fatal: %v", err)
+		os.Exit(exitcodes.ScryptParams)
+	}
 
 	k, err := scrypt.Key([]byte(pw), s.Salt, s.N, s.R, s.P, s.KeyLen)
 	if err != nil {
@@ -78,29 +82,29 @@ func (s *ScryptKDF) LogN() int {
 }
 
 // validateParams checks that all parameters are at or above hardcoded limits.
-// If not, it exists with an error message.
+// If not, it returns an error with the exit code ScryptParams.
 // This makes sure we do not get weak parameters passed through a
 // rougue gocryptfs.conf.
-func (s *ScryptKDF) validateParams() {
+func (s *ScryptKDF) validateParams() error {
 	minN := 1 << scryptMinLogN
 	if s.N < minN {
-		tlog.Fatal.Println("Fatal: scryptn below 10 is too low to make sense")
-		os.Exit(exitcodes.ScryptParams)
+		return exitcodes.NewErr("scryptn below 10 is too low to make sense", exitcodes.ScryptParams)
 	}
 	if s.R < scryptMinR {
-		tlog.Fatal.Printf("Fatal: scrypt parameter R below minimum: value=%d, min=%d", s.R, scryptMinR)
-		os.Exit(exitcodes.ScryptParams)
+		return exitcodes.NewErr(fmt.Sprintf("scrypt parameter R below minimum: value=%d, min=%d", s.R, scryptMinR),
+			exitcodes.ScryptParams)
 	}
 	if s.P < scryptMinP {
-		tlog.Fatal.Printf("Fatal: scrypt parameter P below minimum: value=%d, min=%d", s.P, scryptMinP)
-		os.Exit(exitcodes.ScryptParams)
+		return exitcodes.NewErr(fmt.Sprintf("scrypt parameter P below minimum: value=%d, min=%d", s.P, scryptMinP),
+			exitcodes.ScryptParams)
 	}
 	if len(s.Salt) < scryptMinSaltLen {
-		tlog.Fatal.Printf("Fatal: scrypt salt length below minimum: value=%d, min=%d", len(s.Salt), scryptMinSaltLen)
-		os.Exit(exitcodes.ScryptParams)
+		return exitcodes.NewErr(fmt.Sprintf("scrypt salt length below minimum: value=%d, min=%d", len(s.Salt), scryptMinSaltLen),
+			exitcodes.ScryptParams)
 	}
 	if s.KeyLen < cryptocore.KeyLen {
-		tlog.Fatal.Printf("Fatal: scrypt parameter KeyLen below minimum: value=%d, min=%d", len(s.Salt), cryptocore.KeyLen)
-		os.Exit(exitcodes.ScryptParams)
+		return exitcodes.NewErr(fmt.Sprintf("scrypt parameter KeyLen below minimum: value=%d, min=%d", s.KeyLen, cryptocore.KeyLen),
+			exitcodes.ScryptParams)
 	}
+	return nil
 }
@@ -0,0 +1,98 @@
+package contentenc
+
+// Per-block compression ("-compress")
+//
+// With compression enabled, every ciphertext block carries a header between
+// the nonce and the sealed data:
+//
+//   nonce | method (1 byte) | compressed length (2 bytes, big endian) | sealed data
+//
+// The header is appended to the authenticated data, so flipping the method
+// or the length is detected like any other modification.
+//
+// A block still occupies a cipherBS-sized slot in the ciphertext file, which
+// keeps the offset math and random access exactly as without compression. A
+// compressed block only uses the beginning of its slot. The rest is written
+// as zeros and can be deallocated by the caller, see BlockUsedLen. This only
+// frees whole filesystem blocks, so it needs a plaintext block size well
+// above 4 KiB, see CompressMinBS.
+//
+// Only file content is compressed. Other blocks, like xattr values and
+// symlink targets, carry a BlockStored header.
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/lz4"
+)
+
+const (
+	// BlockHeaderLen is the length of the compression header
+	BlockHeaderLen = 3
+	// BlockStored marks a block whose plaintext is stored as it is
+	BlockStored = 0
+	// BlockLZ4 marks a block whose plaintext is LZ4-compressed
+	BlockLZ4 = 1
+	// CompressMinBS is the smallest plaintext block size "-compress"
+	// accepts. With 4 KiB blocks, the unused part of a slot never covers a
+	// whole filesystem block, and nothing could be saved.
+	CompressMinBS = 16 * 1024
+	// CompressDefaultBS is the plaintext block size "-compress" uses if
+	// none is given
+	CompressDefaultBS = MaxBS
+)
+
+// Compression returns true if blocks are compressed before they are
+// encrypted.
+func (be *ContentEnc) Compression() bool {
+	return be.compress
+}
+
+// compressBlock returns the data to seal for "plaintext" and the header
+// describing it. "buf" is a plainBS-sized scratch buffer that the
+// compressed data may be stored in. Compression is only used if it makes the
+// block smaller.
+func (be *ContentEnc) compressBlock(plaintext []byte, buf []byte) ([]byte, []byte) {
+	hdr := make([]byte, BlockHeaderLen)
+	compressed := lz4.Compress(buf[:0], plaintext)
+	if len(compressed) >= len(plaintext) {
+		hdr[0] = BlockStored
+		return plaintext, hdr
+	}
+	hdr[0] = BlockLZ4
+	binary.BigEndian.PutUint16(hdr[1:], uint16(len(compressed)))
+	return compressed, hdr
+}
+
+// decompressBlock decompresses "compressed" into a block from pBlockPool.
+// The result must be exactly "plainLen" bytes long.
+func (be *ContentEnc) decompressBlock(compressed []byte, plainLen int) ([]byte, error) {
+	buf := be.pBlockPool.Get()
+	n, err := lz4.Decompress(buf, compressed)
+	if err != nil {
+		be.pBlockPool.Put(buf)
+		return nil, err
+	}
+	if n != plainLen {
+		be.pBlockPool.Put(buf)
+		return nil, errors.New("decompressed block has the wrong length")
+	}
+	return buf[:n], nil
+}
+
+// BlockUsedLen returns how many bytes of the ciphertext block "cBlock"
+// are actually used. Only compressed blocks can be shorter than their slot,
+// for all others this is len(cBlock).
+func (be *ContentEnc) BlockUsedLen(cBlock []byte) int {
+	hdrEnd := be.cryptoCore.IVLen + BlockHeaderLen
+	if !be.compress || len(cBlock) < hdrEnd || cBlock[hdrEnd-BlockHeaderLen] != BlockLZ4 {
+		return len(cBlock)
+	}
+	used := hdrEnd + int(binary.BigEndian.Uint16(cBlock[hdrEnd-2:hdrEnd])) + cryptocore.AuthTagLen
+	if used > len(cBlock) {
+		return len(cBlock)
+	}
+	return used
+}
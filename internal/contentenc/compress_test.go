@@ -0,0 +1,139 @@
+package contentenc
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+// compressTestData returns a ContentEnc with compression, a plaintext of
+// two compressible blocks, a random block and a short compressible block,
+// and its ciphertext.
+func compressTestData() (f *ContentEnc, plaintext []byte, ciphertext []byte, fileID []byte) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f = New(cc, DefaultBS, false, true)
+	var text bytes.Buffer
+	for i := 0; text.Len() < 2*DefaultBS; i++ {
+		fmt.Fprintf(&text, "{\"line\": %d, \"level\": \"info\"}\n", i)
+	}
+	plaintext = append(plaintext, text.Bytes()[:2*DefaultBS]...)
+	plaintext = append(plaintext, cryptocore.RandBytes(DefaultBS)...)
+	plaintext = append(plaintext, text.Bytes()[:1000]...)
+	var blocks [][]byte
+	for i := 0; i < len(plaintext); i += DefaultBS {
+		end := i + DefaultBS
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		blocks = append(blocks, plaintext[i:end])
+	}
+	fileID = cryptocore.RandBytes(headerIDLen)
+	ciphertext = f.EncryptBlocks(blocks, 0, fileID, false)
+	return f, plaintext, ciphertext, fileID
+}
+
+func TestCompression(t *testing.T) {
+	f, plaintext, ciphertext, fileID := compressTestData()
+	cipherBS := int(f.CipherBS())
+	if cipherBS != DefaultBS+DefaultIVBits/8+cryptocore.AuthTagLen+BlockHeaderLen {
+		t.Errorf("wrong cipherBS %d", cipherBS)
+	}
+	// The block slots are unchanged, so is the offset math
+	if f.PlainSizeToCipherSize(uint64(len(plaintext))) != HeaderLen+uint64(len(ciphertext)) {
+		t.Errorf("ciphertext has the wrong length %d", len(ciphertext))
+	}
+	have, err := f.DecryptBlocks(ciphertext, 0, fileID, false)
+	if err != nil || !bytes.Equal(have, plaintext) {
+		t.Fatalf("wrong plaintext, err=%v", err)
+	}
+	f.PReqPool.Put(have)
+	for i, compressed := range []bool{true, true, false, true} {
+		cEnd := (i + 1) * cipherBS
+		if cEnd > len(ciphertext) {
+			cEnd = len(ciphertext)
+		}
+		cBlock := ciphertext[i*cipherBS : cEnd]
+		used := f.BlockUsedLen(cBlock)
+		if compressed != (used < len(cBlock)) {
+			t.Errorf("block %d: used=%d of %d, want compressed=%v", i, used, len(cBlock), compressed)
+		}
+		// The unused rest of the slot must be zero, so it can be deallocated
+		if !bytes.Equal(cBlock[used:], make([]byte, len(cBlock)-used)) {
+			t.Errorf("block %d: unused bytes are not zero", i)
+		}
+	}
+	// A file hole still decrypts to zeros
+	hole := make([]byte, cipherBS)
+	pBlock, err := f.DecryptBlock(hole, 0, fileID)
+	if err != nil || !bytes.Equal(pBlock, make([]byte, DefaultBS)) {
+		t.Errorf("file hole was not decrypted to zeros, err=%v", err)
+	}
+}
+
+// The compression header is authenticated
+func TestCompressionHeaderAuth(t *testing.T) {
+	f, _, ciphertext, fileID := compressTestData()
+	cBlock := ciphertext[:f.CipherBS()]
+	ivLen := DefaultIVBits / 8
+	for _, i := range []int{ivLen, ivLen + 1, ivLen + 2} {
+		orig := cBlock[i]
+		cBlock[i] ^= 1
+		if _, err := f.DecryptBlock(cBlock, 0, fileID); err == nil {
+			t.Errorf("modified header byte %d was not detected", i-ivLen)
+		}
+		cBlock[i] = orig
+	}
+	if _, err := f.DecryptBlock(cBlock, 0, fileID); err != nil {
+		t.Error(err)
+	}
+}
+
+// Blocks that are not file content, like xattr values, can be larger than
+// plainBS. They are stored uncompressed.
+func TestCompressionLargeBlock(t *testing.T) {
+	f, _, _, fileID := compressTestData()
+	in := bytes.Repeat([]byte("compressible attribute value\n"), 1000)
+	c := f.EncryptBlock(in, 0, fileID)
+	if len(c) != len(in)+int(f.BlockOverhead()) {
+		t.Errorf("wrong ciphertext length %d", len(c))
+	}
+	if f.BlockUsedLen(c) != len(c) {
+		t.Error("block was compressed")
+	}
+	out, err := f.DecryptBlock(c, 0, fileID)
+	if err != nil || !bytes.Equal(out, in) {
+		t.Errorf("wrong plaintext, err=%v", err)
+	}
+}
+
+// With forcedecode, a compressed block that fails the integrity check is
+// returned as zeros
+func TestCompressionForceDecode(t *testing.T) {
+	if stupidgcm.BuiltWithoutOpenssl {
+		t.Skip("forcedecode needs openssl")
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendOpenSSL, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, true, true)
+	var text bytes.Buffer
+	for i := 0; text.Len() < 2*DefaultBS; i++ {
+		fmt.Fprintf(&text, "{\"line\": %d, \"level\": \"info\"}\n", i)
+	}
+	plaintext := text.Bytes()[:2*DefaultBS]
+	fileID := cryptocore.RandBytes(headerIDLen)
+	ciphertext := f.EncryptBlocks([][]byte{plaintext[:DefaultBS], plaintext[DefaultBS:]}, 0, fileID, false)
+	// Corrupt the sealed data of the first block
+	ciphertext[DefaultIVBits/8+BlockHeaderLen] ^= 1
+	have, err := f.DecryptBlocks(ciphertext, 0, fileID, false)
+	if err != stupidgcm.ErrAuth {
+		t.Errorf("want ErrAuth, have %v", err)
+	}
+	want := append(make([]byte, DefaultBS), plaintext[DefaultBS:]...)
+	if !bytes.Equal(have, want) {
+		t.Errorf("wrong plaintext, len=%d", len(have))
+	}
+}
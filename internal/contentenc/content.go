@@ -6,9 +6,11 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/hanwen/go-fuse/fuse"
 
@@ -23,11 +25,17 @@ type NonceMode int
 const (
 	// DefaultBS is the default plaintext block size
 	DefaultBS = 4096
+	// MaxBS is the largest plaintext block size. Two blocks must fit into a
+	// FUSE request.
+	MaxBS = 65536
 	// DefaultIVBits is the default length of IV, in bits.
 	// We always use 128-bit IVs for file content, but the
 	// master key in the config file is encrypted with a 96-bit IV for
 	// gocryptfs v1.2 and earlier. v1.3 switched to 128 bit.
 	DefaultIVBits = 128
+	// XChaCha20Poly1305IVBits is the length of the IV when the
+	// XChaCha20-Poly1305 backend is used, in bits.
+	XChaCha20Poly1305IVBits = 192
 
 	_ = iota // skip zero
 	// RandomNonce chooses a random nonce.
@@ -41,6 +49,10 @@ const (
 
 // ContentEnc is used to encipher and decipher file content.
 type ContentEnc struct {
+	// authFailures counts the blocks that DecryptBlock could not decrypt.
+	// It is accessed atomically and must be the first element of the struct
+	// to guarantee 64-bit alignment.
+	authFailures uint64
 	// Cryptographic primitives
 	cryptoCore *cryptocore.CryptoCore
 	// Plaintext block size
@@ -56,19 +68,58 @@ type ContentEnc struct {
 	// Ciphertext block pool. Always returns cipherBS-sized byte slices.
 	cBlockPool bPool
 	// Ciphertext request data pool. Always returns byte slices of size
-	// fuse.MAX_KERNEL_WRITE + overhead.
+	// fuse.MAX_KERNEL_WRITE + overhead + one extra block + one byte.
 	CReqPool bPool
 	// Plaintext block pool. Always returns plainBS-sized byte slices.
 	pBlockPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
+	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE +
+	// plainBS.
 	PReqPool bPool
+	// Maximum number of goroutines DecryptBlocks uses
+	decryptWorkers int
+	// Compress blocks before encrypting them ("-compress")
+	compress bool
+	// Mark the last block of a file in its authenticated data
+	// ("-lastblockmarker")
+	lastBlockMarker bool
+}
+
+// BackendIVBits returns the IV length in bits that file content encryption
+// uses with "backend".
+func BackendIVBits(backend cryptocore.AEADTypeEnum) int {
+	if backend == cryptocore.BackendXChaCha20Poly1305 {
+		return XChaCha20Poly1305IVBits
+	}
+	return DefaultIVBits
+}
+
+// CheckBlockSize returns an error if "plainBS" cannot be used as the
+// plaintext block size. Valid are powers of two from DefaultBS to MaxBS.
+func CheckBlockSize(plainBS uint64) error {
+	if plainBS < DefaultBS || plainBS > MaxBS || plainBS&(plainBS-1) != 0 {
+		return fmt.Errorf("invalid block size %d: must be a power of two between %d and %d",
+			plainBS, DefaultBS, MaxBS)
+	}
+	return nil
 }
 
 // New returns an initialized ContentEnc instance.
-func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
+// The ciphertext block size is "plainBS" plus the IV length of "cc" plus the
+// auth tag, plus the compression header if "compress" is set.
+func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool, compress bool) *ContentEnc {
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
+	if compress {
+		cipherBS += BlockHeaderLen
+	}
 	// Take IV and GHASH overhead into account.
 	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
+	// Requests that are not aligned to the block size touch one additional
+	// block. The kernel only aligns to the page size, so with large blocks,
+	// this is the normal case. Reserve space for the extra block.
+	cReqSize += int(cipherBS)
+	// One more byte lets readers find out if they have hit the end of the
+	// file, which the last-block marker needs.
+	cReqSize++
 	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
 		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
 	}
@@ -82,11 +133,31 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
-		PReqPool:     newBPool(fuse.MAX_KERNEL_WRITE),
+		PReqPool:     newBPool(fuse.MAX_KERNEL_WRITE + int(plainBS)),
+		compress:     compress,
 	}
+	c.SetDecryptWorkers(0)
 	return c
 }
 
+// SetDecryptWorkers sets the maximum number of goroutines DecryptBlocks
+// uses for a single request. Zero or less selects the default, which is the
+// number of CPUs, but at most decryptMaxSplit.
+func (be *ContentEnc) SetDecryptWorkers(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+		if n > decryptMaxSplit {
+			n = decryptMaxSplit
+		}
+	}
+	be.decryptWorkers = n
+}
+
+// DecryptWorkers returns the maximum number of goroutines DecryptBlocks uses.
+func (be *ContentEnc) DecryptWorkers() int {
+	return be.decryptWorkers
+}
+
 // PlainBS returns the plaintext block size
 func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
@@ -97,27 +168,105 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
-func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
-	cBuf := bytes.NewBuffer(ciphertext)
+// DecryptBlocks decrypts a number of blocks. Large requests are split across
+// up to DecryptWorkers() goroutines. "eof" says if the ciphertext extends
+// to the end of the file, i.e. if its final block is the last block.
+//
+// If a block cannot be decrypted, the plaintext of the blocks before it is
+// returned together with the error. With forcedecode, blocks that fail the
+// integrity check are passed through and stupidgcm.ErrAuth is returned.
+// Compressed blocks cannot be passed through and are returned as zeros.
+func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte, eof bool) ([]byte, error) {
+	cipherBS := int(be.cipherBS)
+	plainBS := int(be.plainBS)
+	nBlocks := (len(ciphertext) + cipherBS - 1) / cipherBS
+	pBuf := be.PReqPool.Get()
+	if nBlocks*plainBS > len(pBuf) {
+		// Larger than any FUSE request. Will not be returned to PReqPool.
+		pBuf = make([]byte, nBlocks*plainBS)
+	}
+	// Every block is decrypted to its final position in pBuf. Only the last
+	// one can be shorter than plainBS.
+	pLens := make([]int, nBlocks)
+	errs := make([]error, nBlocks)
+	workers := be.decryptWorkers
+	if limit := len(ciphertext) / decryptMinGroupSize; workers > limit {
+		workers = limit
+	}
+	if workers > nBlocks {
+		workers = nBlocks
+	}
+	if workers > 1 {
+		groupSize := nBlocks / workers
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				low := i * groupSize
+				high := (i + 1) * groupSize
+				if i == workers-1 {
+					// Last group, pick up any left-over blocks
+					high = nBlocks
+				}
+				be.doDecryptBlocks(ciphertext, pBuf, pLens, errs, low, high, firstBlockNo, fileID, eof)
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		be.doDecryptBlocks(ciphertext, pBuf, pLens, errs, 0, nBlocks, firstBlockNo, fileID, eof)
+	}
+	// Collect the result. Stop at the first block that could not be decrypted.
 	var err error
-	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	for cBuf.Len() > 0 {
-		cBlock := cBuf.Next(int(be.cipherBS))
-		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, firstBlockNo, fileID)
+	n := 0
+	for i := 0; i < nBlocks; i++ {
+		if errs[i] != nil {
+			err = errs[i]
+			if !be.forceDecode || err != stupidgcm.ErrAuth {
+				break
+			}
+		}
+		n += pLens[i]
+	}
+	return pBuf[:n], err
+}
+
+// doDecryptBlocks is called by DecryptBlocks to decrypt the blocks
+// low...high-1 of "ciphertext" into "pBuf". It stops at the first block that
+// fails to decrypt, as the blocks after it are not returned anyway.
+func (be *ContentEnc) doDecryptBlocks(ciphertext []byte, pBuf []byte, pLens []int, errs []error, low int, high int, firstBlockNo uint64, fileID []byte, eof bool) {
+	cipherBS := int(be.cipherBS)
+	plainBS := int(be.plainBS)
+	for i := low; i < high; i++ {
+		cEnd := (i + 1) * cipherBS
+		if cEnd > len(ciphertext) {
+			cEnd = len(ciphertext)
+		}
+		blockNo := firstBlockNo + uint64(i)
+		last := eof && cEnd == len(ciphertext)
+		cBlock := ciphertext[i*cipherBS : cEnd]
+		pBlock, err := be.decryptBlock(cBlock, blockNo, fileID, last)
+		errs[i] = err
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
-				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overriden by forcedecode", firstBlockNo)
+				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overriden by forcedecode", blockNo)
 			} else {
-				break
+				return
 			}
 		}
-		pBuf.Write(pBlock)
+		if pBlock == nil {
+			// A compressed block that failed the integrity check cannot be
+			// passed through. Return zeros in its place.
+			pLen := len(cBlock) - int(be.BlockOverhead())
+			for j := i * plainBS; j < i*plainBS+pLen; j++ {
+				pBuf[j] = 0
+			}
+			pLens[i] = pLen
+			continue
+		}
+		pLens[i] = copy(pBuf[i*plainBS:], pBlock)
 		be.pBlockPool.Put(pBlock)
-		firstBlockNo++
 	}
-	return pBuf.Bytes(), err
 }
 
 // DecryptBlock - Verify and decrypt GCM block
@@ -125,6 +274,13 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 // Corner case: A full-sized block of all-zero ciphertext bytes is translated
 // to an all-zero plaintext block, i.e. file hole passtrough.
 func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
+	return be.decryptBlock(ciphertext, blockNo, fileID, false)
+}
+
+// decryptBlock is the backend for DecryptBlock and DecryptContentBlock.
+// "last" says if this is the last block of a file.
+func (be *ContentEnc) decryptBlock(ciphertext []byte, blockNo uint64, fileID []byte, last bool) ([]byte, error) {
+	marked := last && be.lastBlockMarker
 
 	// Empty block?
 	if len(ciphertext) == 0 {
@@ -133,12 +289,19 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 
 	// All-zero block?
 	if bytes.Equal(ciphertext, be.allZeroBlock) {
+		if marked {
+			// The last block is always written out, a hole means that
+			// blocks have been dropped.
+			atomic.AddUint64(&be.authFailures, 1)
+			return nil, ErrTruncated
+		}
 		tlog.Debug.Printf("DecryptBlock: file hole encountered")
 		return make([]byte, be.plainBS), nil
 	}
 
 	if len(ciphertext) < be.cryptoCore.IVLen {
 		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
+		atomic.AddUint64(&be.authFailures, 1)
 		return nil, errors.New("Block is too short")
 	}
 
@@ -148,38 +311,107 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		// Bug in tmpfs?
 		// https://github.com/rfjakob/gocryptfs/issues/56
 		// http://www.spinics.net/lists/kernel/msg2370127.html
+		atomic.AddUint64(&be.authFailures, 1)
 		return nil, errors.New("all-zero nonce")
 	}
 	ciphertextOrig := ciphertext
 	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
-	// Decrypt
-	plaintext := be.pBlockPool.Get()
-	plaintext = plaintext[:0]
 	aData := make([]byte, 8)
 	aData = append(aData, fileID...)
 	binary.BigEndian.PutUint64(aData, blockNo)
+	method := byte(BlockStored)
+	if be.compress {
+		if len(ciphertext) < BlockHeaderLen {
+			tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertextOrig))
+			atomic.AddUint64(&be.authFailures, 1)
+			return nil, errors.New("Block is too short")
+		}
+		hdr := ciphertext[:BlockHeaderLen]
+		ciphertext = ciphertext[BlockHeaderLen:]
+		aData = append(aData, hdr...)
+		method = hdr[0]
+		if method == BlockLZ4 {
+			// Only the beginning of the slot is used
+			sealedLen := int(binary.BigEndian.Uint16(hdr[1:])) + cryptocore.AuthTagLen
+			if sealedLen > len(ciphertext) {
+				atomic.AddUint64(&be.authFailures, 1)
+				return nil, errors.New("compressed length exceeds the block")
+			}
+			ciphertext = ciphertext[:sealedLen]
+		} else if method != BlockStored {
+			atomic.AddUint64(&be.authFailures, 1)
+			return nil, fmt.Errorf("unknown block compression method %d", method)
+		}
+	}
+	if marked {
+		aData = append(aData, lastBlockMarker)
+	}
+
+	// Decrypt
+	plaintext := be.pBlockPool.Get()
+	plaintext = plaintext[:0]
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
+	if err != nil && marked && !be.forceDecode {
+		// Tell truncation apart from corruption. A block from the middle of
+		// the file decrypts without the marker. With forceDecode, the
+		// plaintext is returned below like for any other auth failure.
+		if _, err2 := be.cryptoCore.AEADCipher.Open(nil, nonce, ciphertext, aData[:len(aData)-1]); err2 == nil {
+			tlog.Warn.Printf("DecryptBlock: block #%d: %v", blockNo, ErrTruncated)
+			atomic.AddUint64(&be.authFailures, 1)
+			return nil, ErrTruncated
+		}
+	}
 	if err != nil {
 		tlog.Warn.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
 		tlog.Debug.Println(hex.Dump(ciphertextOrig))
-		if be.forceDecode && err == stupidgcm.ErrAuth {
+		atomic.AddUint64(&be.authFailures, 1)
+		if be.forceDecode && err == stupidgcm.ErrAuth && method == BlockStored {
 			return plaintext, err
 		}
 		return nil, err
 	}
 
+	if method == BlockLZ4 {
+		compressed := plaintext
+		plaintext, err = be.decompressBlock(compressed, len(ciphertextOrig)-int(be.BlockOverhead()))
+		be.pBlockPool.Put(compressed)
+		if err != nil {
+			tlog.Warn.Printf("DecryptBlock: block #%d: %v", blockNo, err)
+			atomic.AddUint64(&be.authFailures, 1)
+			return nil, err
+		}
+	}
+
 	return plaintext, nil
 }
 
+// AuthFailures returns the number of blocks that DecryptBlock could not
+// decrypt, including those that were passed through because of forcedecode.
+func (be *ContentEnc) AuthFailures() uint64 {
+	return atomic.LoadUint64(&be.authFailures)
+}
+
 // At some point, splitting the ciphertext into more groups will not improve
 // performance, as spawning goroutines comes at a cost.
 // 2 seems to work ok for now.
 const encryptMaxSplit = 2
 
+const (
+	// decryptMaxSplit is the default limit for the number of goroutines
+	// DecryptBlocks uses. Decryption is what limits read throughput, so
+	// it is split more aggressively than encryption.
+	decryptMaxSplit = 4
+	// decryptMinGroupSize is the least amount of ciphertext, in bytes, that
+	// DecryptBlocks hands to a goroutine. Smaller requests are not worth the
+	// overhead.
+	decryptMinGroupSize = 16 * 1024
+)
+
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
-func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
+// "eof" says if the final block is the last block of the file.
+func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte, eof bool) []byte {
 	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
 	// For large writes, we parallelize encryption.
 	if len(plaintextBlocks) >= 32 {
@@ -198,13 +430,14 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 					// Last group, pick up any left-over blocks
 					high = len(plaintextBlocks)
 				}
-				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID,
+					eof && high == len(plaintextBlocks))
 				wg.Done()
 			}(i)
 		}
 		wg.Wait()
 	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID, eof)
 	}
 	// Concatenate ciphertext into a single byte array.
 	tmp := be.CReqPool.Get()
@@ -218,19 +451,21 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 }
 
 // doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
-func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte, eof bool) {
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		last := eof && i == len(in)-1
+		out[i] = be.EncryptContentBlock(v, firstBlockNo+uint64(i), fileID, last)
 	}
 }
 
 // EncryptBlock - Encrypt plaintext using a random nonce.
 // blockNo and fileID are used as associated data.
-// The output is nonce + ciphertext + tag.
+// The output is nonce + ciphertext + tag. With compression, see compress.go,
+// the block is stored uncompressed. Use EncryptContentBlock for file content.
 func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
 	// Get a fresh random nonce
 	nonce := be.cryptoCore.IVGenerator.Get()
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce, false, false)
 }
 
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
@@ -241,13 +476,18 @@ func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID
 	if be.cryptoCore.AEADBackend != cryptocore.BackendAESSIV {
 		log.Panic("deterministic nonces are only secure in SIV mode")
 	}
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce, false, false)
 }
 
-// doEncryptBlock is the backend for EncryptBlock and EncryptBlockNonce.
-// blockNo and fileID are used as associated data.
+// doEncryptBlock is the backend for EncryptBlock, EncryptBlockNonce and
+// EncryptContentBlock.
+// blockNo and fileID are used as associated data. "last" says if this is
+// the last block of a file. Only blocks of file content ("content") are
+// compressed. Everything else, like xattr values and symlink targets, can be
+// larger than a block and does not fit into a compression buffer.
 // The output is nonce + ciphertext + tag.
-func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte, last bool, content bool) []byte {
+	marked := last && be.lastBlockMarker
 	// Empty block?
 	if len(plaintext) == 0 {
 		return plaintext
@@ -264,9 +504,34 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	cBlock := be.cBlockPool.Get()
 	copy(cBlock, nonce)
 	cBlock = cBlock[0:len(nonce)]
+	overhead := int(be.cipherBS - be.plainBS)
+	if be.compress {
+		data, hdr := plaintext, make([]byte, BlockHeaderLen)
+		if content {
+			buf := be.pBlockPool.Get()
+			defer be.pBlockPool.Put(buf)
+			data, hdr = be.compressBlock(plaintext, buf)
+		}
+		cBlock = append(cBlock, hdr...)
+		aData = append(aData, hdr...)
+		if marked {
+			aData = append(aData, lastBlockMarker)
+		}
+		// Encrypt and append to the header
+		ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, data, aData)
+		// Zero-fill the rest of the slot. cBlock may contain old data.
+		slotEnd := len(plaintext) + overhead
+		ciphertext = ciphertext[:slotEnd]
+		for i := len(nonce) + BlockHeaderLen + len(data) + cryptocore.AuthTagLen; i < slotEnd; i++ {
+			ciphertext[i] = 0
+		}
+		return ciphertext
+	}
+	if marked {
+		aData = append(aData, lastBlockMarker)
+	}
 	// Encrypt plaintext and append to nonce
 	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
-	overhead := int(be.cipherBS - be.plainBS)
 	if len(plaintext)+overhead != len(ciphertext) {
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
 			len(plaintext), overhead, len(ciphertext))
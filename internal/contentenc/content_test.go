@@ -1,8 +1,11 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
+	"github.com/hanwen/go-fuse/fuse"
+
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
@@ -24,7 +27,7 @@ func TestSplitRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -52,7 +55,7 @@ func TestCiphertextRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 
@@ -75,7 +78,7 @@ func TestCiphertextRange(t *testing.T) {
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +97,155 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestAuthFailures checks that failed decryptions are counted
+func TestAuthFailures(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	fileID := make([]byte, 16)
+	ciphertext := f.EncryptBlock([]byte("foo"), 0, fileID)
+	if _, err := f.DecryptBlock(ciphertext, 0, fileID); err != nil {
+		t.Fatal(err)
+	}
+	// Wrong block number
+	if _, err := f.DecryptBlock(ciphertext, 1, fileID); err == nil {
+		t.Fatal("decryption should have failed")
+	}
+	if n := f.AuthFailures(); n != 1 {
+		t.Errorf("want 1 auth failure, got %d", n)
+	}
+}
+
+// XChaCha20-Poly1305 uses 24-byte IVs, which makes the ciphertext blocks
+// 8 bytes larger than with GCM
+func TestXChaCha20Poly1305(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	backend := cryptocore.BackendXChaCha20Poly1305
+	cc := cryptocore.New(key, backend, BackendIVBits(backend), true, false)
+	f := New(cc, DefaultBS, false, false)
+	if f.CipherBS() != DefaultBS+24+cryptocore.AuthTagLen {
+		t.Errorf("wrong cipherBS %d", f.CipherBS())
+	}
+	if s := f.PlainSizeToCipherSize(5000); s != HeaderLen+4136+944 {
+		t.Errorf("wrong cipher size %d", s)
+	}
+	plaintext := make([]byte, 5000)
+	fileID := cryptocore.RandBytes(headerIDLen)
+	ciphertext := f.EncryptBlocks([][]byte{plaintext[:DefaultBS], plaintext[DefaultBS:]}, 0, fileID, false)
+	have, err := f.DecryptBlocks(ciphertext, 0, fileID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(plaintext) {
+		t.Errorf("wrong plaintext length %d", len(have))
+	}
+}
+
+func TestCheckBlockSize(t *testing.T) {
+	for _, bs := range []uint64{4096, 8192, 65536} {
+		if err := CheckBlockSize(bs); err != nil {
+			t.Errorf("%d: %v", bs, err)
+		}
+	}
+	for _, bs := range []uint64{0, 512, 5000, 131072} {
+		if err := CheckBlockSize(bs); err == nil {
+			t.Errorf("%d should be rejected", bs)
+		}
+	}
+}
+
+// A FUSE request that is not aligned to the block size touches one more
+// block. It must still fit into the pooled buffers.
+func TestUnalignedRequest(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	for _, bs := range []uint64{DefaultBS, MaxBS} {
+		f := New(cc, bs, false, false)
+		blocks := f.ExplodePlainRange(4096, fuse.MAX_KERNEL_WRITE)
+		_, cLen := blocks[0].JointCiphertextRange(blocks)
+		if cLen > uint64(len(f.CReqPool.Get())) {
+			t.Errorf("bs=%d: ciphertext range %d does not fit into CReqPool", bs, cLen)
+		}
+		pLen := uint64(len(blocks)) * bs
+		if pLen > uint64(len(f.PReqPool.Get())) {
+			t.Errorf("bs=%d: plaintext %d does not fit into PReqPool", bs, pLen)
+		}
+	}
+}
+
+// encryptTestData returns a ContentEnc with "workers" decryption goroutines,
+// a plaintext of 32 full blocks plus a partial one, and its ciphertext.
+func encryptTestData(workers int) (f *ContentEnc, plaintext []byte, ciphertext []byte, fileID []byte) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f = New(cc, DefaultBS, false, false)
+	f.SetDecryptWorkers(workers)
+	plaintext = cryptocore.RandBytes(32*DefaultBS + 100)
+	var blocks [][]byte
+	for i := 0; i < len(plaintext); i += DefaultBS {
+		end := i + DefaultBS
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		blocks = append(blocks, plaintext[i:end])
+	}
+	fileID = cryptocore.RandBytes(headerIDLen)
+	ciphertext = f.EncryptBlocks(blocks, 0, fileID, false)
+	return f, plaintext, ciphertext, fileID
+}
+
+// DecryptBlocks must return the same result no matter how many goroutines
+// it uses
+func TestDecryptBlocksWorkers(t *testing.T) {
+	for workers := 1; workers <= 5; workers++ {
+		f, plaintext, ciphertext, fileID := encryptTestData(workers)
+		have, err := f.DecryptBlocks(ciphertext, 0, fileID, false)
+		if err != nil || !bytes.Equal(have, plaintext) {
+			t.Errorf("workers=%d: wrong plaintext, err=%v", workers, err)
+		}
+		f.PReqPool.Put(have)
+		// A file hole decrypts to zeros
+		copy(ciphertext[3*f.CipherBS():], make([]byte, f.CipherBS()))
+		have, err = f.DecryptBlocks(ciphertext, 0, fileID, false)
+		if err != nil || !bytes.Equal(have[3*DefaultBS:4*DefaultBS], make([]byte, DefaultBS)) {
+			t.Errorf("workers=%d: file hole was not decrypted to zeros, err=%v", workers, err)
+		}
+		f.PReqPool.Put(have)
+		// Only the blocks before a corrupt one are returned
+		ciphertext[20*f.CipherBS()+100] ^= 1
+		have, err = f.DecryptBlocks(ciphertext, 0, fileID, false)
+		if err == nil {
+			t.Errorf("workers=%d: corrupt block was not detected", workers)
+		}
+		if len(have) != 20*DefaultBS || !bytes.Equal(have[4*DefaultBS:], plaintext[4*DefaultBS:20*DefaultBS]) {
+			t.Errorf("workers=%d: got %d bytes of plaintext, want %d", workers, len(have), 20*DefaultBS)
+		}
+		f.PReqPool.Put(have)
+	}
+}
+
+func benchmarkDecryptBlocks(b *testing.B, workers int) {
+	f, _, ciphertext, fileID := encryptTestData(workers)
+	b.SetBytes(int64(len(ciphertext)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plaintext, err := f.DecryptBlocks(ciphertext, 0, fileID, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.PReqPool.Put(plaintext)
+	}
+}
+
+func BenchmarkDecryptBlocks1(b *testing.B) {
+	benchmarkDecryptBlocks(b, 1)
+}
+
+func BenchmarkDecryptBlocks2(b *testing.B) {
+	benchmarkDecryptBlocks(b, 2)
+}
+
+func BenchmarkDecryptBlocks4(b *testing.B) {
+	benchmarkDecryptBlocks(b, 4)
+}
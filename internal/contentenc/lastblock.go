@@ -0,0 +1,51 @@
+package contentenc
+
+// Authenticated file length ("-lastblockmarker")
+//
+// The blocks of a file are bound to their position by the block number and
+// to the file by the file ID. This does not stop anybody from cutting off
+// blocks at the end of the file. With the LastBlockMarker feature flag, the
+// authenticated data of the last block of a file gets one extra byte:
+//
+//   blockNo | fileID | compression header (if any) | lastBlockMarker
+//
+// If the file is cut at a block boundary, or trailing blocks are dropped,
+// the block that is now the last one does not carry the marker and fails to
+// decrypt.
+
+import (
+	"errors"
+)
+
+// lastBlockMarker is appended to the authenticated data of the last block
+const lastBlockMarker = 0x01
+
+// ErrTruncated is returned for the last block of a file if it decrypts, but
+// has not been encrypted as the last block. This means the file has been
+// truncated or trailing blocks have been dropped.
+var ErrTruncated = errors.New("file has been truncated: the last block is not marked as such")
+
+// SetLastBlockMarker enables or disables the last-block marker.
+func (be *ContentEnc) SetLastBlockMarker(on bool) {
+	be.lastBlockMarker = on
+}
+
+// LastBlockMarker returns true if the last block of a file is marked in its
+// authenticated data.
+func (be *ContentEnc) LastBlockMarker() bool {
+	return be.lastBlockMarker
+}
+
+// EncryptContentBlock is like EncryptBlock, for a block of file content.
+// "last" says if it is the last block of the file.
+func (be *ContentEnc) EncryptContentBlock(plaintext []byte, blockNo uint64, fileID []byte, last bool) []byte {
+	nonce := be.cryptoCore.IVGenerator.Get()
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce, last, true)
+}
+
+// DecryptContentBlock is like DecryptBlock, for a block of file content.
+// "last" says if it is the last block of the file. Returns ErrTruncated if
+// it is not marked as such.
+func (be *ContentEnc) DecryptContentBlock(ciphertext []byte, blockNo uint64, fileID []byte, last bool) ([]byte, error) {
+	return be.decryptBlock(ciphertext, blockNo, fileID, last)
+}
@@ -0,0 +1,53 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestLastBlockMarker(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	f.SetLastBlockMarker(true)
+	fileID := cryptocore.RandBytes(headerIDLen)
+	plaintext := cryptocore.RandBytes(3 * DefaultBS)
+	blocks := [][]byte{plaintext[:DefaultBS], plaintext[DefaultBS : 2*DefaultBS], plaintext[2*DefaultBS:]}
+	ciphertext := f.EncryptBlocks(blocks, 0, fileID, true)
+
+	have, err := f.DecryptBlocks(ciphertext, 0, fileID, true)
+	if err != nil || !bytes.Equal(have, plaintext) {
+		t.Fatalf("wrong plaintext, err=%v", err)
+	}
+	// Not knowing where the file ends is fine as long as the last block is
+	// not part of the request
+	cipherBS := int(f.CipherBS())
+	if _, err = f.DecryptBlocks(ciphertext[:2*cipherBS], 0, fileID, false); err != nil {
+		t.Error(err)
+	}
+	// Drop the last block
+	if _, err = f.DecryptBlocks(ciphertext[:2*cipherBS], 0, fileID, true); err != ErrTruncated {
+		t.Errorf("dropped block: want ErrTruncated, got %v", err)
+	}
+	// Only the last block is marked
+	if _, err = f.DecryptBlocks(ciphertext, 0, fileID, false); err == nil {
+		t.Error("marked block decrypted as a middle block")
+	}
+	// A trailing file hole cannot be the last block
+	hole := make([]byte, cipherBS)
+	if _, err = f.DecryptContentBlock(hole, 3, fileID, true); err != ErrTruncated {
+		t.Errorf("hole: want ErrTruncated, got %v", err)
+	}
+	if _, err = f.DecryptContentBlock(hole, 3, fileID, false); err != nil {
+		t.Error(err)
+	}
+
+	// Without the feature flag, the marker does nothing
+	f.SetLastBlockMarker(false)
+	ciphertext = f.EncryptBlocks(blocks, 0, fileID, true)
+	if _, err = f.DecryptBlocks(ciphertext[:2*cipherBS], 0, fileID, true); err != nil {
+		t.Error(err)
+	}
+}
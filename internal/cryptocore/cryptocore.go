@@ -1,5 +1,5 @@
-// Package cryptocore wraps OpenSSL and Go GCM crypto and provides
-// a nonce generator.
+// Package cryptocore wraps OpenSSL and Go GCM crypto, AES-SIV and
+// XChaCha20-Poly1305, and provides a nonce generator.
 package cryptocore
 
 import (
@@ -10,6 +10,7 @@ import (
 	"log"
 
 	"github.com/rfjakob/eme"
+	"golang.org/x/crypto/chacha20poly1305"
 
 	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -31,19 +32,41 @@ const (
 	BackendGoGCM AEADTypeEnum = iota
 	// BackendAESSIV specifies an AESSIV backend.
 	BackendAESSIV AEADTypeEnum = iota
+	// BackendXChaCha20Poly1305 specifies the Go based XChaCha20-Poly1305
+	// backend. It uses 192-bit nonces and is fast on CPUs without AES
+	// instructions.
+	BackendXChaCha20Poly1305 AEADTypeEnum = iota
 )
 
+// String returns the name of the backend, for example "Go-GCM".
+func (a AEADTypeEnum) String() string {
+	switch a {
+	case BackendOpenSSL:
+		return "OpenSSL-GCM"
+	case BackendGoGCM:
+		return "Go-GCM"
+	case BackendAESSIV:
+		return "AES-SIV"
+	case BackendXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("AEADTypeEnum(%d)", int(a))
+}
+
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
 	EMECipher *eme.EMECipher
-	// GCM or AES-SIV. This is used for content encryption.
+	// GCM, AES-SIV or XChaCha20-Poly1305. This is used for content encryption.
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
 	AEADBackend AEADTypeEnum
 	// GCM needs unique IVs (nonces)
 	IVGenerator *nonceGenerator
 	IVLen       int
+	// ManifestKey authenticates the directory manifests. Nil if HKDF is
+	// not used.
+	ManifestKey []byte
 }
 
 // New returns a new CryptoCore object or panics.
@@ -117,15 +140,36 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 			key64 = s[:]
 		}
 		aeadCipher = siv_aead.New(key64)
+	} else if aeadType == BackendXChaCha20Poly1305 {
+		if IVLen != chacha20poly1305.NonceSizeX {
+			log.Panicf("XChaCha20-Poly1305 must use %d-byte nonces", chacha20poly1305.NonceSizeX)
+		}
+		chachaKey := key
+		if useHKDF {
+			chachaKey = hkdfDerive(key, hkdfInfoXChaChaContent, chacha20poly1305.KeySize)
+		}
+		var err error
+		aeadCipher, err = chacha20poly1305.NewX(chachaKey)
+		if err != nil {
+			log.Panic(err)
+		}
 	} else {
 		log.Panic("unknown backend cipher")
 	}
 
+	// Directory manifests are only supported with HKDF, the master key must
+	// not be used for HMAC directly.
+	var manifestKey []byte
+	if useHKDF {
+		manifestKey = hkdfDerive(key, hkdfInfoDirManifest, KeyLen)
+	}
+
 	return &CryptoCore{
 		EMECipher:   emeCipher,
 		AEADCipher:  aeadCipher,
 		AEADBackend: aeadType,
 		IVGenerator: &nonceGenerator{nonceLen: IVLen},
 		IVLen:       IVLen,
+		ManifestKey: manifestKey,
 	}
 }
@@ -18,6 +18,10 @@ func TestCryptoCoreNew(t *testing.T) {
 		if c.IVLen != 16 {
 			t.Fail()
 		}
+		c = New(key, BackendXChaCha20Poly1305, 192, useHKDF, false)
+		if c.IVLen != 24 {
+			t.Fail()
+		}
 		if stupidgcm.BuiltWithoutOpenssl {
 			continue
 		}
@@ -39,3 +43,15 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true, false)
 }
+
+// XChaCha20-Poly1305 should panic on anything but 192-bit IVs
+func TestNewXChaChaPanic(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+
+	key := make([]byte, 32)
+	New(key, BackendXChaCha20Poly1305, 128, true, false)
+}
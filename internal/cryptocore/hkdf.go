@@ -13,6 +13,9 @@ const (
 	hkdfInfoEMENames   = "EME filename encryption"
 	hkdfInfoGCMContent = "AES-GCM file content encryption"
 	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	// XChaCha20-Poly1305 gets its own key so it never shares one with GCM
+	hkdfInfoXChaChaContent = "XChaCha20-Poly1305 file content encryption"
+	hkdfInfoDirManifest    = "HMAC-SHA256 directory manifest authentication"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
@@ -18,12 +18,46 @@ import (
 type Interface interface {
 	EncryptPath(string) (string, error)
 	DecryptPath(string) (string, error)
+	Stats() StatsStruct
 }
 
 // RequestStruct is sent by a client
 type RequestStruct struct {
 	EncryptPath string
 	DecryptPath string
+	// Op selects an operation that does not take a path. Currently, the only
+	// supported value is OpStats.
+	Op string
+}
+
+// OpStats requests a StatsStruct in the Stats field of the response.
+const OpStats = "Stats"
+
+// StatsVersion is the version of StatsStruct. It is incremented whenever a
+// field is removed or changes its meaning. Adding fields does not change it.
+const StatsVersion = 1
+
+// StatsStruct contains statistics about the running filesystem.
+type StatsStruct struct {
+	// Version is StatsVersion
+	Version int
+	// Uptime is the number of seconds since the filesystem was mounted
+	Uptime uint64
+	// BytesRead is the number of bytes returned by read operations
+	BytesRead uint64
+	// BytesWritten is the number of bytes accepted by write operations
+	BytesWritten uint64
+	// AuthFailures is the number of blocks that failed to decrypt or
+	// failed the integrity check
+	AuthFailures uint64
+	// OpenFiles is the number of files that are currently open
+	OpenFiles int
+	// WriteOpCount is the number of write operations on file contents
+	WriteOpCount uint64
+	// ReadOpCount is the number of read operations on file contents
+	ReadOpCount uint64
+	// Backend is the name of the crypto backend, for example "Go-GCM"
+	Backend string
 }
 
 // ResponseStruct is sent by us as response to a request
@@ -39,6 +73,8 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Stats is the result of an OpStats request. Nil otherwise.
+	Stats *StatsStruct `json:",omitempty"`
 }
 
 type ctlSockHandler struct {
@@ -115,6 +151,11 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
+	// Operations that do not take a path
+	if in.Op != "" {
+		ch.handleOp(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
 		err = errors.New("Ambigous")
@@ -153,6 +194,22 @@ func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleOp handles a request that has the Op field set
+func (ch *ctlSockHandler) handleOp(in *RequestStruct, conn *net.UnixConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambigous"), "", "")
+		return
+	}
+	switch in.Op {
+	case OpStats:
+		stats := ch.fs.Stats()
+		stats.Version = StatsVersion
+		writeResponse(conn, &ResponseStruct{Stats: &stats})
+	default:
+		sendResponse(conn, fmt.Errorf("Unknown Op %q", in.Op), "", "")
+	}
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
 	msg := ResponseStruct{
@@ -167,8 +224,15 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
+		} else if se, ok := err.(syscall.Errno); ok {
+			msg.ErrNo = int32(se)
 		}
 	}
+	writeResponse(conn, &msg)
+}
+
+// writeResponse marshals "msg" and writes it to "conn"
+func writeResponse(conn *net.UnixConn, msg *ResponseStruct) {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
@@ -0,0 +1,457 @@
+// Package dirmanifest implements the authenticated directory manifests that
+// are used with "-dirmanifest".
+//
+// Every directory contains a "gocryptfs.dirmanifest" file that lists the
+// encrypted names of its entries, their type and their ID. The ID is the
+// file header for regular files, the directory IV for directories and a
+// hash of the encrypted target for symlinks. The manifest also stores the
+// directory IV of the directory it belongs to, and is authenticated with
+// HMAC-SHA256.
+//
+// Format:
+//
+//   magic "GCDM" | version uint16 | flags byte | directory IV (16 bytes) |
+//   entry count uint32 | entries sorted by name | HMAC-SHA256 (32 bytes)
+//
+// Entry format:
+//
+//   name length uint16 | name | type byte | ID length byte | ID
+//
+// All integers are big endian.
+package dirmanifest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// Filename is the name of the manifest file in each directory.
+	// Exported because we have to ignore this name in directory listings.
+	Filename = "gocryptfs.dirmanifest"
+	// TmpFilename is the name of the temporary file that atomically
+	// replaces the manifest.
+	TmpFilename = Filename + ".tmp"
+	// RmdirPrefix is the prefix of the name a manifest is moved to when its
+	// directory is deleted.
+	RmdirPrefix = Filename + ".rmdir."
+
+	magic   = "GCDM"
+	version = 1
+	// flagRoot marks the manifest of the root directory
+	flagRoot = 0x01
+	// maxCached is the number of verified manifests a Keeper keeps in
+	// memory
+	maxCached = 100
+)
+
+// Entry types
+const (
+	// TypeFile is a regular file
+	TypeFile = 'f'
+	// TypeDir is a directory
+	TypeDir = 'd'
+	// TypeSymlink is a symbolic link
+	TypeSymlink = 'l'
+	// TypeOther is a device node, a FIFO or a socket
+	TypeOther = 'o'
+)
+
+// symlinkIDLen is the length of the truncated SHA-256 hash that identifies a
+// symlink
+const symlinkIDLen = 16
+
+// ErrAuth is returned if a manifest fails authentication
+var ErrAuth = errors.New("manifest authentication failed")
+
+// Entry is one directory entry in a manifest
+type Entry struct {
+	// Type is one of TypeFile, TypeDir, TypeSymlink, TypeOther
+	Type byte
+	// ID identifies the content of the entry. Empty for TypeOther and empty
+	// files.
+	ID []byte
+}
+
+// Equal returns true if both entries have the same type and ID
+func (e Entry) Equal(o Entry) bool {
+	return e.Type == o.Type && bytes.Equal(e.ID, o.ID)
+}
+
+// String returns a short description of the entry for log messages
+func (e Entry) String() string {
+	return fmt.Sprintf("%c:%x", e.Type, e.ID)
+}
+
+// Manifest is the decoded manifest of one directory
+type Manifest struct {
+	// Root is set for the manifest of the root directory
+	Root bool
+	// DirIV is the directory IV of the directory the manifest belongs to
+	DirIV []byte
+	// Entries maps encrypted names to entries
+	Entries map[string]Entry
+}
+
+// New returns an empty manifest for the directory with IV "dirIV"
+func New(dirIV []byte, root bool) *Manifest {
+	return &Manifest{
+		Root:    root,
+		DirIV:   dirIV,
+		Entries: make(map[string]Entry),
+	}
+}
+
+// Keeper reads and writes authenticated manifests
+type Keeper struct {
+	key []byte
+	// cache contains manifests that have been verified or written,
+	// indexed by the directory IV they belong to. Directory IVs are random
+	// and move with their directory, so a rename does not invalidate the
+	// cache. A manifest that is changed on disk behind our back is not
+	// read again, the authentic copy in the cache is used instead.
+	cache     map[string]*Manifest
+	cacheLock sync.Mutex
+}
+
+// NewKeeper returns a Keeper that authenticates manifests with "key"
+func NewKeeper(key []byte) *Keeper {
+	if len(key) == 0 {
+		panic("dirmanifest: empty key")
+	}
+	return &Keeper{key: key, cache: make(map[string]*Manifest)}
+}
+
+// lookup returns the cached manifest for the directory IV "iv", or nil.
+func (k *Keeper) lookup(iv []byte) *Manifest {
+	k.cacheLock.Lock()
+	defer k.cacheLock.Unlock()
+	return k.cache[string(iv)]
+}
+
+// store puts "m" into the cache.
+func (k *Keeper) store(m *Manifest) {
+	k.cacheLock.Lock()
+	defer k.cacheLock.Unlock()
+	// Delete a random entry from the map if reached maxCached
+	if len(k.cache) >= maxCached {
+		for iv := range k.cache {
+			delete(k.cache, iv)
+			break
+		}
+	}
+	k.cache[string(m.DirIV)] = m
+}
+
+// Clone returns a copy of "m" whose entries can be changed.
+func (m *Manifest) Clone() *Manifest {
+	c := New(m.DirIV, m.Root)
+	for name, e := range m.Entries {
+		c.Entries[name] = e
+	}
+	return c
+}
+
+// mac returns the HMAC-SHA256 of "data"
+func (k *Keeper) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, k.key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Pack serializes and authenticates "m"
+func (k *Keeper) Pack(m *Manifest) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(version))
+	var flags byte
+	if m.Root {
+		flags |= flagRoot
+	}
+	buf.WriteByte(flags)
+	buf.Write(m.DirIV)
+	names := make([]string, 0, len(m.Entries))
+	for name := range m.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	binary.Write(&buf, binary.BigEndian, uint32(len(names)))
+	for _, name := range names {
+		e := m.Entries[name]
+		binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+		buf.WriteString(name)
+		buf.WriteByte(e.Type)
+		buf.WriteByte(byte(len(e.ID)))
+		buf.Write(e.ID)
+	}
+	buf.Write(k.mac(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// Unpack verifies and decodes a manifest created by Pack
+func (k *Keeper) Unpack(data []byte) (*Manifest, error) {
+	if len(data) < sha256.Size {
+		return nil, ErrAuth
+	}
+	body := data[:len(data)-sha256.Size]
+	if !hmac.Equal(k.mac(body), data[len(body):]) {
+		return nil, ErrAuth
+	}
+	// The data is authentic, so a format error is a bug or a version
+	// mismatch.
+	r := bytes.NewReader(body)
+	var hdr struct {
+		Magic   [4]byte
+		Version uint16
+		Flags   byte
+		DirIV   [nametransform.DirIVLen]byte
+		Count   uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("manifest header: %v", err)
+	}
+	if string(hdr.Magic[:]) != magic || hdr.Version != version {
+		return nil, fmt.Errorf("unsupported manifest version %d", hdr.Version)
+	}
+	m := New(append([]byte(nil), hdr.DirIV[:]...), hdr.Flags&flagRoot != 0)
+	for i := uint32(0); i < hdr.Count; i++ {
+		var nameLen uint16
+		if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %v", i, err)
+		}
+		name := make([]byte, nameLen)
+		var typeAndLen [2]byte
+		_, err := io.ReadFull(r, name)
+		if err == nil {
+			_, err = io.ReadFull(r, typeAndLen[:])
+		}
+		id := make([]byte, typeAndLen[1])
+		if err == nil {
+			_, err = io.ReadFull(r, id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %v", i, err)
+		}
+		if len(id) == 0 {
+			id = nil
+		}
+		m.Entries[string(name)] = Entry{Type: typeAndLen[0], ID: id}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("manifest has %d bytes of trailing garbage", r.Len())
+	}
+	return m, nil
+}
+
+// Read reads and verifies the manifest of the directory "dir" (absolute
+// ciphertext path). The manifest must be authentic and belong to the
+// current gocryptfs.diriv of the directory. Verified manifests are cached.
+// The result is shared and must not be modified, use Clone() for that.
+func (k *Keeper) Read(dir string) (*Manifest, error) {
+	iv, err := nametransform.ReadDirIV(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m := k.lookup(iv); m != nil {
+		return m, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, Filename))
+	if err != nil {
+		return nil, err
+	}
+	m, err := k.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(iv, m.DirIV) {
+		return nil, fmt.Errorf("manifest belongs to a different directory")
+	}
+	k.store(m)
+	return m, nil
+}
+
+// Write atomically replaces the manifest of the directory "dir" (absolute
+// ciphertext path) with "m". "m" goes into the cache and must not be
+// modified afterwards.
+func (k *Keeper) Write(dir string, m *Manifest) error {
+	tmp := filepath.Join(dir, TmpFilename)
+	// A leftover from a crash would make O_EXCL fail
+	syscall.Unlink(tmp)
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		tlog.Warn.Printf("dirmanifest.Write: OpenFile: %v", err)
+		return err
+	}
+	_, err = fd.Write(k.Pack(m))
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscall.Rename(tmp, filepath.Join(dir, Filename))
+	}
+	if err != nil {
+		tlog.Warn.Printf("dirmanifest.Write: %v", err)
+		syscall.Unlink(tmp)
+		return err
+	}
+	k.store(m)
+	return nil
+}
+
+// IsSpecial returns true if "name" is gocryptfs metadata that is not listed
+// in the manifest. "root" says if the directory is the root directory.
+func IsSpecial(name string, root bool) bool {
+	if root && name == configfile.ConfDefaultName {
+		return true
+	}
+	return name == nametransform.DirIVFilename || name == Filename ||
+		name == TmpFilename || strings.HasPrefix(name, RmdirPrefix) ||
+		strings.HasPrefix(name, nametransform.DirIVFilename+".rmdir.") ||
+		nametransform.NameType(name) == nametransform.LongNameFilename
+}
+
+// TypeFromMode returns the entry type for the file mode "mode" as returned
+// by stat(2)
+func TypeFromMode(mode uint32) byte {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return TypeFile
+	case syscall.S_IFDIR:
+		return TypeDir
+	case syscall.S_IFLNK:
+		return TypeSymlink
+	}
+	return TypeOther
+}
+
+// EntryAt returns the manifest entry for the ciphertext file "path" as it is
+// on disk.
+func EntryAt(path string) (Entry, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Type: TypeFromMode(st.Mode)}
+	switch e.Type {
+	case TypeFile:
+		fd, err := os.Open(path)
+		if err != nil {
+			return e, err
+		}
+		defer fd.Close()
+		return FileEntry(fd)
+	case TypeDir:
+		iv, err := nametransform.ReadDirIV(path)
+		if err != nil {
+			return e, err
+		}
+		e.ID = iv
+	case TypeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return e, err
+		}
+		h := sha256.Sum256([]byte(target))
+		e.ID = h[:symlinkIDLen]
+	}
+	return e, nil
+}
+
+// FileEntry returns the manifest entry for the ciphertext file "fd", which
+// must be open for reading. Unlike EntryAt, this also works for files
+// whose permissions do not allow opening them again.
+func FileEntry(fd *os.File) (Entry, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd.Fd()), &st); err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Type: TypeFromMode(uint32(st.Mode))}
+	if e.Type != TypeFile {
+		return e, nil
+	}
+	// The header binds the content blocks to the file. Empty files do not
+	// have one.
+	hdr := make([]byte, contentenc.HeaderLen)
+	n, err := fd.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return e, err
+	}
+	if n > 0 {
+		e.ID = hdr[:n]
+	}
+	return e, nil
+}
+
+// Scan builds a manifest from the current contents of the directory "dir"
+// (absolute ciphertext path).
+func Scan(dir string, root bool) (*Manifest, error) {
+	iv, err := nametransform.ReadDirIV(dir)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	m := New(iv, root)
+	for _, name := range names {
+		if IsSpecial(name, root) {
+			continue
+		}
+		e, err := EntryAt(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m.Entries[name] = e
+	}
+	return m, nil
+}
+
+// Diff compares the manifest "m" with the manifest "actual" that was built
+// by Scan and returns a description of each difference.
+func (m *Manifest) Diff(actual *Manifest) []string {
+	var diffs []string
+	if m.Root != actual.Root {
+		diffs = append(diffs, fmt.Sprintf("root flag is %v, should be %v", m.Root, actual.Root))
+	}
+	for name, e := range actual.Entries {
+		want, ok := m.Entries[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%q is not in the manifest", name))
+		} else if !want.Equal(e) {
+			diffs = append(diffs, fmt.Sprintf("%q is %v, the manifest says %v", name, e, want))
+		}
+	}
+	for name := range m.Entries {
+		if _, ok := actual.Entries[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%q is missing", name))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
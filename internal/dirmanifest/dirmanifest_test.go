@@ -0,0 +1,91 @@
+package dirmanifest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func TestPackUnpack(t *testing.T) {
+	k := NewKeeper(cryptocore.RandBytes(32))
+	m := New(cryptocore.RandBytes(nametransform.DirIVLen), true)
+	m.Entries["file"] = Entry{Type: TypeFile, ID: cryptocore.RandBytes(18)}
+	m.Entries["dir"] = Entry{Type: TypeDir, ID: cryptocore.RandBytes(16)}
+	m.Entries["fifo"] = Entry{Type: TypeOther}
+	data := k.Pack(m)
+	m2, err := k.Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := m2.Diff(m); len(diffs) != 0 || !m2.Root {
+		t.Errorf("round trip changed the manifest: %v", diffs)
+	}
+	// Every single bit is authenticated
+	for i := range data {
+		data[i] ^= 0x80
+		if _, err = k.Unpack(data); err != ErrAuth {
+			t.Fatalf("modified byte %d: want ErrAuth, got %v", i, err)
+		}
+		data[i] ^= 0x80
+	}
+	// So is the key
+	if _, err = NewKeeper(cryptocore.RandBytes(32)).Unpack(data); err != ErrAuth {
+		t.Errorf("wrong key: want ErrAuth, got %v", err)
+	}
+}
+
+// A manifest only verifies in the directory it belongs to
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-dirmanifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := cryptocore.RandBytes(32)
+	k := NewKeeper(key)
+	var ivs [2][]byte
+	for i, sub := range []string{"a", "b"} {
+		d := filepath.Join(dir, sub)
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = nametransform.WriteDirIV(d); err != nil {
+			t.Fatal(err)
+		}
+		ivs[i], _ = nametransform.ReadDirIV(d)
+		if err = k.Write(d, New(ivs[i], false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "a", "file"), []byte("xyz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := k.Read(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := Scan(filepath.Join(dir, "a"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := m.Diff(actual); len(diffs) != 1 {
+		t.Errorf("want one difference, got %v", diffs)
+	}
+	// Move the manifest of "a" into "b"
+	err = os.Rename(filepath.Join(dir, "a", Filename), filepath.Join(dir, "b", Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "k" still has the authentic manifest of "b" in its cache
+	if m, err = k.Read(filepath.Join(dir, "b")); err != nil || !bytes.Equal(m.DirIV, ivs[1]) {
+		t.Errorf("cached manifest: err=%v", err)
+	}
+	if _, err = NewKeeper(key).Read(filepath.Join(dir, "b")); err == nil {
+		t.Error("manifest of another directory was accepted")
+	}
+}
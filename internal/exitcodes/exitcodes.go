@@ -61,6 +61,15 @@ const (
 	// Profiler - error occoured when trying to write cpu or memory profile or
 	// execution trace
 	Profiler = 25
+	// FsckErrors - the filesystem check found errors
+	FsckErrors = 26
+	// ExcludeError - an exclude pattern was invalid or an exclude file could
+	// not be read
+	ExcludeError = 27
+	// ReencryptError - "-reencrypt" was aborted. Run it again to resume.
+	ReencryptError = 28
+	// Argon2idParams means that argon2id was called with invalid parameters
+	Argon2idParams = 29
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -2,6 +2,7 @@ package fusefrontend
 
 import (
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
@@ -13,6 +14,10 @@ type Args struct {
 	CryptoBackend  cryptocore.AEADTypeEnum
 	PlaintextNames bool
 	LongNames      bool
+	// LongNameMax is the longest encrypted name that is not hashed into a
+	// long name. Zero means 255.
+	// Corresponds to the LongNameMax feature flag.
+	LongNameMax int
 	// Should we chown a file after it has been created?
 	// This only makes sense if (1) allow_other is set and (2) we run as root.
 	PreserveOwner bool
@@ -30,13 +35,63 @@ type Args struct {
 	// file names.
 	// Corresponds to the Raw64 feature flag introduced in gocryptfs v1.2.
 	Raw64 bool
+	// NFC is true when file names are normalized to Unicode NFC before
+	// encryption.
+	// Corresponds to the NFC feature flag.
+	NFC bool
+	// Base32 is true when encrypted file names use lower-case base32 instead
+	// of base64.
+	// Corresponds to the Base32 feature flag.
+	Base32 bool
 	// NoPrealloc disables automatic preallocation before writing
 	NoPrealloc bool
 	// Use HKDF key derivation.
 	// Corresponds to the HKDF feature flag introduced in gocryptfs v1.3.
 	HKDF bool
+	// Encrypt extended attributes.
+	// Corresponds to the Xattr feature flag.
+	Xattr bool
 	// Try to serialize read operations, "-serialize_reads"
 	SerializeReads bool
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
+	// Exclude is a list of gitignore-style patterns of plaintext paths that
+	// are hidden in reverse mode, "-exclude"
+	Exclude []string
+	// ExcludeFrom is a list of files that contain exclude patterns,
+	// "-exclude-from"
+	ExcludeFrom []string
+	// ReverseWrite allows writing canonical ciphertext to a reverse mount,
+	// "-reversewrite"
+	ReverseWrite bool
+	// BlockSize is the plaintext block size. Zero means
+	// contentenc.DefaultBS.
+	// Corresponds to the BlockSize feature flag.
+	BlockSize uint64
+	// Compress is true when file content blocks are compressed before they
+	// are encrypted.
+	// Corresponds to the Compression feature flag.
+	Compress bool
+	// LastBlockMarker is true when the last block of each file is marked in
+	// its authenticated data.
+	// Corresponds to the LastBlockMarker feature flag.
+	LastBlockMarker bool
+	// DirManifest is true when every directory has an authenticated
+	// manifest of its entries.
+	// Corresponds to the DirManifest feature flag.
+	DirManifest bool
+	// DecryptWorkers is the number of goroutines used to decrypt a read
+	// request, "-decryptworkers". Zero selects the default.
+	DecryptWorkers int
+	// CacheSize is the size of the decrypted block cache in bytes,
+	// "-cachesize". Zero disables the cache.
+	CacheSize uint64
+}
+
+// PlainBS returns the plaintext block size to use
+func (a *Args) PlainBS() uint64 {
+	if a.BlockSize == 0 {
+		return contentenc.DefaultBS
+	}
+	return a.BlockSize
 }
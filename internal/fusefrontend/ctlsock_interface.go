@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 )
 
 var _ ctlsock.Interface = &FS{} // Verify that interface is implemented.
@@ -48,3 +51,17 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	}
 	return plainPath, nil
 }
+
+// Stats implements ctlsock.Interface
+func (fs *FS) Stats() ctlsock.StatsStruct {
+	return ctlsock.StatsStruct{
+		Uptime:       uint64(time.Since(fs.startTime).Seconds()),
+		BytesRead:    atomic.LoadUint64(&fs.bytesRead),
+		BytesWritten: atomic.LoadUint64(&fs.bytesWritten),
+		AuthFailures: fs.contentEnc.AuthFailures(),
+		OpenFiles:    openfiletable.CountOpenFiles(),
+		WriteOpCount: openfiletable.WriteOpCount(),
+		ReadOpCount:  openfiletable.ReadOpCount(),
+		Backend:      fs.args.CryptoBackend.String(),
+	}
+}
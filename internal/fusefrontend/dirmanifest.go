@@ -0,0 +1,282 @@
+package fusefrontend
+
+// Authenticated directory manifests ("-dirmanifest")
+//
+// Operations that add, remove or replace directory entries hold
+// manifestLock.Lock() from the change on disk until the manifest has been
+// rewritten, so OpenDir() and Open(), which verify the manifests under
+// manifestLock.RLock(), never see an intermediate state.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// lockManifests takes manifestLock.Lock() if directory manifests are
+// enabled. Call unlockManifests() when done.
+func (fs *FS) lockManifests() {
+	if fs.manifests != nil {
+		fs.manifestLock.Lock()
+	}
+}
+
+// unlockManifests releases the lock taken by lockManifests().
+func (fs *FS) unlockManifests() {
+	if fs.manifests != nil {
+		fs.manifestLock.Unlock()
+	}
+}
+
+// isRootDir returns true if "cDir" (absolute ciphertext path) is the root
+// directory of the filesystem.
+func (fs *FS) isRootDir(cDir string) bool {
+	return filepath.Clean(cDir) == filepath.Clean(fs.args.Cipherdir)
+}
+
+// manifestError logs a failed manifest check of "cPath" (absolute ciphertext
+// path) and returns EIO. With "-forcedecode", the problem is only logged.
+func (fs *FS) manifestError(cPath string, err error) fuse.Status {
+	tlog.Warn.Printf("dirmanifest: %q: %v", cPath, err)
+	if fs.args.ForceDecode {
+		return fuse.OK
+	}
+	return fuse.EIO
+}
+
+// writeEmptyManifest creates the manifest of the new directory "cDir"
+// (absolute ciphertext path).
+func (fs *FS) writeEmptyManifest(cDir string, dirIV []byte) error {
+	return fs.manifests.Write(cDir, dirmanifest.New(dirIV, fs.isRootDir(cDir)))
+}
+
+// editManifest reads the manifest of the directory "cDir" (absolute
+// ciphertext path), applies "edit" to it and writes it back. Does nothing
+// without "-dirmanifest".
+// The caller must hold manifestLock.Lock().
+func (fs *FS) editManifest(cDir string, edit func(m *dirmanifest.Manifest) error) fuse.Status {
+	if fs.manifests == nil {
+		return fuse.OK
+	}
+	m, err := fs.manifests.Read(cDir)
+	if err != nil {
+		if !fs.args.ForceDecode {
+			tlog.Warn.Printf("editManifest %q: %v", cDir, err)
+			return fuse.EIO
+		}
+		tlog.Warn.Printf("editManifest %q: %v. Rebuilding it because of -forcedecode.", cDir, err)
+		m, err = dirmanifest.Scan(cDir, fs.isRootDir(cDir))
+		if err != nil {
+			tlog.Warn.Printf("editManifest %q: Scan: %v", cDir, err)
+			return fuse.EIO
+		}
+	} else {
+		// The manifest from Read() is shared
+		m = m.Clone()
+	}
+	if err = edit(m); err != nil {
+		tlog.Warn.Printf("editManifest %q: %v", cDir, err)
+		return fuse.EIO
+	}
+	if err = fs.manifests.Write(cDir, m); err != nil {
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// updateManifest refreshes the entries "cNames" in the manifest of the
+// directory "cDir" (absolute ciphertext path) from disk. Entries that no
+// longer exist are removed. Does nothing without "-dirmanifest".
+// The caller must hold manifestLock.Lock().
+func (fs *FS) updateManifest(cDir string, cNames ...string) fuse.Status {
+	return fs.editManifest(cDir, func(m *dirmanifest.Manifest) error {
+		for _, cName := range cNames {
+			e, err := dirmanifest.EntryAt(filepath.Join(cDir, cName))
+			if os.IsNotExist(err) {
+				delete(m.Entries, cName)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%q: %v", cName, err)
+			}
+			m.Entries[cName] = e
+		}
+		return nil
+	})
+}
+
+// putManifestEntry sets the entry "cName" in the manifest of the directory
+// "cDir" (absolute ciphertext path) to "e". Used instead of updateManifest()
+// when the entry is already known, because the file may not be readable
+// (mode 0200). Does nothing without "-dirmanifest".
+// The caller must hold manifestLock.Lock().
+func (fs *FS) putManifestEntry(cDir string, cName string, e dirmanifest.Entry) fuse.Status {
+	return fs.editManifest(cDir, func(m *dirmanifest.Manifest) error {
+		m.Entries[cName] = e
+		return nil
+	})
+}
+
+// manifestEntry returns the entry for "cPath" (absolute ciphertext path) in
+// the manifest of its parent directory. "ok" is false if there is none or
+// without "-dirmanifest".
+// The caller must hold manifestLock.
+func (fs *FS) manifestEntry(cPath string) (e dirmanifest.Entry, ok bool) {
+	if fs.manifests == nil {
+		return e, false
+	}
+	m, err := fs.manifests.Read(filepath.Dir(cPath))
+	if err != nil {
+		return e, false
+	}
+	e, ok = m.Entries[filepath.Base(cPath)]
+	return e, ok
+}
+
+// verifyEntry checks that the file or directory "cPath" (absolute ciphertext
+// path) is what the manifest of its parent directory says. Does nothing
+// without "-dirmanifest".
+// The caller must hold manifestLock.RLock().
+func (fs *FS) verifyEntry(cPath string) fuse.Status {
+	if fs.manifests == nil || fs.isRootDir(cPath) {
+		return fuse.OK
+	}
+	have, err := dirmanifest.EntryAt(cPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.checkEntry(cPath, have)
+}
+
+// verifyFile is verifyEntry for the regular file "cPath" that has just been
+// opened as "fd". The header is read through "fd", which also works for
+// files with mode 0200.
+// The caller must hold manifestLock.RLock().
+func (fs *FS) verifyFile(cPath string, fd *os.File) fuse.Status {
+	if fs.manifests == nil {
+		return fuse.OK
+	}
+	have, err := dirmanifest.FileEntry(fd)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.checkEntry(cPath, have)
+}
+
+// newVerifiedFile checks the file "fd" that Open() has just opened against
+// the manifest and wraps it with NewFile(). Closes "fd" on failure.
+// The caller must hold manifestLock.RLock().
+func (fs *FS) newVerifiedFile(cPath string, fd *os.File) (nodefs.File, fuse.Status) {
+	if status := fs.verifyFile(cPath, fd); !status.Ok() {
+		fd.Close()
+		return nil, status
+	}
+	return NewFile(fd, fs)
+}
+
+// checkEntry compares "have", the entry of "cPath" (absolute ciphertext path)
+// on disk, with the manifest of the parent directory.
+func (fs *FS) checkEntry(cPath string, have dirmanifest.Entry) fuse.Status {
+	cDir := filepath.Dir(cPath)
+	m, err := fs.manifests.Read(cDir)
+	if err != nil {
+		return fs.manifestError(cDir, err)
+	}
+	want, ok := m.Entries[filepath.Base(cPath)]
+	if !ok {
+		return fs.manifestError(cPath, errors.New("not in the manifest"))
+	}
+	if !want.Equal(have) {
+		return fs.manifestError(cPath, fmt.Errorf("entry is %v, the manifest says %v", have, want))
+	}
+	return fuse.OK
+}
+
+// verifyDir checks the ciphertext directory listing "entries" of "cDir"
+// (absolute ciphertext path) against its manifest, and that the directory is
+// listed in the manifest of its parent. Does nothing without "-dirmanifest".
+// The caller must hold manifestLock.RLock().
+func (fs *FS) verifyDir(cDir string, entries []fuse.DirEntry) fuse.Status {
+	if fs.manifests == nil {
+		return fuse.OK
+	}
+	root := fs.isRootDir(cDir)
+	m, err := fs.manifests.Read(cDir)
+	if err != nil {
+		return fs.manifestError(cDir, err)
+	}
+	if m.Root != root {
+		return fs.manifestError(cDir, errors.New("manifest of the root directory used elsewhere or vice versa"))
+	}
+	n := 0
+	for _, e := range entries {
+		if dirmanifest.IsSpecial(e.Name, root) {
+			continue
+		}
+		n++
+		want, ok := m.Entries[e.Name]
+		if !ok {
+			return fs.manifestError(filepath.Join(cDir, e.Name), errors.New("not in the manifest"))
+		}
+		if have := dirmanifest.TypeFromMode(e.Mode); have != want.Type {
+			return fs.manifestError(filepath.Join(cDir, e.Name),
+				fmt.Errorf("entry type is %c, the manifest says %c", have, want.Type))
+		}
+	}
+	if n != len(m.Entries) {
+		return fs.manifestError(cDir, fmt.Errorf("%d entries are missing", len(m.Entries)-n))
+	}
+	return fs.verifyEntry(cDir)
+}
+
+// truncateOnOpen emulates O_TRUNC in "flags" on the file that Open() or
+// Create() has just opened. mangleOpenFlags() removes O_TRUNC with
+// "-dirmanifest", because it would also remove the file header.
+func (fs *FS) truncateOnOpen(fuseFile nodefs.File, status fuse.Status, flags uint32) (nodefs.File, fuse.Status) {
+	if !status.Ok() || fs.manifests == nil || int(flags)&os.O_TRUNC == 0 {
+		return fuseFile, status
+	}
+	status = fuseFile.Truncate(0)
+	if !status.Ok() {
+		fuseFile.Release()
+		return nil, status
+	}
+	return fuseFile, fuse.OK
+}
+
+// createHeaderAt writes a new file header to the empty file "fd", so that the
+// file ID is known when the file is entered into the manifest.
+func createHeaderAt(fd *os.File) error {
+	h := contentenc.RandomHeader()
+	_, err := fd.WriteAt(h.Pack(), 0)
+	return err
+}
+
+// truncateToHeader implements Truncate(0) with "-dirmanifest". It removes the
+// file content but keeps the header, because the manifest records the file
+// ID.
+// The caller must hold ContentLock.Lock().
+func (f *file) truncateToHeader() fuse.Status {
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if fi.Size() > contentenc.HeaderLen {
+		err = syscall.Ftruncate(f.intFd(), contentenc.HeaderLen)
+	}
+	f.invalidateFile()
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: truncateToHeader: Ftruncate returned error: %v", f.qIno.Ino, f.intFd(), err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
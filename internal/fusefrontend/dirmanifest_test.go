@@ -0,0 +1,185 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newManifestFS sets up a CIPHERDIR with directory manifests like "-init"
+// does and returns the filesystem on top of it.
+func newManifestFS(t *testing.T) (*FS, string) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-dirmanifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	if err = nametransform.WriteDirIV(dir); err != nil {
+		t.Fatal(err)
+	}
+	iv, _ := nametransform.ReadDirIV(dir)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, 128, true, false)
+	if err = dirmanifest.NewKeeper(cc.ManifestKey).Write(dir, dirmanifest.New(iv, true)); err != nil {
+		t.Fatal(err)
+	}
+	args := Args{
+		Cipherdir:     dir,
+		CryptoBackend: cryptocore.BackendGoGCM,
+		LongNames:     true,
+		HKDF:          true,
+		DirManifest:   true,
+	}
+	return NewFS(key, args), dir
+}
+
+func TestDirManifest(t *testing.T) {
+	fs, dir := newManifestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	create := func(path string, content string) {
+		fh, status := fs.Create(path, syscall.O_WRONLY, 0600, ctx)
+		if !status.Ok() {
+			t.Fatalf("Create %q: %v", path, status)
+		}
+		if content != "" {
+			fh.Write([]byte(content), 0)
+		}
+		fh.Release()
+	}
+	ok := func(step string, status fuse.Status) {
+		if !status.Ok() {
+			t.Fatalf("%s: %v", step, status)
+		}
+	}
+	create("a", "aaa")
+	create("empty", "")
+	ok("Mkdir", fs.Mkdir("d", 0700, ctx))
+	ok("Mkdir", fs.Mkdir("e", 0700, ctx))
+	create("d/b", "bbb")
+	ok("Rename", fs.Rename("a", "d/c", ctx))
+	ok("Rename", fs.Rename("d/b", "d/b2", ctx))
+	ok("Symlink", fs.Symlink("target", "l", ctx))
+	ok("Link", fs.Link("d/c", "hard", ctx))
+	ok("Unlink", fs.Unlink("hard", ctx))
+	ok("Rmdir", fs.Rmdir("e", ctx))
+	ok("Mkdir", fs.Mkdir(strings.Repeat("long", 50), 0700, ctx))
+	// Opening with O_TRUNC keeps the file ID
+	fh, status := fs.Open("d/c", syscall.O_WRONLY|syscall.O_TRUNC, ctx)
+	ok("Open O_TRUNC", status)
+	fh.Write([]byte("new"), 0)
+	fh.Release()
+	// Every manifest matches the directory
+	for _, p := range []string{"", "d"} {
+		_, status = fs.OpenDir(p, ctx)
+		ok("OpenDir "+p, status)
+	}
+	_, status = fs.Open("d/c", syscall.O_RDONLY, ctx)
+	ok("Open", status)
+	dirs := 0
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		dirs++
+		m, err := fs.manifests.Read(path)
+		if err != nil {
+			t.Fatalf("%q: %v", path, err)
+		}
+		actual, err := dirmanifest.Scan(path, path == dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diffs := m.Diff(actual); len(diffs) != 0 {
+			t.Errorf("%q: %v", path, diffs)
+		}
+		return nil
+	})
+	if dirs != 3 {
+		t.Errorf("want 3 directories, got %d", dirs)
+	}
+}
+
+// Files with mode 0200 can be created, opened, renamed and linked. The
+// manifest code must not open them for reading behind the back of
+// openWriteOnlyFile(). Only meaningful when not running as root.
+func TestDirManifestWriteOnly(t *testing.T) {
+	fs, dir := newManifestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	fh, status := fs.Create("wo", syscall.O_WRONLY, 0200, ctx)
+	if !status.Ok() {
+		t.Fatalf("Create: %v", status)
+	}
+	fh.Write([]byte("aaa"), 0)
+	fh.Release()
+	if status = fs.Rename("wo", "wo2", ctx); !status.Ok() {
+		t.Fatalf("Rename: %v", status)
+	}
+	if status = fs.Link("wo2", "wo3", ctx); !status.Ok() {
+		t.Fatalf("Link: %v", status)
+	}
+	for _, p := range []string{"wo2", "wo3"} {
+		fh, status = fs.Open(p, syscall.O_WRONLY, ctx)
+		if !status.Ok() {
+			t.Fatalf("Open %q: %v", p, status)
+		}
+		fh.Release()
+	}
+	if _, status = fs.OpenDir("", ctx); !status.Ok() {
+		t.Fatalf("OpenDir: %v", status)
+	}
+}
+
+// Changes to CIPHERDIR behind our back are detected
+func TestDirManifestTampering(t *testing.T) {
+	fs, dir := newManifestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for _, name := range []string{"x", "y", "z"} {
+		fh, status := fs.Create(name, syscall.O_WRONLY, 0600, ctx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		fh.Write([]byte(name), 0)
+		fh.Release()
+	}
+	fs.Mkdir("d1", 0700, ctx)
+	fs.Mkdir("d2", 0700, ctx)
+	cPath := func(path string) string {
+		p, err := fs.getBackingPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	// Swap the content of two files
+	cx, cy := cPath("x"), cPath("y")
+	os.Rename(cx, cx+".tmp")
+	os.Rename(cy, cx)
+	os.Rename(cx+".tmp", cy)
+	if _, status := fs.Open("x", syscall.O_RDONLY, ctx); status != fuse.EIO {
+		t.Errorf("swapped file: want EIO, got %v", status)
+	}
+	// Replace gocryptfs.diriv
+	iv2, _ := nametransform.ReadDirIV(cPath("d2"))
+	ivPath := filepath.Join(cPath("d1"), nametransform.DirIVFilename)
+	os.Remove(ivPath)
+	ioutil.WriteFile(ivPath, iv2, 0400)
+	if _, status := fs.OpenDir("d1", ctx); status != fuse.EIO {
+		t.Errorf("replaced diriv: want EIO, got %v", status)
+	}
+	// Delete a file
+	os.Remove(cPath("z"))
+	if _, status := fs.OpenDir("", ctx); status != fuse.EIO {
+		t.Errorf("deleted file: want EIO, got %v", status)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -52,6 +53,14 @@ type file struct {
 	lastOpCount uint64
 	// Parent filesystem
 	fs *FS
+	// readAheadLock protects nextReadOff and readAheadEnd
+	readAheadLock sync.Mutex
+	// nextReadOff is the plaintext offset where a sequential Read would
+	// continue
+	nextReadOff uint64
+	// readAheadEnd is the end of the plaintext range that has already been
+	// read ahead into the block cache
+	readAheadEnd uint64
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
 	// have not implemented. This prevents build breakage when the go-fuse library
 	// adds new methods to the nodefs.File interface.
@@ -68,6 +77,12 @@ func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
 	}
 	qi := openfiletable.QInoFromStat(&st)
 	e := openfiletable.Register(qi)
+	if st.Size == 0 && fs.blockCache != nil {
+		// The file is new or has been opened with O_TRUNC. Forget what it
+		// looked like before.
+		e.ContentChanged()
+		fs.blockCache.Purge(qi)
+	}
 
 	return &file{
 		fd:             fd,
@@ -92,9 +107,14 @@ func (f *file) readFileID() ([]byte, error) {
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
+	// With directory manifests, the file ID is authenticated by the
+	// manifest and must not change, so header-only files keep theirs.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
 	n, err := f.fd.ReadAt(buf, 0)
+	if err == io.EOF && n == contentenc.HeaderLen && f.fs.manifests != nil {
+		err = nil
+	}
 	if err != nil {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("ino%d: readFileID: incomplete file, got %d instead of %d bytes",
@@ -166,15 +186,33 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 		f.fileTableEntry.HeaderLock.RLock()
 	}
 	fileID := f.fileTableEntry.ID
-	// Read the backing ciphertext in one go
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
-	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
 	skip := blocks[0].Skip
+	// Serve the request from the block cache if we can
+	if f.fs.blockCache != nil {
+		plaintext, ok := f.readCachedBlocks(blocks, fileID)
+		if ok {
+			f.fileTableEntry.HeaderLock.RUnlock()
+			return f.cropPlaintext(dst, plaintext, skip, length), fuse.OK
+		}
+	}
+	// Read the backing ciphertext in one go
+	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
 	tlog.Debug.Printf("JointCiphertextRange(%d, %d) -> %d, %d, %d", off, length, alignedOffset, alignedLength, skip)
+	// Content changes from here on make the data we read unfit for caching
+	gen := f.fileTableEntry.ContentGen()
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
-	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	readLen := int(alignedLength)
+	if f.contentEnc.LastBlockMarker() {
+		// Read one more byte to find out if we hit the end of the file
+		readLen++
+	}
+	n, err := f.fd.ReadAt(ciphertext[:readLen], int64(alignedOffset))
+	eof := n < readLen
+	if n > int(alignedLength) {
+		n = int(alignedLength)
+	}
 	// We don't care if the file ID changes after we have read the data. Drop the lock.
 	f.fileTableEntry.HeaderLock.RUnlock()
 	if err != nil && err != io.EOF {
@@ -193,7 +231,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID, eof)
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		if f.fs.args.ForceDecode && err == stupidgcm.ErrAuth {
@@ -206,9 +244,16 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 			tlog.Warn.Printf("ino%d: doRead: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
 			return nil, fuse.EIO
 		}
+	} else if f.fs.blockCache != nil {
+		f.cacheBlocks(plaintext, firstBlockNo, fileID, gen)
 	}
 
-	// Crop down to the relevant part
+	return f.cropPlaintext(dst, plaintext, skip, length), fuse.OK
+}
+
+// cropPlaintext appends the part of the decrypted blocks "plaintext" that
+// doRead was asked for to "dst" and returns "plaintext" to PReqPool.
+func (f *file) cropPlaintext(dst []byte, plaintext []byte, skip uint64, length uint64) []byte {
 	var out []byte
 	lenHave := len(plaintext)
 	lenWant := int(skip + length)
@@ -221,8 +266,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	out = append(dst, out...)
 	f.fs.contentEnc.PReqPool.Put(plaintext)
-
-	return out, fuse.OK
+	return out
 }
 
 // Read - FUSE call
@@ -236,6 +280,7 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		serialize_reads.Wait(off, len(buf))
 	}
 
+	openfiletable.CountReadOp()
 	out, status := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
 
 	if f.fs.args.SerializeReads {
@@ -249,6 +294,10 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		return nil, status
 	}
 
+	atomic.AddUint64(&f.fs.bytesRead, uint64(len(out)))
+	if f.fs.blockCache != nil {
+		f.readAhead(uint64(off), len(buf), len(out))
+	}
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
 	return fuse.ReadResultData(out), status
 }
@@ -287,6 +336,10 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
+	eof, status := f.prepareLastBlock(blocks, uint64(off)+uint64(len(data)))
+	if status != fuse.OK {
+		return 0, status
+	}
 	toEncrypt := make([][]byte, len(blocks))
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
@@ -308,7 +361,7 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		toEncrypt[i] = blockData
 	}
 	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID, eof)
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
 	var err error
@@ -322,8 +375,13 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	}
 	// Write
 	_, err = f.fd.WriteAt(ciphertext, cOff)
+	if err == nil && f.contentEnc.Compression() {
+		f.punchUnused(ciphertext, cOff)
+	}
 	// Return memory to CReqPool
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
+	// Even a failed write may have modified some blocks
+	f.invalidateBlocks(blocks[0].BlockNo, uint64(len(blocks)))
 	if err != nil {
 		tlog.Warn.Printf("doWrite: Write failed: %s", err.Error())
 		return 0, fuse.ToStatus(err)
@@ -335,15 +393,32 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 // directly (in time and space) follows the last write.
 // This is an optimisation for streaming writes on NFS where a
 // Stat() call is very expensive.
-// The caller must "wlock.lock(f.devIno.ino)" otherwise this check would be racy.
+// The caller must hold the ContentLock (a range lock is enough), otherwise
+// this check would be racy.
 func (f *file) isConsecutiveWrite(off int64) bool {
 	opCount := openfiletable.WriteOpCount()
 	return opCount == f.lastOpCount+1 && off == f.lastWrittenOffset+1
 }
 
+// isInsideFile returns true if block "blockNo" and all blocks before it are
+// full blocks of the file. Writing to them cannot change the file size, so
+// such writes do not have to lock the whole file.
+// The caller must hold a range lock that includes "blockNo".
+func (f *file) isInsideFile(blockNo uint64) bool {
+	plainSize, err := f.statPlainSize()
+	if err != nil {
+		return false
+	}
+	return (blockNo+1)*f.contentEnc.PlainBS() <= plainSize
+}
+
 // Write - FUSE call
 //
 // If the write creates a hole, pads the file to the next block boundary.
+//
+// Writes that stay within the existing full blocks of the file only lock the
+// blocks they touch and run in parallel to other such writes. All others lock
+// the whole file.
 func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
@@ -354,9 +429,27 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 		tlog.Warn.Printf("ino%d fh%d: Write on released file", f.qIno.Ino, f.intFd())
 		return 0, fuse.EBADF
 	}
-	f.fileTableEntry.ContentLock.Lock()
-	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if len(data) > 0 {
+		// Writes that stay within the existing blocks of the file only need
+		// to lock these blocks
+		first := f.contentEnc.PlainOffToBlockNo(uint64(off))
+		last := f.contentEnc.PlainOffToBlockNo(uint64(off) + uint64(len(data)) - 1)
+		f.fileTableEntry.ContentLock.LockRange(first, last)
+		// Streaming writes append to the file. Skip the Stat() call for them.
+		if !f.isConsecutiveWrite(off) && f.isInsideFile(last) {
+			defer f.fileTableEntry.ContentLock.UnlockRange(first, last)
+			n, status := f.doWrite(data, off)
+			if status.Ok() {
+				atomic.AddUint64(&f.fs.bytesWritten, uint64(n))
+			}
+			return n, status
+		}
+		f.fileTableEntry.ContentLock.UpgradeRange(first, last)
+	} else {
+		f.fileTableEntry.ContentLock.Lock()
+	}
+	defer f.fileTableEntry.ContentLock.Unlock()
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -368,6 +461,7 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 	}
 	n, status := f.doWrite(data, off)
 	if status.Ok() {
+		atomic.AddUint64(&f.fs.bytesWritten, uint64(n))
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
 	}
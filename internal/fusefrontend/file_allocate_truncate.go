@@ -4,12 +4,14 @@ package fusefrontend
 // i.e. ftruncate and fallocate
 
 import (
+	"io"
 	"log"
 	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -20,6 +22,13 @@ const FALLOC_DEFAULT = 0x00
 // FALLOC_FL_KEEP_SIZE allocates disk space while not modifying the file size
 const FALLOC_FL_KEEP_SIZE = 0x01
 
+// FALLOC_FL_PUNCH_HOLE deallocates the range, which then reads as zeros.
+// Must be combined with FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// FALLOC_FL_ZERO_RANGE zeroes the range while keeping it allocated
+const FALLOC_FL_ZERO_RANGE = 0x10
+
 // Only warn once
 var allocateWarnOnce sync.Once
 
@@ -35,11 +44,17 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
+// Hole punching and zeroing are implemented by zeroRange.
+//
+// Other modes (collapsing or inserting ranges) are not supported.
 func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
-	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
+	switch mode {
+	case FALLOC_DEFAULT, FALLOC_FL_KEEP_SIZE,
+		FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE,
+		FALLOC_FL_ZERO_RANGE, FALLOC_FL_ZERO_RANGE | FALLOC_FL_KEEP_SIZE:
+	default:
 		f := func() {
-			tlog.Warn.Print("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.Warn.Print("fallocate: only mode 0 (default), 1 (keep size), punch hole and zero range are supported")
 		}
 		allocateWarnOnce.Do(f)
 		return fuse.Status(syscall.EOPNOTSUPP)
@@ -53,6 +68,15 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 
+	if mode&(FALLOC_FL_PUNCH_HOLE|FALLOC_FL_ZERO_RANGE) != 0 {
+		return f.zeroRange(off, sz, mode)
+	}
+	return f.allocate(off, sz, mode)
+}
+
+// allocate implements Allocate for FALLOC_DEFAULT and FALLOC_FL_KEEP_SIZE.
+// The caller must hold ContentLock.Lock().
+func (f *file) allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
 	lastBlock := blocks[len(blocks)-1]
@@ -91,6 +115,76 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	return f.truncateGrowFile(oldPlainSz, newPlainSz)
 }
 
+// zeroRange implements Allocate for FALLOC_FL_PUNCH_HOLE and
+// FALLOC_FL_ZERO_RANGE.
+//
+// Blocks that are completely inside the range are turned into all-zero
+// ciphertext by passing the operation on to the backing file. DecryptBlock
+// reads these as file holes. The partial blocks at the edges are
+// re-encrypted with zeros in the range. The file header is never touched.
+//
+// Zeroing past the end of the file is handled by allocate.
+// The caller must hold ContentLock.Lock().
+func (f *file) zeroRange(off uint64, sz uint64, mode uint32) fuse.Status {
+	plainSz, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	end := off + sz
+	if off < plainSz {
+		zeroEnd := end
+		if zeroEnd > plainSz {
+			zeroEnd = plainSz
+		}
+		blocks := f.contentEnc.ExplodePlainRange(off, zeroEnd-off)
+		// Only the first and the last block can be partial
+		var full []contentenc.IntraBlock
+		var partial []contentenc.IntraBlock
+		for _, b := range blocks {
+			if b.IsPartial() {
+				partial = append(partial, b)
+			} else {
+				full = append(full, b)
+			}
+		}
+		// With the last-block marker, the last block must not become a hole.
+		// Encrypt zeros instead.
+		if n := len(full); n > 0 && f.contentEnc.LastBlockMarker() &&
+			full[n-1].BlockPlainOff()+f.contentEnc.PlainBS() >= plainSz {
+			partial = append(partial, full[n-1])
+			full = full[:n-1]
+		}
+		// Whole blocks first. If the backing filesystem does not support
+		// the operation, we return the error before having changed anything.
+		if len(full) > 0 {
+			cipherOff := full[0].BlockCipherOff()
+			cipherSz := uint64(len(full)) * f.contentEnc.CipherBS()
+			err = syscallcompat.Fallocate(f.intFd(), mode|FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
+			tlog.Debug.Printf("zeroRange off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
+				off, sz, mode, cipherOff, cipherSz)
+			f.invalidateBlocks(full[0].BlockNo, uint64(len(full)))
+			if err != nil {
+				return fuse.ToStatus(err)
+			}
+		}
+		for _, b := range partial {
+			_, status := f.doWrite(make([]byte, b.Length), int64(b.BlockPlainOff()+b.Skip))
+			if !status.Ok() {
+				return status
+			}
+		}
+	}
+	if end <= plainSz || mode&FALLOC_FL_PUNCH_HOLE != 0 {
+		// Punching holes past the end of the file is a no-op
+		return fuse.OK
+	}
+	// Zeroing past the end of the file is the same as allocating
+	if off < plainSz {
+		off = plainSz
+	}
+	return f.allocate(off, end-off, mode&FALLOC_FL_KEEP_SIZE)
+}
+
 // Truncate - FUSE call
 func (f *file) Truncate(newSize uint64) fuse.Status {
 	f.fdLock.RLock()
@@ -104,8 +198,13 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	defer f.fileTableEntry.ContentLock.Unlock()
 	var err error
 	// Common case first: Truncate to zero
+	if newSize == 0 && f.fs.manifests != nil {
+		// The file ID is in the manifest, keep the header
+		return f.truncateToHeader()
+	}
 	if newSize == 0 {
 		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
+		f.invalidateFile()
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
 			return fuse.ToStatus(err)
@@ -137,6 +236,9 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	}
 
 	// File shrinks
+	if f.contentEnc.LastBlockMarker() {
+		return f.truncateShrinkMarked(oldSize, newSize)
+	}
 	blockNo := f.contentEnc.PlainOffToBlockNo(newSize)
 	cipherOff := f.contentEnc.BlockNoToCipherOff(blockNo)
 	plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
@@ -152,6 +254,8 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	}
 	// Truncate down to the last complete block
 	err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
+	// The RMW in doWrite below must not see the old last block
+	f.invalidateFile()
 	if err != nil {
 		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
 		return fuse.ToStatus(err)
@@ -183,6 +287,9 @@ func (f *file) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
+	if status := f.checkLastBlock(oldPlainSz); status != fuse.OK {
+		return status
+	}
 	var n1 uint64
 	if oldPlainSz > 0 {
 		n1 = f.contentEnc.PlainOffToBlockNo(oldPlainSz - 1)
@@ -202,13 +309,17 @@ func (f *file) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 	// is a no-op if it is already block-aligned.
 	f.zeroPad(oldPlainSz)
 	// The new size is block-aligned. In this case we can do everything ourselves
-	// and avoid the call to doWrite.
-	if newPlainSz%f.contentEnc.PlainBS() == 0 {
-		// The file was empty, so it did not have a header. Create one.
+	// and avoid the call to doWrite. Not with the last-block marker, where the
+	// last block must not be a hole.
+	if newPlainSz%f.contentEnc.PlainBS() == 0 && !f.contentEnc.LastBlockMarker() {
+		// The file was empty, so it may not have a header. Create one.
 		if oldPlainSz == 0 {
 			f.fileTableEntry.HeaderLock.Lock()
 			defer f.fileTableEntry.HeaderLock.Unlock()
-			id, err := f.createHeader()
+			id, err := f.readFileID()
+			if err == io.EOF {
+				id, err = f.createHeader()
+			}
 			if err != nil {
 				return fuse.ToStatus(err)
 			}
@@ -216,6 +327,7 @@ func (f *file) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
 		err := syscall.Ftruncate(f.intFd(), cSz)
+		f.invalidateFile()
 		if err != nil {
 			tlog.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
 		}
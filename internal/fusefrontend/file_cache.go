@@ -0,0 +1,114 @@
+package fusefrontend
+
+// Caching of decrypted blocks and read-ahead ("-cachesize")
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// readCachedBlocks returns the plaintext of "blocks" if all of them are in the
+// block cache. The returned slice comes from PReqPool.
+// The caller must hold HeaderLock.RLock().
+func (f *file) readCachedBlocks(blocks []contentenc.IntraBlock, fileID []byte) ([]byte, bool) {
+	plainBS := int(f.contentEnc.PlainBS())
+	plaintext := f.fs.contentEnc.PReqPool.Get()[:0]
+	for _, b := range blocks {
+		var ok bool
+		lenBefore := len(plaintext)
+		plaintext, ok = f.fs.blockCache.Get(f.qIno, fileID, b.BlockNo, plaintext)
+		if !ok {
+			f.fs.contentEnc.PReqPool.Put(plaintext)
+			return nil, false
+		}
+		if len(plaintext)-lenBefore < plainBS {
+			// Short block, this is the end of the file
+			break
+		}
+	}
+	return plaintext, true
+}
+
+// cacheBlocks stores the decrypted blocks "plaintext", starting at
+// "firstBlockNo", in the block cache. "gen" is the content generation from
+// before the ciphertext was read.
+func (f *file) cacheBlocks(plaintext []byte, firstBlockNo uint64, fileID []byte, gen uint64) {
+	plainBS := int(f.contentEnc.PlainBS())
+	var n uint64
+	for off := 0; off < len(plaintext); off += plainBS {
+		end := off + plainBS
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		f.fs.blockCache.Put(f.qIno, fileID, firstBlockNo+n, plaintext[off:end])
+		n++
+	}
+	// The file may have been modified while we were reading. In this case,
+	// what we have just cached may already be outdated. The writer has
+	// dropped the blocks before or will drop them after we cached them, so
+	// checking afterwards is enough.
+	if f.fileTableEntry.ContentGen() != gen {
+		f.fs.blockCache.Delete(f.qIno, firstBlockNo, n)
+	}
+}
+
+// invalidateBlocks drops "count" blocks starting at "firstBlockNo" from the
+// block cache. Must be called after the blocks have been modified on disk.
+func (f *file) invalidateBlocks(firstBlockNo uint64, count uint64) {
+	if f.fs.blockCache == nil {
+		return
+	}
+	f.fileTableEntry.ContentChanged()
+	f.fs.blockCache.Delete(f.qIno, firstBlockNo, count)
+}
+
+// invalidateFile drops all blocks of the file from the block cache. Must be
+// called after the file has been modified on disk.
+func (f *file) invalidateFile() {
+	if f.fs.blockCache == nil {
+		return
+	}
+	f.fileTableEntry.ContentChanged()
+	f.fs.blockCache.Purge(f.qIno)
+}
+
+// readAhead is called by Read after "got" of "want" bytes have been read from
+// offset "off". If the reader goes through the file sequentially, the data
+// that follows is read into the block cache in the background, keeping
+// at least one maximum-sized FUSE request ahead of the reader.
+func (f *file) readAhead(off uint64, want int, got int) {
+	const window = fuse.MAX_KERNEL_WRITE
+	end := off + uint64(got)
+	f.readAheadLock.Lock()
+	sequential := off == f.nextReadOff
+	if !sequential {
+		f.readAheadEnd = 0
+	}
+	f.nextReadOff = end
+	start := end
+	if f.readAheadEnd > start {
+		start = f.readAheadEnd
+	}
+	// A short read means we have hit the end of the file
+	launch := sequential && got == want && start < end+window
+	if launch {
+		f.readAheadEnd = start + window
+	}
+	f.readAheadLock.Unlock()
+	if launch {
+		go f.doReadAhead(start, window)
+	}
+}
+
+// doReadAhead reads "length" bytes at offset "off" into the block cache.
+func (f *file) doReadAhead(off uint64, length uint64) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return
+	}
+	buf := f.fs.contentEnc.PReqPool.Get()
+	f.doRead(buf[:0], off, length)
+	f.fs.contentEnc.PReqPool.Put(buf)
+}
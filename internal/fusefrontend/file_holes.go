@@ -5,6 +5,7 @@ package fusefrontend
 import (
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -53,3 +54,32 @@ func (f *file) zeroPad(plainSize uint64) fuse.Status {
 	_, status := f.doWrite(pad, int64(plainSize))
 	return status
 }
+
+// punchMinLen is the smallest unused range that punchUnused deallocates.
+// Smaller ranges cannot free a whole filesystem block.
+const punchMinLen = 4096
+
+// punchUnused deallocates the unused end of the compressed ciphertext blocks
+// in "ciphertext", which has just been written to offset "cOff". The unused
+// bytes are zero, so the blocks read back the same. This is where the disk
+// space savings of "-compress" come from. Errors are ignored, the
+// unused ranges then simply stay allocated.
+func (f *file) punchUnused(ciphertext []byte, cOff int64) {
+	cipherBS := int(f.contentEnc.CipherBS())
+	for off := 0; off < len(ciphertext); off += cipherBS {
+		end := off + cipherBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		used := f.contentEnc.BlockUsedLen(ciphertext[off:end])
+		if end-off-used < punchMinLen {
+			continue
+		}
+		err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+			cOff+int64(off+used), int64(end-off-used))
+		if err != nil {
+			tlog.Debug.Printf("ino%d: punchUnused: %v", f.qIno.Ino, err)
+			return
+		}
+	}
+}
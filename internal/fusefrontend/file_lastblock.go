@@ -0,0 +1,116 @@
+package fusefrontend
+
+// Keeping the last block of a file marked ("-lastblockmarker")
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// prepareLastBlock is called by doWrite before it writes "blocks", which end
+// at plaintext offset "end". It returns true if the last of the blocks will
+// be the last block of the file. If the write grows the file past its old
+// last block, the old last block is re-encrypted without the marker first.
+// Does nothing without the LastBlockMarker feature flag.
+// The caller must hold HeaderLock.RLock() and have the file ID.
+func (f *file) prepareLastBlock(blocks []contentenc.IntraBlock, end uint64) (bool, fuse.Status) {
+	if !f.contentEnc.LastBlockMarker() || len(blocks) == 0 {
+		return false, fuse.OK
+	}
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return false, fuse.ToStatus(err)
+	}
+	newSize := oldSize
+	if end > newSize {
+		newSize = end
+	}
+	eof := blocks[len(blocks)-1].BlockNo == f.contentEnc.PlainOffToBlockNo(newSize-1)
+	if !eof || oldSize == 0 {
+		return eof, fuse.OK
+	}
+	oldLastBlockNo := f.contentEnc.PlainOffToBlockNo(oldSize - 1)
+	if oldLastBlockNo >= blocks[0].BlockNo {
+		// The old last block is rewritten anyway
+		return eof, fuse.OK
+	}
+	// Reading the old last block also makes sure that the file has not been
+	// truncated behind our back.
+	plainOff := f.contentEnc.BlockNoToPlainOff(oldLastBlockNo)
+	data, status := f.doRead(nil, plainOff, f.contentEnc.PlainBS())
+	if status != fuse.OK {
+		return eof, status
+	}
+	// The write goes past the end of the block, so what is not there yet
+	// reads as zeros anyway.
+	data = append(data, make([]byte, f.contentEnc.PlainBS()-uint64(len(data)))...)
+	_, status = f.writeBlock(data, oldLastBlockNo, false)
+	return eof, status
+}
+
+// writeBlock encrypts "data" as block "blockNo" and writes it to disk.
+// "last" says if it is the last block of the file. Returns the ciphertext
+// offset where the block ends.
+// The caller must hold HeaderLock.RLock() and have the file ID.
+func (f *file) writeBlock(data []byte, blockNo uint64, last bool) (int64, fuse.Status) {
+	ciphertext := f.contentEnc.EncryptBlocks([][]byte{data}, blockNo, f.fileTableEntry.ID, last)
+	cOff := int64(f.contentEnc.BlockNoToCipherOff(blockNo))
+	cEnd := cOff + int64(len(ciphertext))
+	_, err := f.fd.WriteAt(ciphertext, cOff)
+	if err == nil && f.contentEnc.Compression() {
+		f.punchUnused(ciphertext, cOff)
+	}
+	f.fs.contentEnc.CReqPool.Put(ciphertext)
+	f.invalidateBlocks(blockNo, 1)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: writeBlock #%d: %v", f.qIno.Ino, blockNo, err)
+		return 0, fuse.ToStatus(err)
+	}
+	return cEnd, fuse.OK
+}
+
+// checkLastBlock reads the last block of the file of plaintext size
+// "plainSize". This returns EIO if the file has been truncated behind our
+// back. Does nothing without the LastBlockMarker feature flag.
+func (f *file) checkLastBlock(plainSize uint64) fuse.Status {
+	if !f.contentEnc.LastBlockMarker() || plainSize == 0 {
+		return fuse.OK
+	}
+	plainOff := f.contentEnc.BlockNoToPlainOff(f.contentEnc.PlainOffToBlockNo(plainSize - 1))
+	_, status := f.doRead(nil, plainOff, plainSize-plainOff)
+	return status
+}
+
+// truncateShrinkMarked shrinks the file from "oldSize" to "newSize" with the
+// LastBlockMarker feature flag. The new last block is re-encrypted with the
+// marker in place before the file is cut, so there is always a marked last
+// block at the end of the file.
+// The caller must hold ContentLock.Lock().
+func (f *file) truncateShrinkMarked(oldSize uint64, newSize uint64) fuse.Status {
+	if status := f.checkLastBlock(oldSize); status != fuse.OK {
+		return status
+	}
+	blockNo := f.contentEnc.PlainOffToBlockNo(newSize - 1)
+	plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
+	data, status := f.doRead(nil, plainOff, newSize-plainOff)
+	if status != fuse.OK {
+		return status
+	}
+	f.fileTableEntry.HeaderLock.RLock()
+	cEnd, status := f.writeBlock(data, blockNo, true)
+	f.fileTableEntry.HeaderLock.RUnlock()
+	if status != fuse.OK {
+		return status
+	}
+	err := syscall.Ftruncate(f.intFd(), cEnd)
+	f.invalidateFile()
+	if err != nil {
+		tlog.Warn.Printf("ino%d: truncateShrinkMarked: Ftruncate returned error: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
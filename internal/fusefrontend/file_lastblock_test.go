@@ -0,0 +1,102 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// Test that writes, truncates and hole punching keep the last block marked,
+// and that cutting blocks off the backing file is detected
+func TestLastBlockMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-lastblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := Args{
+		Cipherdir:       dir,
+		CryptoBackend:   cryptocore.BackendGoGCM,
+		PlaintextNames:  true,
+		HKDF:            true,
+		LastBlockMarker: true,
+	}
+	fs := NewFS(make([]byte, 32), args)
+	fh, status := fs.Create("file", syscall.O_RDWR, 0600, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer fh.Release()
+	const bs = 4096
+	var want []byte
+	check := func(step string) {
+		buf := make([]byte, len(want)+bs)
+		res, status := fh.Read(buf, 0)
+		if !status.Ok() {
+			t.Fatalf("%s: Read: %v", step, status)
+		}
+		have, _ := res.Bytes(buf)
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%s: content mismatch: have %d bytes, want %d", step, len(have), len(want))
+		}
+	}
+	write := func(off int, data []byte) {
+		if _, status := fh.Write(data, int64(off)); !status.Ok() {
+			t.Fatal(status)
+		}
+		if end := off + len(data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	truncate := func(size int) {
+		if status := fh.Truncate(uint64(size)); !status.Ok() {
+			t.Fatalf("Truncate(%d): %v", size, status)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+	}
+	write(0, bytes.Repeat([]byte("a"), 2*bs))
+	check("aligned write")
+	write(2*bs, []byte("append"))
+	check("append")
+	write(5*bs, []byte("past the end"))
+	check("write past the end")
+	truncate(3 * bs)
+	check("shrink to a block boundary")
+	truncate(3*bs - 10)
+	check("shrink to the middle of a block")
+	truncate(6 * bs)
+	check("grow to a block boundary")
+	status = fh.Allocate(4*bs, 2*bs, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE)
+	if status.Ok() {
+		copy(want[4*bs:], make([]byte, 2*bs))
+		check("punch the last block")
+	}
+
+	// Drop the last block behind our back
+	cSize := fs.contentEnc.PlainSizeToCipherSize(uint64(len(want)))
+	err = syscall.Truncate(dir+"/file", int64(cSize-fs.contentEnc.CipherBS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*bs)
+	if _, status = fh.Read(buf, 3*bs); status != fuse.EIO {
+		t.Errorf("Read after dropping a block: want EIO, got %v", status)
+	}
+	if status = fh.Truncate(uint64(8 * bs)); status != fuse.EIO {
+		t.Errorf("growing Truncate after dropping a block: want EIO, got %v", status)
+	}
+	if status = fh.Truncate(uint64(bs)); status != fuse.EIO {
+		t.Errorf("shrinking Truncate after dropping a block: want EIO, got %v", status)
+	}
+}
@@ -14,8 +14,10 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
+	"github.com/rfjakob/gocryptfs/internal/blockcache"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -24,6 +26,11 @@ import (
 
 // FS implements the go-fuse virtual filesystem interface.
 type FS struct {
+	// bytesRead and bytesWritten count the plaintext bytes that went through
+	// Read and Write. They are accessed atomically and must be the first
+	// elements of the struct to guarantee 64-bit alignment.
+	bytesRead, bytesWritten uint64
+
 	pathfs.FileSystem      // loopbackFileSystem, see go-fuse/fuse/pathfs/loopback.go
 	args              Args // Stores configuration arguments
 	// dirIVLock: Lock()ed if any "gocryptfs.diriv" file is modified
@@ -34,28 +41,51 @@ type FS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Cache of decrypted blocks. Nil if disabled.
+	blockCache *blockcache.BlockCache
 	// This lock is used by openWriteOnlyFile() to block concurrent opens while
 	// it relaxes the permissions on a file.
 	openWriteOnlyLock sync.RWMutex
+	// startTime is the time the filesystem was created, for the uptime
+	// statistics
+	startTime time.Time
+	// Directory manifest helper. Nil if "-dirmanifest" is not used.
+	manifests *dirmanifest.Keeper
+	// manifestLock: Lock()ed while directory entries and their manifest
+	// are changed. Verifiers RLock() it.
+	manifestLock sync.RWMutex
 }
 
 var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
 
 // NewFS returns a new encrypted FUSE overlay filesystem.
 func NewFS(masterkey []byte, args Args) *FS {
-	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, args.ForceDecode)
-	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, args.ForceDecode)
-	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
+	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.BackendIVBits(args.CryptoBackend), args.HKDF, args.ForceDecode)
+	contentEnc := contentenc.New(cryptoCore, args.PlainBS(), args.ForceDecode, args.Compress)
+	contentEnc.SetDecryptWorkers(args.DecryptWorkers)
+	contentEnc.SetLastBlockMarker(args.LastBlockMarker)
+	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.LongNameMax, args.Raw64, args.NFC, args.Base32)
 
 	if args.SerializeReads {
 		serialize_reads.InitSerializer()
 	}
+	var bc *blockcache.BlockCache
+	if n := args.CacheSize / args.PlainBS(); n > 0 {
+		bc = blockcache.New(int(n))
+	}
+	var manifests *dirmanifest.Keeper
+	if args.DirManifest {
+		manifests = dirmanifest.NewKeeper(cryptoCore.ManifestKey)
+	}
 
 	return &FS{
 		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
+		blockCache:    bc,
+		startTime:     time.Now(),
+		manifests:     manifests,
 	}
 }
 
@@ -96,6 +126,13 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 	}
 	// We also cannot open the file in append mode, we need to seek back for RMW
 	newFlags = newFlags &^ os.O_APPEND
+	// With directory manifests, the file header must survive O_TRUNC.
+	// truncateOnOpen() emulates it.
+	// The file is verified through the new fd, which must not be a
+	// symlink that was put in its place.
+	if fs.manifests != nil {
+		newFlags = newFlags&^os.O_TRUNC | syscall.O_NOFOLLOW
+	}
 
 	return newFlags
 }
@@ -116,6 +153,10 @@ func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile n
 		return nil, fuse.ToStatus(err)
 	}
 	tlog.Debug.Printf("Open: %s", cPath)
+	if fs.manifests != nil {
+		fs.manifestLock.RLock()
+		defer fs.manifestLock.RUnlock()
+	}
 	f, err := os.OpenFile(cPath, newFlags, 0)
 	if err != nil {
 		sysErr := err.(*os.PathError).Err
@@ -125,11 +166,13 @@ func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile n
 			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cPath, lim.Cur)
 		}
 		if sysErr == syscall.EACCES && (int(flags)&os.O_WRONLY > 0) {
-			return fs.openWriteOnlyFile(cPath, newFlags)
+			fuseFile, status = fs.openWriteOnlyFile(cPath, newFlags)
+			return fs.truncateOnOpen(fuseFile, status, flags)
 		}
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(f, fs)
+	fuseFile, status = fs.newVerifiedFile(cPath, f)
+	return fs.truncateOnOpen(fuseFile, status, flags)
 }
 
 // Due to RMW, we always need read permissions on the backing file. This is a
@@ -175,7 +218,7 @@ func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.Fil
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(rwFd, fs)
+	return fs.newVerifiedFile(cPath, rwFd)
 }
 
 // Create implements pathfs.Filesystem.
@@ -184,10 +227,16 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 		return nil, fuse.EPERM
 	}
 	newFlags := fs.mangleOpenFlags(flags)
+	if fs.manifests != nil {
+		// We write the file header right away, see below
+		newFlags = newFlags&^syscall.O_ACCMODE | os.O_RDWR
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 
 	var fd *os.File
 	cName := filepath.Base(cPath)
@@ -229,7 +278,37 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
 		}
 	}
-	return NewFile(fd, fs)
+	if fs.manifests == nil {
+		return NewFile(fd, fs)
+	}
+	// The manifest records the file ID, so the file gets its header now
+	// instead of on the first write.
+	fi, err := fd.Stat()
+	if err == nil && fi.Size() == 0 {
+		err = createHeaderAt(fd)
+	}
+	if err != nil {
+		tlog.Warn.Printf("Create: writing the file header failed: %v", err)
+		fd.Close()
+		return nil, fuse.ToStatus(err)
+	}
+	// Read through "fd" because a file with mode 0200 cannot be opened again
+	e, err := dirmanifest.FileEntry(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fuse.ToStatus(err)
+	}
+	fuseFile, code = NewFile(fd, fs)
+	fuseFile, code = fs.truncateOnOpen(fuseFile, code, flags)
+	if !code.Ok() {
+		return nil, code
+	}
+	code = fs.putManifestEntry(filepath.Dir(cPath), cName, e)
+	if !code.Ok() {
+		fuseFile.Release()
+		return nil, code
+	}
+	return fuseFile, fuse.OK
 }
 
 // Chmod implements pathfs.Filesystem.
@@ -267,6 +346,9 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 		// execute the Lchown on "cPath/gocryptfs.diriv" and ignore errors.
 		dirIVPath := filepath.Join(cPath, nametransform.DirIVFilename)
 		os.Lchown(dirIVPath, int(uid), int(gid))
+		if fs.manifests != nil {
+			os.Lchown(filepath.Join(cPath, dirmanifest.Filename), int(uid), int(gid))
+		}
 	}
 	return fuse.OK
 }
@@ -276,10 +358,21 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	if t := mode & syscall.S_IFMT; fs.manifests != nil && (t == syscall.S_IFREG || t == 0) {
+		// Regular files need their header right away, which Create() takes
+		// care of
+		fuseFile, status := fs.Create(path, uint32(os.O_WRONLY|os.O_EXCL), mode&^syscall.S_IFMT, context)
+		if status.Ok() {
+			fuseFile.Release()
+		}
+		return status
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 	// Create ".name" file to store long file name
 	cName := filepath.Base(cPath)
 	if nametransform.IsLongContent(cName) {
@@ -312,7 +405,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 			tlog.Warn.Printf("Mknod: Lchown failed: %v", err)
 		}
 	}
-	return fuse.OK
+	return fs.updateManifest(filepath.Dir(cPath), cName)
 }
 
 // Truncate implements pathfs.Filesystem.
@@ -389,6 +482,8 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 
 	cName := filepath.Base(cPath)
 	if nametransform.IsLongContent(cName) {
@@ -403,6 +498,9 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
+		if code = fs.updateManifest(filepath.Dir(cPath), cName); !code.Ok() {
+			return code
+		}
 		// Delete ".name"
 		err = nametransform.DeleteLongName(dirfd, cName)
 		if err != nil {
@@ -412,7 +510,10 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 	}
 
 	err = syscall.Unlink(cPath)
-	return fuse.ToStatus(err)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.updateManifest(filepath.Dir(cPath), cName)
 }
 
 // Symlink implements pathfs.Filesystem.
@@ -429,6 +530,8 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 		err = os.Symlink(target, cPath)
 		return fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
 	cBinTarget := fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
 	cTarget := fs.nameTransform.B64.EncodeToString(cBinTarget)
@@ -466,7 +569,7 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 			tlog.Warn.Printf("Mknod: Lchown failed: %v", err)
 		}
 	}
-	return fuse.OK
+	return fs.updateManifest(filepath.Dir(cPath), cName)
 }
 
 // Rename implements pathfs.Filesystem.
@@ -482,6 +585,8 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 	// The Rename may cause a directory to take the place of another directory.
 	// That directory may still be in the DirIV cache, clear it.
 	fs.nameTransform.DirIVCache.Clear()
@@ -521,6 +626,9 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 			return fuse.ToStatus(err)
 		}
 	}
+	// The entry moves with the inode. Take it from the manifest, the file
+	// may not be readable (mode 0200).
+	oldEntry, haveOldEntry := fs.manifestEntry(cOldPath)
 	// Actual rename
 	tlog.Debug.Printf("Renameat oldfd=%d oldpath=%s newfd=%d newpath=%s\n", finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
 	err = syscallcompat.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
@@ -531,7 +639,7 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
-		if fs.Rmdir(newPath, context) == fuse.OK {
+		if fs.rmdir(newPath, context) == fuse.OK {
 			err = syscallcompat.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
 		}
 	}
@@ -545,7 +653,27 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if oldDirFd != nil {
 		nametransform.DeleteLongName(oldDirFd, cOldName)
 	}
-	return fuse.OK
+	cOldDir, cNewDir := filepath.Dir(cOldPath), filepath.Dir(cNewPath)
+	if !haveOldEntry {
+		if cOldDir == cNewDir {
+			return fs.updateManifest(cOldDir, cOldName, cNewName)
+		}
+		if code = fs.updateManifest(cOldDir, cOldName); !code.Ok() {
+			return code
+		}
+		return fs.updateManifest(cNewDir, cNewName)
+	}
+	if cOldDir == cNewDir {
+		return fs.editManifest(cOldDir, func(m *dirmanifest.Manifest) error {
+			delete(m.Entries, cOldName)
+			m.Entries[cNewName] = oldEntry
+			return nil
+		})
+	}
+	if code = fs.updateManifest(cOldDir, cOldName); !code.Ok() {
+		return code
+	}
+	return fs.putManifestEntry(cNewDir, cNewName, oldEntry)
 }
 
 // Link implements pathfs.Filesystem.
@@ -561,6 +689,8 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	fs.lockManifests()
+	defer fs.unlockManifests()
 	// Handle long file name
 	cNewName := filepath.Base(cNewPath)
 	if nametransform.IsLongContent(cNewName) {
@@ -579,9 +709,17 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cNewName)
 		}
+	} else {
+		err = os.Link(cOldPath, cNewPath)
+	}
+	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fuse.ToStatus(os.Link(cOldPath, cNewPath))
+	// Like in Rename(), the file may not be readable
+	if e, ok := fs.manifestEntry(cOldPath); ok {
+		return fs.putManifestEntry(filepath.Dir(cNewPath), cNewName, e)
+	}
+	return fs.updateManifest(filepath.Dir(cNewPath), cNewName)
 }
 
 // Access implements pathfs.Filesystem.
@@ -595,23 +733,3 @@ func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse
 	}
 	return fuse.ToStatus(syscall.Access(cPath, mode))
 }
-
-// GetXAttr implements pathfs.Filesystem.
-func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// SetXAttr implements pathfs.Filesystem.
-func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
-
-// ListXAttr implements pathfs.Filesystem.
-func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// RemoveXAttr implements pathfs.Filesystem.
-func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
@@ -7,12 +7,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/dirmanifest"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -32,6 +34,17 @@ func (fs *FS) mkdirWithIv(cPath string, mode uint32) error {
 	}
 	// Create gocryptfs.diriv
 	err = nametransform.WriteDirIV(cPath)
+	if err == nil && fs.manifests != nil {
+		// Create gocryptfs.dirmanifest
+		var iv []byte
+		iv, err = nametransform.ReadDirIV(cPath)
+		if err == nil {
+			err = fs.writeEmptyManifest(cPath, iv)
+		}
+		if err != nil {
+			syscall.Unlink(filepath.Join(cPath, nametransform.DirIVFilename))
+		}
+	}
 	if err != nil {
 		err2 := syscall.Rmdir(cPath)
 		if err2 != nil {
@@ -62,6 +75,9 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		return fuse.ToStatus(err)
 	}
 
+	fs.lockManifests()
+	defer fs.unlockManifests()
+
 	// We need write and execute permissions to create gocryptfs.diriv
 	origMode := mode
 	mode = mode | 0300
@@ -111,12 +127,26 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		if err != nil {
 			tlog.Warn.Printf("Mkdir: Lchown 2 failed: %v", err)
 		}
+		if fs.manifests != nil {
+			err = os.Lchown(filepath.Join(cPath, dirmanifest.Filename), int(context.Owner.Uid), int(context.Owner.Gid))
+			if err != nil {
+				tlog.Warn.Printf("Mkdir: Lchown 3 failed: %v", err)
+			}
+		}
 	}
-	return fuse.OK
+	return fs.updateManifest(filepath.Dir(cPath), cName)
 }
 
 // Rmdir implements pathfs.FileSystem
 func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
+	fs.lockManifests()
+	defer fs.unlockManifests()
+	return fs.rmdir(path, context)
+}
+
+// rmdir is Rmdir without taking manifestLock. Rename() calls it to remove an
+// empty target directory.
+func (fs *FS) rmdir(path string, context *fuse.Context) (code fuse.Status) {
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -176,9 +206,16 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 
 	children, err := dirfd.Readdirnames(10)
 	if err == nil {
-		// If the directory is not empty besides gocryptfs.diriv, do not even
-		// attempt the dance around gocryptfs.diriv.
-		if len(children) > 1 {
+		// If the directory is not empty besides gocryptfs.diriv (and
+		// gocryptfs.dirmanifest), do not even attempt the dance around
+		// gocryptfs.diriv.
+		for _, c := range children {
+			if c == nametransform.DirIVFilename {
+				continue
+			}
+			if fs.manifests != nil && (c == dirmanifest.Filename || c == dirmanifest.TmpFilename) {
+				continue
+			}
 			return fuse.ToStatus(syscall.ENOTEMPTY)
 		}
 		// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
@@ -188,6 +225,31 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		// Protect against concurrent readers.
 		fs.dirIVLock.Lock()
 		defer fs.dirIVLock.Unlock()
+		// Move "gocryptfs.dirmanifest" out of the way the same way
+		var tmpManifest string
+		removed := false
+		if fs.manifests != nil {
+			syscallcompat.Unlinkat(int(dirfd.Fd()), dirmanifest.TmpFilename)
+			tmpManifest = fmt.Sprintf("%s%d", dirmanifest.RmdirPrefix, cryptocore.RandUint64())
+			err = syscallcompat.Renameat(int(dirfd.Fd()), dirmanifest.Filename,
+				int(parentDirFd.Fd()), tmpManifest)
+			if err != nil {
+				tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
+					dirmanifest.Filename, tmpManifest, err)
+				return fuse.ToStatus(err)
+			}
+			defer func() {
+				if removed {
+					syscallcompat.Unlinkat(int(parentDirFd.Fd()), tmpManifest)
+					return
+				}
+				err2 := syscallcompat.Renameat(int(parentDirFd.Fd()), tmpManifest,
+					int(dirfd.Fd()), dirmanifest.Filename)
+				if err2 != nil {
+					tlog.Warn.Printf("Rmdir: Rename rollback of %s failed: %v", dirmanifest.Filename, err2)
+				}
+			}()
+		}
 		err = syscallcompat.Renameat(int(dirfd.Fd()), nametransform.DirIVFilename,
 			int(parentDirFd.Fd()), tmpName)
 		if err != nil {
@@ -199,6 +261,7 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 		// TODO Use syscall.Unlinkat with the AT_REMOVEDIR flag once it is available
 		// in Go
 		err = syscall.Rmdir(cPath)
+		removed = err == nil
 		if err != nil {
 			// This can happen if another file in the directory was created in the
 			// meantime, undo the rename
@@ -231,7 +294,7 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 	}
 	// The now-deleted directory may have been in the DirIV cache. Clear it.
 	fs.nameTransform.DirIVCache.Clear()
-	return fuse.OK
+	return fs.updateManifest(parentDir, cName)
 }
 
 // OpenDir implements pathfs.FileSystem
@@ -241,6 +304,10 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if fs.manifests != nil {
+		fs.manifestLock.RLock()
+		defer fs.manifestLock.RUnlock()
+	}
 	// Read ciphertext directory
 	cDirAbsPath := filepath.Join(fs.args.Cipherdir, cDirName)
 	var cipherEntries []fuse.DirEntry
@@ -271,6 +338,9 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			return nil, fuse.ToStatus(err)
 		}
 	}
+	if status = fs.verifyDir(cDirAbsPath, cipherEntries); !status.Ok() {
+		return nil, status
+	}
 
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
@@ -290,6 +360,11 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if fs.manifests != nil && (cName == dirmanifest.Filename || cName == dirmanifest.TmpFilename ||
+			strings.HasPrefix(cName, dirmanifest.RmdirPrefix)) {
+			// the same for "gocryptfs.dirmanifest" and its temporary files
+			continue
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if fs.args.LongNames {
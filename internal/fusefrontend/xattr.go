@@ -0,0 +1,166 @@
+package fusefrontend
+
+// FUSE operations on extended attributes
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Extended attribute values are encrypted like a single content block. The
+// encrypted attribute name and the random ID of the file are used as the
+// associated data, so a value cannot be moved to a different attribute or
+// to a different file without failing the integrity check. The ID is stored
+// in the attribute nametransform.XattrIDName when the first value is set.
+// Unlike the file ID in the header, it survives truncation, is shared by hard
+// links and also exists for directories.
+
+// encryptXattrValue encrypts the value "data" of the attribute "cAttr"
+// (encrypted name) on the file with the ID "id".
+func (fs *FS) encryptXattrValue(data []byte, cAttr string, id []byte) []byte {
+	return fs.contentEnc.EncryptBlock(data, 0, nametransform.XattrValueAD(cAttr, id))
+}
+
+// decryptXattrValue decrypts the value "cData" of the attribute "cAttr"
+// (encrypted name) on the file with the ID "id".
+func (fs *FS) decryptXattrValue(cData []byte, cAttr string, id []byte) ([]byte, error) {
+	return fs.contentEnc.DecryptBlock(cData, 0, nametransform.XattrValueAD(cAttr, id))
+}
+
+// xattrID returns the ID that binds the attribute values to the file "cPath".
+// If the file has none yet and "create" is set, a random one is stored.
+func (fs *FS) xattrID(cPath string, create bool, context *fuse.Context) ([]byte, fuse.Status) {
+	id, status := fs.FileSystem.GetXAttr(cPath, nametransform.XattrIDName, context)
+	if status == fuse.ENODATA && create {
+		id = cryptocore.RandBytes(nametransform.XattrIDLen)
+		status = fs.FileSystem.SetXAttr(cPath, nametransform.XattrIDName, id, syscallcompat.XattrCreate, context)
+		if status == fuse.Status(syscall.EEXIST) {
+			// Created concurrently
+			return fs.xattrID(cPath, false, context)
+		}
+	}
+	if !status.Ok() {
+		return nil, status
+	}
+	if len(id) != nametransform.XattrIDLen {
+		tlog.Warn.Printf("xattrID: %q has an ID of the wrong length %d", cPath, len(id))
+		return nil, fuse.EIO
+	}
+	return id, fuse.OK
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (fs *FS) GetXAttr(relPath string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if !fs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	if fs.isFiltered(relPath) {
+		return nil, fuse.EPERM
+	}
+	cPath, err := fs.encryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cAttr, err := fs.nameTransform.EncryptXattrName(attr)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cData, status := fs.FileSystem.GetXAttr(cPath, cAttr, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	id, status := fs.xattrID(cPath, false, context)
+	if !status.Ok() {
+		tlog.Warn.Printf("GetXAttr: could not read the ID of %q: %v", cPath, status)
+		return nil, fuse.EIO
+	}
+	data, err := fs.decryptXattrValue(cData, cAttr, id)
+	if err != nil {
+		tlog.Warn.Printf("GetXAttr: could not decrypt value of %q on %q: %v", attr, cPath, err)
+		return nil, fuse.EIO
+	}
+	return data, fuse.OK
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(relPath string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if !fs.args.Xattr {
+		return fuse.ENOSYS
+	}
+	if fs.isFiltered(relPath) {
+		return fuse.EPERM
+	}
+	cPath, err := fs.encryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cAttr, err := fs.nameTransform.EncryptXattrName(attr)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	id, status := fs.xattrID(cPath, true, context)
+	if !status.Ok() {
+		return status
+	}
+	cData := fs.encryptXattrValue(data, cAttr, id)
+	return fs.FileSystem.SetXAttr(cPath, cAttr, cData, flags, context)
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(relPath string, attr string, context *fuse.Context) fuse.Status {
+	if !fs.args.Xattr {
+		return fuse.ENOSYS
+	}
+	if fs.isFiltered(relPath) {
+		return fuse.EPERM
+	}
+	cPath, err := fs.encryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cAttr, err := fs.nameTransform.EncryptXattrName(attr)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FileSystem.RemoveXAttr(cPath, cAttr, context)
+}
+
+// ListXAttr implements pathfs.Filesystem.
+// Attributes on the backing file that were not set through gocryptfs (no
+// "user.gocryptfs." prefix) are hidden, and so is the ID.
+func (fs *FS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.Status) {
+	if !fs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	if fs.isFiltered(relPath) {
+		return nil, fuse.EPERM
+	}
+	cPath, err := fs.encryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cNames, status := fs.FileSystem.ListXAttr(cPath, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	names := make([]string, 0, len(cNames))
+	for _, cName := range cNames {
+		if !strings.HasPrefix(cName, nametransform.XattrPrefix) || cName == nametransform.XattrIDName {
+			continue
+		}
+		name, err := fs.nameTransform.DecryptXattrName(cName)
+		if err != nil {
+			tlog.Warn.Printf("ListXAttr: could not decrypt attribute name %q on %q: %v", cName, cPath, err)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, fuse.OK
+}
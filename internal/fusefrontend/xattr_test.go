@@ -0,0 +1,74 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// Test that an attribute value cannot be moved to a different file
+func TestXattrBoundToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-xattr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS(make([]byte, cryptocore.KeyLen), Args{
+		Cipherdir:     dir,
+		CryptoBackend: cryptocore.BackendGoGCM,
+		HKDF:          true,
+		Xattr:         true,
+	})
+	ctx := &fuse.Context{}
+	for _, name := range []string{"file1", "file2"} {
+		fh, status := fs.Create(name, syscall.O_WRONLY, 0600, ctx)
+		if !status.Ok() {
+			t.Fatalf("Create %q: %v", name, status)
+		}
+		fh.Release()
+		status = fs.SetXAttr(name, "user.test", []byte("value of "+name), 0, ctx)
+		if status == fuse.Status(syscall.EOPNOTSUPP) {
+			t.Skip("backing filesystem does not support user xattrs")
+		} else if !status.Ok() {
+			t.Fatalf("SetXAttr %q: %v", name, status)
+		}
+	}
+	names, status := fs.ListXAttr("file1", ctx)
+	if !status.Ok() || len(names) != 1 || names[0] != "user.test" {
+		t.Errorf("ListXAttr: %v %v", names, status)
+	}
+	// Copy the encrypted value of file1 to file2
+	cAttr, _ := fs.nameTransform.EncryptXattrName("user.test")
+	cPaths := make([]string, 2)
+	for i, name := range []string{"file1", "file2"} {
+		cPath, err := fs.encryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cPaths[i] = filepath.Join(dir, cPath)
+	}
+	cData, err := syscallcompat.Getxattr(cPaths[0], cAttr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscallcompat.Setxattr(cPaths[1], cAttr, cData, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, status := fs.GetXAttr("file1", "user.test", ctx); !status.Ok() || string(data) != "value of file1" {
+		t.Errorf("file1: %q %v", data, status)
+	}
+	if _, status = fs.GetXAttr("file2", "user.test", ctx); status != fuse.EIO {
+		t.Errorf("moved value: want EIO, got %v", status)
+	}
+}
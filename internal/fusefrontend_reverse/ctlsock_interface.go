@@ -3,9 +3,12 @@ package fusefrontend_reverse
 import (
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 )
 
@@ -15,6 +18,9 @@ var _ ctlsock.Interface = &ReverseFS{} // Verify that interface is implemented.
 // This is actually not used inside reverse mode, but we implement it because
 // third-party tools want to encrypt paths through the control socket.
 func (rfs *ReverseFS) EncryptPath(plainPath string) (string, error) {
+	if rfs.isExcludedPlain(plainPath) {
+		return "", syscall.ENOENT
+	}
 	if rfs.args.PlaintextNames || plainPath == "" {
 		return plainPath, nil
 	}
@@ -23,7 +29,7 @@ func (rfs *ReverseFS) EncryptPath(plainPath string) (string, error) {
 	for _, part := range parts {
 		dirIV := pathiv.Derive(cipherPath, pathiv.PurposeDirIV)
 		encryptedPart := rfs.nameTransform.EncryptName(part, dirIV)
-		if rfs.args.LongNames && len(encryptedPart) > syscall.NAME_MAX {
+		if rfs.args.LongNames && len(encryptedPart) > rfs.nameTransform.LongNameMax() {
 			encryptedPart = rfs.nameTransform.HashLongName(encryptedPart)
 		}
 		cipherPath = filepath.Join(cipherPath, encryptedPart)
@@ -36,3 +42,17 @@ func (rfs *ReverseFS) DecryptPath(cipherPath string) (string, error) {
 	p, err := rfs.decryptPath(cipherPath)
 	return p, err
 }
+
+// Stats implements ctlsock.Interface. The byte counters count ciphertext.
+func (rfs *ReverseFS) Stats() ctlsock.StatsStruct {
+	return ctlsock.StatsStruct{
+		Uptime:       uint64(time.Since(rfs.startTime).Seconds()),
+		BytesRead:    atomic.LoadUint64(&rfs.bytesRead),
+		BytesWritten: atomic.LoadUint64(&rfs.bytesWritten),
+		AuthFailures: rfs.contentEnc.AuthFailures(),
+		OpenFiles:    openfiletable.CountOpenFiles(),
+		WriteOpCount: openfiletable.WriteOpCount(),
+		ReadOpCount:  openfiletable.ReadOpCount(),
+		Backend:      rfs.args.CryptoBackend.String(),
+	}
+}
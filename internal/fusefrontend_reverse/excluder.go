@@ -0,0 +1,251 @@
+package fusefrontend_reverse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// excludePattern is one parsed line of a gitignore-style exclude list.
+type excludePattern struct {
+	// negate is true for patterns starting with "!". A matching negated
+	// pattern re-includes a path that an earlier pattern excluded.
+	negate bool
+	// dirOnly is true for patterns ending in "/". They only match directories.
+	dirOnly bool
+	// anchored is true if the pattern contains a slash. It is then matched
+	// against the full path relative to the root directory instead of
+	// against the last path component.
+	anchored bool
+	// parts is the pattern split at slashes
+	parts []string
+}
+
+// excluder decides which plaintext paths are hidden from the reverse view.
+type excluder struct {
+	patterns []excludePattern
+}
+
+// newExcluder parses the gitignore-style "lines". Empty lines and lines
+// starting with "#" are ignored.
+func newExcluder(lines []string) (*excluder, error) {
+	var e excluder
+	for _, l := range lines {
+		l = strings.TrimRight(l, " \t\r")
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		orig := l
+		var p excludePattern
+		if strings.HasPrefix(l, "!") {
+			p.negate = true
+			l = l[1:]
+		} else if strings.HasPrefix(l, `\!`) || strings.HasPrefix(l, `\#`) {
+			l = l[1:]
+		}
+		if strings.HasSuffix(l, "/") {
+			p.dirOnly = true
+			l = strings.TrimRight(l, "/")
+		}
+		if strings.Contains(l, "/") {
+			p.anchored = true
+			l = strings.TrimLeft(l, "/")
+		}
+		if l == "" {
+			return nil, fmt.Errorf("invalid exclude pattern %q", orig)
+		}
+		p.parts = strings.Split(l, "/")
+		for _, part := range p.parts {
+			// Catch malformed patterns early, match() ignores the error
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %q: %v", orig, err)
+			}
+		}
+		e.patterns = append(e.patterns, p)
+	}
+	return &e, nil
+}
+
+// matchParts matches the path components "name" against the pattern
+// components "pat". "**" matches zero or more directories.
+func matchParts(pat []string, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				// "foo/**" matches everything inside "foo", but not "foo"
+				// itself.
+				return len(name) > 0
+			}
+			for i := range name {
+				if matchParts(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat = pat[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// match returns true if the pattern matches the path components "parts".
+func (p *excludePattern) match(parts []string) bool {
+	if p.anchored {
+		return matchParts(p.parts, parts)
+	}
+	ok, _ := path.Match(p.parts[0], parts[len(parts)-1])
+	return ok
+}
+
+// matchLast returns true if the last matching pattern excludes the path
+// components "parts".
+func (e *excluder) matchLast(parts []string, isDir bool) bool {
+	excluded := false
+	for i := range e.patterns {
+		p := &e.patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.match(parts) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// isExcluded returns true if the plaintext path "relPath" (relative to the
+// root directory) is excluded. Everything below an excluded directory is
+// excluded as well. Like in git, it is not possible to re-include a path if
+// one of its parent directories is excluded.
+func (e *excluder) isExcluded(relPath string, isDir bool) bool {
+	if relPath == "" {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if e.matchLast(parts[:i], true) {
+			return true
+		}
+	}
+	return e.matchLast(parts, isDir)
+}
+
+// readExcludeFrom returns the lines of the file "filename".
+func readExcludeFrom(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// prepareExcluder builds an excluder from the "-exclude" and "-exclude-from"
+// options. Returns nil if nothing is excluded. Exits on invalid patterns or
+// unreadable files.
+func prepareExcluder(args fusefrontend.Args) *excluder {
+	if len(args.Exclude) == 0 && len(args.ExcludeFrom) == 0 {
+		return nil
+	}
+	lines := args.Exclude
+	for _, filename := range args.ExcludeFrom {
+		l, err := readExcludeFrom(filename)
+		if err != nil {
+			tlog.Fatal.Printf("Could not read exclude file: %v", err)
+			os.Exit(exitcodes.ExcludeError)
+		}
+		lines = append(lines, l...)
+	}
+	e, err := newExcluder(lines)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.ExcludeError)
+	}
+	return e
+}
+
+// isExcludedPlain returns true if the plaintext path "pRelPath" is hidden by
+// an exclude pattern.
+func (rfs *ReverseFS) isExcludedPlain(pRelPath string) bool {
+	if rfs.excluder == nil || pRelPath == "" {
+		return false
+	}
+	// Never hide the config file that is mapped to "gocryptfs.conf"
+	if pRelPath == configfile.ConfReverseName && !rfs.args.ConfigCustom {
+		return false
+	}
+	isDir := false
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(rfs.args.Cipherdir, pRelPath), &st); err == nil {
+		isDir = st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	}
+	return rfs.excluder.isExcluded(pRelPath, isDir)
+}
+
+// isExcluded returns true if the ciphertext path "relPath" belongs to an
+// excluded plaintext path. Virtual files belong to the directory
+// (gocryptfs.diriv) or the file (.name) they are generated for.
+// Paths that fail to decrypt are not excluded, the caller will report the
+// error.
+func (rfs *ReverseFS) isExcluded(relPath string) bool {
+	if rfs.excluder == nil || rfs.isTranslatedConfig(relPath) {
+		return false
+	}
+	if rfs.isDirIV(relPath) {
+		relPath = relDir(relPath)
+	} else if rfs.isNameFile(relPath) {
+		relPath = strings.TrimSuffix(relPath, nametransform.LongNameSuffix)
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return false
+	}
+	return rfs.isExcludedPlain(pRelPath)
+}
+
+// excludeEntries removes the excluded entries from the listing of the
+// plaintext directory "pDir".
+func (rfs *ReverseFS) excludeEntries(pDir string, entries []fuse.DirEntry) []fuse.DirEntry {
+	if rfs.excluder == nil {
+		return entries
+	}
+	filtered := entries[:0]
+	for _, entry := range entries {
+		p := filepath.Join(pDir, entry.Name)
+		if pDir == "" && entry.Name == configfile.ConfReverseName && !rfs.args.ConfigCustom {
+			filtered = append(filtered, entry)
+			continue
+		}
+		isDir := entry.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if rfs.excluder.isExcluded(p, isDir) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
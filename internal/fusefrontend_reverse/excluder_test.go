@@ -0,0 +1,69 @@
+package fusefrontend_reverse
+
+import (
+	"testing"
+)
+
+func TestExcluder(t *testing.T) {
+	e, err := newExcluder([]string{
+		"# comment",
+		"",
+		"*.o",
+		"node_modules/",
+		"/cache",
+		"build/**/tmp",
+		"docs/*.pdf",
+		"!keep.o",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"main.c", false, false},
+		{"main.o", false, true},
+		{"src/main.o", false, true},
+		{"keep.o", false, false},
+		{"src/keep.o", false, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"a/node_modules", true, true},
+		{"a/node_modules/x/y.js", false, true},
+		{"cache", true, true},
+		{"cache/foo", false, true},
+		{"src/cache", true, false},
+		{"build/tmp", true, true},
+		{"build/a/b/tmp", true, true},
+		{"build/a/b/tmp2", true, false},
+		{"docs/x.pdf", false, true},
+		{"docs/sub/x.pdf", false, false},
+		{"# comment", false, false},
+	}
+	for _, tc := range testCases {
+		if e.isExcluded(tc.path, tc.isDir) != tc.excluded {
+			t.Errorf("%q (isDir=%v): want excluded=%v", tc.path, tc.isDir, tc.excluded)
+		}
+	}
+}
+
+// Re-including a path below an excluded directory is not possible
+func TestExcluderParentExcluded(t *testing.T) {
+	e, err := newExcluder([]string{"dir/", "!dir/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.isExcluded("dir/file", false) {
+		t.Error("dir/file should be excluded")
+	}
+}
+
+func TestExcluderInvalid(t *testing.T) {
+	for _, p := range []string{"[", "foo/[a-", "/"} {
+		if _, err := newExcluder([]string{p}); err == nil {
+			t.Errorf("pattern %q should be rejected", p)
+		}
+	}
+}
@@ -11,15 +11,12 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-const (
-	shortNameMax = 176
-)
-
 var longnameParentCache map[string]string
 var longnameCacheLock sync.Mutex
 
@@ -62,12 +59,12 @@ func (rfs *ReverseFS) findLongnameParent(dir string, dirIV []byte, longname stri
 	longnameCacheLock.Lock()
 	defer longnameCacheLock.Unlock()
 	for _, plaintextName = range dirEntries {
-		if len(plaintextName) <= shortNameMax {
+		if len(plaintextName) <= rfs.nameTransform.ShortNameMax() {
 			continue
 		}
 		cName := rfs.nameTransform.EncryptName(plaintextName, dirIV)
-		if len(cName) <= syscall.NAME_MAX {
-			log.Panic("logic error or wrong shortNameMax constant?")
+		if len(cName) <= rfs.nameTransform.LongNameMax() {
+			log.Panic("logic error or wrong ShortNameMax?")
 		}
 		hName := rfs.nameTransform.HashLongName(cName)
 		longnameParentCache[hName] = plaintextName
@@ -100,5 +97,5 @@ func (rfs *ReverseFS) newNameFile(relPath string) (nodefs.File, fuse.Status) {
 	}
 	content := []byte(rfs.nameTransform.EncryptName(pName, dirIV))
 	parentFile := filepath.Join(rfs.args.Cipherdir, pDir, pName)
-	return rfs.newVirtualFile(content, parentFile, inoBaseNameFile)
+	return rfs.newVirtualFile(content, parentFile, inomap.TagNameFile)
 }
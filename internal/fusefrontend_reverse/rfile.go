@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	// In newer Go versions, this has moved to just "sync/syncmap".
@@ -13,6 +15,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -22,12 +25,21 @@ type reverseFile struct {
 	nodefs.File
 	// Backing FD
 	fd *os.File
+	// Device and inode number of the backing file, for the open file table
+	qIno openfiletable.QIno
 	// File header (contains the IV)
 	header contentenc.FileHeader
 	// IV for block 0
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// The filesystem this file belongs to, for the statistics
+	rfs *ReverseFS
+	// pendingLock protects pending
+	pendingLock sync.Mutex
+	// pending holds the ciphertext blocks that have been partially written
+	// through a "-reversewrite" mount, indexed by block number
+	pending map[uint64]*pendingBlock
 }
 
 var inodeTable syncmap.Map
@@ -37,6 +49,14 @@ func (rfs *ReverseFS) newFile(relPath string, flags uint32) (nodefs.File, fuse.S
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		if !rfs.args.ReverseWrite {
+			return nil, fuse.EROFS
+		}
+		// Partial block writes need the existing plaintext. Offsets are
+		// ciphertext offsets, so O_APPEND cannot work.
+		flags = flags&^(syscall.O_ACCMODE|syscall.O_APPEND) | syscall.O_RDWR
+	}
 	fd, err := os.OpenFile(absPath, int(flags), 0666)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -74,12 +94,17 @@ func (rfs *ReverseFS) newFile(relPath string, flags uint32) (nodefs.File, fuse.S
 		Version: contentenc.CurrentVersion,
 		ID:      derivedIVs.ID,
 	}
+	qIno := openfiletable.QInoFromStat(&st)
+	openfiletable.Register(qIno)
 	return &reverseFile{
 		File:       nodefs.NewDefaultFile(),
 		fd:         fd,
+		qIno:       qIno,
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
 		contentEnc: rfs.contentEnc,
+		rfs:        rfs,
+		pending:    make(map[uint64]*pendingBlock),
 	}, fuse.OK
 }
 
@@ -142,6 +167,7 @@ func (rf *reverseFile) readBackingFile(off uint64, length uint64) (out []byte, e
 
 // Read - FUSE call
 func (rf *reverseFile) Read(buf []byte, ioff int64) (resultData fuse.ReadResult, status fuse.Status) {
+	openfiletable.CountReadOp()
 	length := uint64(len(buf))
 	off := uint64(ioff)
 	var out bytes.Buffer
@@ -178,10 +204,12 @@ func (rf *reverseFile) Read(buf []byte, ioff int64) (resultData fuse.ReadResult,
 		out.Write(fileData)
 	}
 
+	atomic.AddUint64(&rf.rfs.bytesRead, uint64(out.Len()))
 	return fuse.ReadResultData(out.Bytes()), fuse.OK
 }
 
 // Release - FUSE call, close file
 func (rf *reverseFile) Release() {
 	rf.fd.Close()
+	openfiletable.Unregister(rf.qIno)
 }
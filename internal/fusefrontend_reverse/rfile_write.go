@@ -0,0 +1,207 @@
+package fusefrontend_reverse
+
+// Writing ciphertext to a reverse mount ("-reversewrite"). Each ciphertext block is
+// checked against the IVs ReverseFS derives for the path and authenticated
+// before its plaintext is written to the backing file. As the IVs are
+// deterministic, this only accepts exactly the ciphertext that ReverseFS
+// would generate itself.
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// pendingMax is the number of partially written blocks a file may have.
+// Sequential writers only ever have one or two, the limit keeps a writer that
+// leaves gaps from using up memory until close().
+const pendingMax = 64
+
+// pendingBlock is a ciphertext block that has only been partially written so
+// far. The kernel splits writes at page boundaries, so this is the normal
+// case for blocks that straddle one.
+type pendingBlock struct {
+	// data starts out as the ciphertext of the current plaintext block,
+	// overlaid with what has been written
+	data []byte
+	// written marks the bytes of "data" that have been written
+	written []bool
+}
+
+// complete returns true if all bytes of a full-sized block have been written.
+func (p *pendingBlock) complete(cipherBS int) bool {
+	if len(p.data) != cipherBS {
+		return false
+	}
+	for _, w := range p.written {
+		if !w {
+			return false
+		}
+	}
+	return true
+}
+
+// Write - FUSE call. "off" is the ciphertext offset.
+func (rf *reverseFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if !rf.rfs.args.ReverseWrite {
+		return 0, fuse.EROFS
+	}
+	rf.pendingLock.Lock()
+	defer rf.pendingLock.Unlock()
+	openfiletable.CountWriteOp()
+	n := len(data)
+	// The header is derived from the path and cannot change
+	if off < contentenc.HeaderLen {
+		header := rf.header.Pack()
+		l := len(header) - int(off)
+		if l > len(data) {
+			l = len(data)
+		}
+		if !bytes.Equal(data[:l], header[off:int(off)+l]) {
+			tlog.Warn.Printf("ino%d: Write: non-canonical file header", rf.qIno.Ino)
+			return 0, fuse.EINVAL
+		}
+		data = data[l:]
+		off += int64(l)
+	}
+	if len(data) == 0 {
+		atomic.AddUint64(&rf.rfs.bytesWritten, uint64(n))
+		return uint32(n), fuse.OK
+	}
+	for _, b := range rf.contentEnc.ExplodeCipherRange(uint64(off), uint64(len(data))) {
+		status := rf.writeBlock(b.BlockNo, int(b.Skip), data[:b.Length])
+		if !status.Ok() {
+			return 0, status
+		}
+		data = data[b.Length:]
+	}
+	atomic.AddUint64(&rf.rfs.bytesWritten, uint64(n))
+	return uint32(n), fuse.OK
+}
+
+// writeBlock writes "data" at offset "skip" into ciphertext block "blockNo".
+// Complete blocks are applied right away, others are kept in rf.pending.
+// Caller must hold rf.pendingLock.
+func (rf *reverseFile) writeBlock(blockNo uint64, skip int, data []byte) fuse.Status {
+	cipherBS := int(rf.contentEnc.CipherBS())
+	p := rf.pending[blockNo]
+	if p == nil {
+		if skip == 0 && len(data) == cipherBS {
+			return rf.applyBlock(blockNo, data)
+		}
+		if len(rf.pending) >= pendingMax {
+			tlog.Warn.Printf("ino%d: Write: more than %d partially written blocks", rf.qIno.Ino, pendingMax)
+			return fuse.EINVAL
+		}
+		base, err := rf.readBackingFile(rf.contentEnc.BlockNoToCipherOff(blockNo), uint64(cipherBS))
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		p = &pendingBlock{
+			data:    base,
+			written: make([]bool, cipherBS),
+		}
+	}
+	if end := skip + len(data); end > len(p.data) {
+		p.data = append(p.data, make([]byte, end-len(p.data))...)
+	}
+	copy(p.data[skip:], data)
+	for i := skip; i < skip+len(data); i++ {
+		p.written[i] = true
+	}
+	// Reject a wrong nonce right away
+	nonce := pathiv.BlockIV(rf.block0IV, blockNo)
+	if skip < len(nonce) {
+		end := len(nonce)
+		if end > len(p.data) {
+			end = len(p.data)
+		}
+		if !bytes.Equal(p.data[skip:end], nonce[skip:end]) {
+			tlog.Warn.Printf("ino%d: Write: non-canonical nonce in block #%d", rf.qIno.Ino, blockNo)
+			delete(rf.pending, blockNo)
+			return fuse.EINVAL
+		}
+	}
+	if p.complete(cipherBS) {
+		delete(rf.pending, blockNo)
+		return rf.applyBlock(blockNo, p.data)
+	}
+	rf.pending[blockNo] = p
+	return fuse.OK
+}
+
+// applyBlock authenticates the ciphertext block "cBlock" and writes its
+// plaintext to the backing file.
+func (rf *reverseFile) applyBlock(blockNo uint64, cBlock []byte) fuse.Status {
+	nonce := pathiv.BlockIV(rf.block0IV, blockNo)
+	// This also rejects all-zero blocks, which DecryptBlock would happily
+	// turn into a file hole
+	if !bytes.HasPrefix(cBlock, nonce) {
+		tlog.Warn.Printf("ino%d: Write: non-canonical nonce in block #%d", rf.qIno.Ino, blockNo)
+		return fuse.EINVAL
+	}
+	plaintext, err := rf.contentEnc.DecryptBlock(cBlock, blockNo, rf.header.ID)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: Write: corrupt block #%d: %v", rf.qIno.Ino, blockNo, err)
+		return fuse.EINVAL
+	}
+	_, err = rf.fd.WriteAt(plaintext, int64(rf.contentEnc.BlockNoToPlainOff(blockNo)))
+	return fuse.ToStatus(err)
+}
+
+// flushPending applies all partially written blocks. They must authenticate
+// as they are, otherwise the data is discarded and EINVAL is returned.
+func (rf *reverseFile) flushPending() fuse.Status {
+	rf.pendingLock.Lock()
+	defer rf.pendingLock.Unlock()
+	status := fuse.OK
+	for blockNo, p := range rf.pending {
+		if s := rf.applyBlock(blockNo, p.data); !s.Ok() {
+			status = s
+		}
+		delete(rf.pending, blockNo)
+	}
+	return status
+}
+
+// Flush - FUSE call. Called on close(), so this is where incomplete or
+// tampered writes get reported.
+func (rf *reverseFile) Flush() fuse.Status {
+	return rf.flushPending()
+}
+
+// Fsync - FUSE call
+func (rf *reverseFile) Fsync(flags int) fuse.Status {
+	if status := rf.flushPending(); !status.Ok() {
+		return status
+	}
+	return fuse.ToStatus(rf.fd.Sync())
+}
+
+// Truncate - FUSE call. "size" is the ciphertext size.
+func (rf *reverseFile) Truncate(size uint64) fuse.Status {
+	if !rf.rfs.args.ReverseWrite {
+		return fuse.EROFS
+	}
+	plainSize, status := rf.rfs.cipherSizeToPlainSize(size)
+	if !status.Ok() {
+		return status
+	}
+	rf.pendingLock.Lock()
+	defer rf.pendingLock.Unlock()
+	for blockNo, p := range rf.pending {
+		off := rf.contentEnc.BlockNoToCipherOff(blockNo)
+		if off >= size {
+			delete(rf.pending, blockNo)
+		} else if off+uint64(len(p.data)) > size {
+			p.data = p.data[:size-off]
+		}
+	}
+	return fuse.ToStatus(rf.fd.Truncate(int64(plainSize)))
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -15,6 +17,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -23,6 +26,11 @@ import (
 // ReverseFS implements the pathfs.FileSystem interface and provides an
 // encrypted view of a plaintext directory.
 type ReverseFS struct {
+	// bytesRead and bytesWritten count the ciphertext bytes that went
+	// through reverseFile.Read and reverseFile.Write. They are accessed
+	// atomically and must be the first elements of the struct to guarantee
+	// 64-bit alignment.
+	bytesRead, bytesWritten uint64
 	// Embed pathfs.defaultFileSystem for a ENOSYS implementation of all methods
 	pathfs.FileSystem
 	// pathfs.loopbackFileSystem, see go-fuse/fuse/pathfs/loopback.go
@@ -33,6 +41,19 @@ type ReverseFS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Decides which plaintext paths are hidden. nil if nothing is excluded.
+	excluder *excluder
+	// startTime is the time the filesystem was created, for the uptime
+	// statistics
+	startTime time.Time
+	// longnameWrites maps the ciphertext path of a long name to the
+	// plaintext name. Filled when a ".name" file is written with "-reversewrite",
+	// emptied when the file is created.
+	longnameWrites     map[string]string
+	longnameWritesLock sync.Mutex
+	// inoMap translates the backing inode numbers and assigns the inode
+	// numbers of the virtual files
+	inoMap *inomap.InoMap
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -46,16 +67,20 @@ func NewFS(masterkey []byte, args fusefrontend.Args) *ReverseFS {
 	}
 	initLongnameCache()
 	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, false)
-	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, false)
-	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
+	contentEnc := contentenc.New(cryptoCore, args.PlainBS(), false, false)
+	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.LongNameMax, args.Raw64, false, args.Base32)
 
 	return &ReverseFS{
 		// pathfs.defaultFileSystem returns ENOSYS for all operations
-		FileSystem:    pathfs.NewDefaultFileSystem(),
-		loopbackfs:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
-		args:          args,
-		nameTransform: nameTransform,
-		contentEnc:    contentEnc,
+		FileSystem:     pathfs.NewDefaultFileSystem(),
+		loopbackfs:     pathfs.NewLoopbackFileSystem(args.Cipherdir),
+		args:           args,
+		nameTransform:  nameTransform,
+		contentEnc:     contentEnc,
+		excluder:       prepareExcluder(args),
+		startTime:      time.Now(),
+		longnameWrites: make(map[string]string),
+		inoMap:         inomap.New(),
 	}
 }
 
@@ -105,6 +130,9 @@ func (rfs *ReverseFS) isTranslatedConfig(relPath string) bool {
 // GetAttr - FUSE call
 // "relPath" is the relative ciphertext path
 func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if rfs.isExcluded(relPath) {
+		return nil, fuse.ENOENT
+	}
 	// Handle "gocryptfs.conf"
 	if rfs.isTranslatedConfig(relPath) {
 		absConfPath, _ := rfs.abs(configfile.ConfReverseName, nil)
@@ -113,6 +141,7 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 		if err != nil {
 			return nil, fuse.ToStatus(err)
 		}
+		rfs.inoMap.TranslateStat(&st, inomap.TagReal)
 		var a fuse.Attr
 		a.FromStat(&st)
 		if rfs.args.ForceOwner != nil {
@@ -161,12 +190,9 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	// Instead of risking an inode number collision, we return an error.
-	if st.Ino > inoBaseMin {
-		tlog.Warn.Printf("GetAttr %q: backing file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
-			relPath, st.Ino, inoBaseMin)
-		return nil, fuse.ToStatus(syscall.EOVERFLOW)
-	}
+	// Map the backing inode number into our inode number space, shared with
+	// the virtual files
+	rfs.inoMap.TranslateStat(&st, inomap.TagReal)
 	var a fuse.Attr
 	a.FromStat(&st)
 	// Calculate encrypted file size
@@ -209,6 +235,20 @@ func (rfs *ReverseFS) Access(relPath string, mode uint32, context *fuse.Context)
 
 // Open - FUSE call
 func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	if rfs.isExcluded(relPath) {
+		return nil, fuse.ENOENT
+	}
+	writable := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	if writable && rfs.isVirtual(relPath) {
+		if status := rfs.checkWrite(relPath); !status.Ok() {
+			return nil, status
+		}
+		if !rfs.isNameFile(relPath) {
+			return nil, fuse.EPERM
+		}
+		// Overwriting a ".name" file
+		return rfs.newNameWriter(relPath), fuse.OK
+	}
 	if rfs.isTranslatedConfig(relPath) {
 		return rfs.loopbackfs.Open(configfile.ConfReverseName, flags, context)
 	}
@@ -252,11 +292,15 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if rfs.isExcludedPlain(relPath) {
+		return nil, fuse.ENOENT
+	}
 	// Read plaintext dir
 	entries, status := rfs.loopbackfs.OpenDir(relPath, context)
 	if entries == nil {
 		return nil, status
 	}
+	entries = rfs.excludeEntries(relPath, entries)
 	if rfs.args.PlaintextNames {
 		return rfs.openDirPlaintextnames(cipherPath, entries)
 	}
@@ -281,7 +325,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 			cName = configfile.ConfDefaultName
 		} else {
 			cName = rfs.nameTransform.EncryptName(entries[i].Name, dirIV)
-			if len(cName) > syscall.NAME_MAX {
+			if len(cName) > rfs.nameTransform.LongNameMax() {
 				cName = rfs.nameTransform.HashLongName(cName)
 				dotNameFile := fuse.DirEntry{
 					Mode: virtualFileMode,
@@ -0,0 +1,423 @@
+package fusefrontend_reverse
+
+// FUSE operations that modify the plaintext directory. They are only enabled
+// with "-reversewrite". Everything written through the mount must be the ciphertext
+// ReverseFS itself would generate for the path ("canonical ciphertext"),
+// otherwise the operation fails with EINVAL.
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// longnameWritesMax is the number of plaintext names of ".name" files that
+// ReverseFS keeps until the file itself is created
+const longnameWritesMax = 1000
+
+// checkWrite returns EROFS if the mount is read-only and EPERM if "relPath"
+// is the config file. These can never be written.
+func (rfs *ReverseFS) checkWrite(relPath string) fuse.Status {
+	if !rfs.args.ReverseWrite {
+		return fuse.EROFS
+	}
+	if rfs.isTranslatedConfig(relPath) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// decryptNewPath decrypts the ciphertext path "relPath" of a file or
+// directory that is about to be created. Unlike decryptPath, the last
+// component does not have to exist in the plaintext directory. Long names
+// must have their ".name" file written first.
+func (rfs *ReverseFS) decryptNewPath(relPath string) (string, error) {
+	if rfs.args.PlaintextNames {
+		if relPath == configfile.ConfReverseName && !rfs.args.ConfigCustom {
+			return "", syscall.EPERM
+		}
+		return relPath, nil
+	}
+	cDir := nametransform.Dir(relPath)
+	pDir, err := rfs.decryptPath(cDir)
+	if err != nil {
+		return "", err
+	}
+	cName := filepath.Base(relPath)
+	dirIV := pathiv.Derive(cDir, pathiv.PurposeDirIV)
+	var pName string
+	switch nametransform.NameType(cName) {
+	case nametransform.LongNameNone:
+		pName, err = rfs.nameTransform.DecryptName(cName, dirIV)
+		if err != nil {
+			tlog.Warn.Printf("decryptNewPath %q: invalid name: %v", relPath, err)
+			return "", syscall.EINVAL
+		}
+	case nametransform.LongNameContent:
+		rfs.longnameWritesLock.Lock()
+		pName = rfs.longnameWrites[relPath]
+		rfs.longnameWritesLock.Unlock()
+		if pName == "" {
+			// Maybe the file already exists and is overwritten
+			pName, err = rfs.findLongnameParent(pDir, dirIV, cName)
+			if err != nil {
+				tlog.Warn.Printf("decryptNewPath %q: %s file must be written first",
+					relPath, nametransform.LongNameSuffix)
+				return "", syscall.EINVAL
+			}
+		}
+	default:
+		return "", syscall.EINVAL
+	}
+	pRelPath := filepath.Join(pDir, pName)
+	if pRelPath == configfile.ConfReverseName && !rfs.args.ConfigCustom {
+		// Would shadow "gocryptfs.conf"
+		return "", syscall.EPERM
+	}
+	if rfs.isExcludedPlain(pRelPath) {
+		return "", syscall.EPERM
+	}
+	return pRelPath, nil
+}
+
+// storeLongname validates the content "cName" written to the ".name" file
+// "relPath" and remembers the plaintext name for decryptNewPath.
+func (rfs *ReverseFS) storeLongname(relPath string, cName string) fuse.Status {
+	dotName := filepath.Base(relPath)                                    // gocryptfs.longname.XYZ.name
+	longname := dotName[:len(dotName)-len(nametransform.LongNameSuffix)] // gocryptfs.longname.XYZ
+	if rfs.nameTransform.HashLongName(cName) != longname {
+		tlog.Warn.Printf("storeLongname %q: content does not match the hash", relPath)
+		return fuse.EINVAL
+	}
+	cDir := nametransform.Dir(relPath)
+	pName, err := rfs.nameTransform.DecryptName(cName, pathiv.Derive(cDir, pathiv.PurposeDirIV))
+	if err != nil {
+		tlog.Warn.Printf("storeLongname %q: invalid name: %v", relPath, err)
+		return fuse.EINVAL
+	}
+	rfs.longnameWritesLock.Lock()
+	if len(rfs.longnameWrites) >= longnameWritesMax {
+		// ".name" files that are never followed by the file itself.
+		// Drop a random entry.
+		for k := range rfs.longnameWrites {
+			delete(rfs.longnameWrites, k)
+			break
+		}
+	}
+	rfs.longnameWrites[filepath.Join(cDir, longname)] = pName
+	rfs.longnameWritesLock.Unlock()
+	return fuse.OK
+}
+
+// forgetLongname drops the plaintext name stored by storeLongname once the
+// file or directory "relPath" has been created.
+func (rfs *ReverseFS) forgetLongname(relPath string) {
+	rfs.longnameWritesLock.Lock()
+	delete(rfs.longnameWrites, relPath)
+	rfs.longnameWritesLock.Unlock()
+}
+
+// Create - FUSE call. Creates the plaintext file and opens it.
+func (rfs *ReverseFS) Create(relPath string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return nil, status
+	}
+	if rfs.isNameFile(relPath) {
+		return rfs.newNameWriter(relPath), fuse.OK
+	}
+	if rfs.isDirIV(relPath) {
+		return nil, fuse.EPERM
+	}
+	pRelPath, err := rfs.decryptNewPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, status := rfs.loopbackfs.Create(pRelPath, flags&syscall.O_EXCL|syscall.O_WRONLY, mode, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	f.Release()
+	rfs.forgetLongname(relPath)
+	if rfs.args.PreserveOwner {
+		rfs.loopbackfs.Chown(pRelPath, context.Owner.Uid, context.Owner.Gid, context)
+	}
+	return rfs.newFile(relPath, flags&^(syscall.O_CREAT|syscall.O_EXCL))
+}
+
+// Mkdir - FUSE call
+func (rfs *ReverseFS) Mkdir(relPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(relPath) {
+		return fuse.EPERM
+	}
+	pRelPath, err := rfs.decryptNewPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	status := rfs.loopbackfs.Mkdir(pRelPath, mode, context)
+	if !status.Ok() {
+		return status
+	}
+	rfs.forgetLongname(relPath)
+	if rfs.args.PreserveOwner {
+		rfs.loopbackfs.Chown(pRelPath, context.Owner.Uid, context.Owner.Gid, context)
+	}
+	return status
+}
+
+// Unlink - FUSE call. Deleting a virtual file is a no-op, they go away
+// together with their plaintext counterpart.
+func (rfs *ReverseFS) Unlink(relPath string, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(relPath) {
+		return fuse.OK
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if rfs.isExcludedPlain(pRelPath) {
+		return fuse.ENOENT
+	}
+	return rfs.loopbackfs.Unlink(pRelPath, context)
+}
+
+// Rmdir - FUSE call
+func (rfs *ReverseFS) Rmdir(relPath string, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if rfs.isExcludedPlain(pRelPath) {
+		return fuse.ENOENT
+	}
+	return rfs.loopbackfs.Rmdir(pRelPath, context)
+}
+
+// Rename - FUSE call. Renaming a ".name" file to another ".name" file is
+// treated like writing the new one.
+func (rfs *ReverseFS) Rename(oldPath string, newPath string, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(oldPath); !status.Ok() {
+		return status
+	}
+	if status := rfs.checkWrite(newPath); !status.Ok() {
+		return status
+	}
+	if rfs.isNameFile(oldPath) && rfs.isNameFile(newPath) {
+		f, status := rfs.newNameFile(oldPath)
+		if !status.Ok() {
+			return status
+		}
+		return rfs.storeLongname(newPath, string(f.(*virtualFile).content))
+	}
+	if rfs.isVirtual(oldPath) || rfs.isVirtual(newPath) {
+		return fuse.EPERM
+	}
+	pOldPath, err := rfs.decryptPath(oldPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if rfs.isExcludedPlain(pOldPath) {
+		return fuse.ENOENT
+	}
+	pNewPath, err := rfs.decryptNewPath(newPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	status := rfs.loopbackfs.Rename(pOldPath, pNewPath, context)
+	if status.Ok() {
+		rfs.forgetLongname(newPath)
+	}
+	return status
+}
+
+// Symlink - FUSE call. "target" is the encrypted symlink target.
+func (rfs *ReverseFS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(linkName); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(linkName) {
+		return fuse.EPERM
+	}
+	pRelPath, err := rfs.decryptNewPath(linkName)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if !rfs.args.PlaintextNames {
+		cBinTarget, err := rfs.nameTransform.B64.DecodeString(target)
+		if err != nil {
+			return fuse.EINVAL
+		}
+		nonce := pathiv.Derive(linkName, pathiv.PurposeSymlinkIV)
+		if !bytes.HasPrefix(cBinTarget, nonce) {
+			tlog.Warn.Printf("Symlink %q: non-canonical nonce", linkName)
+			return fuse.EINVAL
+		}
+		pTarget, err := rfs.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+		if err != nil {
+			return fuse.EINVAL
+		}
+		target = string(pTarget)
+	}
+	status := rfs.loopbackfs.Symlink(target, pRelPath, context)
+	if !status.Ok() {
+		return status
+	}
+	rfs.forgetLongname(linkName)
+	if rfs.args.PreserveOwner {
+		os.Lchown(filepath.Join(rfs.args.Cipherdir, pRelPath), int(context.Owner.Uid), int(context.Owner.Gid))
+	}
+	return status
+}
+
+// Truncate - FUSE call. "size" is the ciphertext size.
+func (rfs *ReverseFS) Truncate(relPath string, size uint64, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(relPath) {
+		return fuse.EPERM
+	}
+	plainSize, status := rfs.cipherSizeToPlainSize(size)
+	if !status.Ok() {
+		return status
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return rfs.loopbackfs.Truncate(pRelPath, plainSize, context)
+}
+
+// cipherSizeToPlainSize converts the ciphertext file size "size" to the
+// plaintext size. Returns EINVAL if no plaintext encrypts to "size" bytes.
+func (rfs *ReverseFS) cipherSizeToPlainSize(size uint64) (uint64, fuse.Status) {
+	plainSize := rfs.contentEnc.CipherSizeToPlainSize(size)
+	if rfs.contentEnc.PlainSizeToCipherSize(plainSize) != size {
+		tlog.Warn.Printf("Truncate: %d is not a valid ciphertext size", size)
+		return 0, fuse.EINVAL
+	}
+	return plainSize, fuse.OK
+}
+
+// Chmod - FUSE call. Virtual files have a fixed mode, so this is a no-op for
+// them.
+func (rfs *ReverseFS) Chmod(relPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(relPath) {
+		return fuse.OK
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return rfs.loopbackfs.Chmod(pRelPath, mode, context)
+}
+
+// Utimens - FUSE call. Virtual files take their timestamps from the plaintext
+// file, so this is a no-op for them.
+func (rfs *ReverseFS) Utimens(relPath string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	if status := rfs.checkWrite(relPath); !status.Ok() {
+		return status
+	}
+	if rfs.isVirtual(relPath) {
+		return fuse.OK
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return rfs.loopbackfs.Utimens(pRelPath, a, m, context)
+}
+
+// nameWriter collects the content of a ".name" file that is written through
+// the mount. It is checked and stored when the file is closed.
+type nameWriter struct {
+	// Embed nodefs.defaultFile for a ENOSYS implementation of all methods
+	nodefs.File
+	rfs *ReverseFS
+	// relPath is the ciphertext path of the ".name" file
+	relPath string
+	// lock protects content
+	lock    sync.Mutex
+	content []byte
+}
+
+func (rfs *ReverseFS) newNameWriter(relPath string) nodefs.File {
+	return &nameWriter{
+		File:    nodefs.NewDefaultFile(),
+		rfs:     rfs,
+		relPath: relPath,
+	}
+}
+
+// Write - FUSE call
+func (f *nameWriter) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	end := int(off) + len(data)
+	if end > syscall.PathMax {
+		return 0, fuse.EINVAL
+	}
+	if end > len(f.content) {
+		f.content = append(f.content, make([]byte, end-len(f.content))...)
+	}
+	copy(f.content[off:], data)
+	return uint32(len(data)), fuse.OK
+}
+
+// Truncate - FUSE call
+func (f *nameWriter) Truncate(size uint64) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if size > uint64(len(f.content)) {
+		return fuse.EINVAL
+	}
+	f.content = f.content[:size]
+	return fuse.OK
+}
+
+// GetAttr - FUSE call
+func (f *nameWriter) GetAttr(a *fuse.Attr) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	a.Mode = virtualFileMode
+	a.Size = uint64(len(f.content))
+	a.Nlink = 1
+	return fuse.OK
+}
+
+// Flush - FUSE call. Called on close().
+func (f *nameWriter) Flush() fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.content) == 0 {
+		return fuse.OK
+	}
+	return f.rfs.storeLongname(f.relPath, string(f.content))
+}
+
+// Fsync - FUSE call. There is nothing to sync.
+func (f *nameWriter) Fsync(flags int) fuse.Status {
+	return fuse.OK
+}
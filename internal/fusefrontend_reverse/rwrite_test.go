@@ -0,0 +1,241 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+)
+
+// newTestFS returns a writable ReverseFS on top of a new temporary directory.
+func newTestFS(t *testing.T) (*ReverseFS, string) {
+	dir, err := ioutil.TempDir("", "rwrite_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs := NewFS(make([]byte, cryptocore.KeyLen), fusefrontend.Args{
+		Cipherdir:     dir,
+		CryptoBackend: cryptocore.BackendAESSIV,
+		LongNames:     true,
+		Raw64:         true,
+		HKDF:          true,
+		ConfigCustom:  true,
+		ReverseWrite:  true,
+	})
+	return rfs, dir
+}
+
+// cipherName returns the ciphertext name of "pName" in the root directory.
+func cipherName(rfs *ReverseFS, pName string) string {
+	cName := rfs.nameTransform.EncryptName(pName, pathiv.Derive("", pathiv.PurposeDirIV))
+	if len(cName) > rfs.nameTransform.LongNameMax() {
+		return rfs.nameTransform.HashLongName(cName)
+	}
+	return cName
+}
+
+// readAll reads the whole ciphertext file "cPath".
+func readAll(t *testing.T, rfs *ReverseFS, cPath string) []byte {
+	f, status := rfs.Open(cPath, syscall.O_RDONLY, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatalf("Open %q: %v", cPath, status)
+	}
+	defer f.Release()
+	buf := make([]byte, 1000000)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatalf("Read %q: %v", cPath, status)
+	}
+	if res == nil {
+		return nil
+	}
+	data, _ := res.Bytes(buf)
+	return append([]byte{}, data...)
+}
+
+// writeAll creates "cPath" and writes "data" in page-sized chunks, like the
+// kernel would. Returns the first error.
+func writeAll(rfs *ReverseFS, cPath string, data []byte) fuse.Status {
+	f, status := rfs.Create(cPath, syscall.O_WRONLY, 0600, &fuse.Context{})
+	if !status.Ok() {
+		return status
+	}
+	defer f.Release()
+	for off := 0; off < len(data); off += 4096 {
+		end := off + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, status = f.Write(data[off:end], int64(off)); !status.Ok() {
+			return status
+		}
+	}
+	return f.Flush()
+}
+
+// Test that ciphertext read from the mount can be written back, and that
+// anything else is rejected
+func TestReverseWrite(t *testing.T) {
+	rfs, dir := newTestFS(t)
+	defer os.RemoveAll(dir)
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	long := strings.Repeat("x", 200)
+	for _, name := range []string{"file1", long} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cFile1 := cipherName(rfs, "file1")
+	cLong := cipherName(rfs, long)
+	ciphertext := readAll(t, rfs, cFile1)
+	cLongData := readAll(t, rfs, cLong)
+	dotName := readAll(t, rfs, cLong+nametransform.LongNameSuffix)
+	os.Remove(filepath.Join(dir, "file1"))
+	os.Remove(filepath.Join(dir, long))
+
+	// Restore both files
+	ops := rfs.Stats().WriteOpCount
+	if status := writeAll(rfs, cFile1, ciphertext); !status.Ok() {
+		t.Fatalf("restoring file1: %v", status)
+	}
+	if st := rfs.Stats(); st.BytesWritten != uint64(len(ciphertext)) || st.WriteOpCount <= ops {
+		t.Errorf("writes were not counted: %+v", st)
+	}
+	if status := writeAll(rfs, cipherName(rfs, long+"2"), nil); status.Ok() {
+		t.Error("creating a long name without its .name file should fail")
+	}
+	if status := writeAll(rfs, cLong+nametransform.LongNameSuffix, dotName); !status.Ok() {
+		t.Fatalf("writing the .name file: %v", status)
+	}
+	if status := writeAll(rfs, cLong, cLongData); !status.Ok() {
+		t.Fatalf("restoring the long name file: %v", status)
+	}
+	if len(rfs.longnameWrites) != 0 {
+		t.Errorf("long name was not forgotten after use: %v", rfs.longnameWrites)
+	}
+	for _, name := range []string{"file1", long} {
+		have, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(have, content) {
+			t.Errorf("%s was not restored: err=%v", name, err)
+		}
+	}
+
+	// The same ciphertext under a different name is not canonical
+	if status := writeAll(rfs, cipherName(rfs, "file2"), ciphertext); status.Ok() {
+		t.Error("ciphertext copied to a different path should be rejected")
+	}
+	// Neither is a modified block, also if it is only detected on close
+	for _, off := range []int{100, 8200} {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[off] ^= 1
+		if status := writeAll(rfs, cFile1, tampered); status.Ok() {
+			t.Errorf("modified byte at offset %d should be rejected", off)
+		}
+	}
+	// Nor an all-zero block
+	if status := writeAll(rfs, cFile1, make([]byte, len(ciphertext))); status.Ok() {
+		t.Error("all-zero ciphertext should be rejected")
+	}
+}
+
+// Test directory operations with encrypted names
+func TestReverseWriteDirs(t *testing.T) {
+	rfs, dir := newTestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	cDir := cipherName(rfs, "dir1")
+	if status := rfs.Mkdir(cDir, 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "dir1")); err != nil || !fi.IsDir() {
+		t.Fatalf("dir1 was not created: %v", err)
+	}
+	if status := rfs.Mkdir("not-encrypted", 0700, ctx); status != fuse.EINVAL {
+		t.Errorf("invalid names should fail with EINVAL, got %v", status)
+	}
+	cDir2 := cipherName(rfs, "dir2")
+	if status := rfs.Rename(cDir, cDir2, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir2")); err != nil {
+		t.Fatalf("dir1 was not renamed: %v", err)
+	}
+	// Deleting gocryptfs.diriv is a no-op
+	if status := rfs.Unlink(filepath.Join(cDir2, nametransform.DirIVFilename), ctx); !status.Ok() {
+		t.Error(status)
+	}
+	if status := rfs.Rmdir(cDir2, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir2")); !os.IsNotExist(err) {
+		t.Errorf("dir2 was not deleted: %v", err)
+	}
+	// Symlinks
+	if err := os.Symlink("/foo/bar", filepath.Join(dir, "link1")); err != nil {
+		t.Fatal(err)
+	}
+	cLink := cipherName(rfs, "link1")
+	cTarget, status := rfs.Readlink(cLink, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	os.Remove(filepath.Join(dir, "link1"))
+	if status = rfs.Symlink(cTarget, cipherName(rfs, "link2"), ctx); status.Ok() {
+		t.Error("symlink target with a foreign nonce should be rejected")
+	}
+	if status = rfs.Symlink(cTarget, cLink, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link1")); err != nil || target != "/foo/bar" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+}
+
+// Test that writes fail on a read-only ReverseFS
+func TestReverseWriteDisabled(t *testing.T) {
+	rfs, dir := newTestFS(t)
+	defer os.RemoveAll(dir)
+	rfs.args.ReverseWrite = false
+	if status := rfs.Mkdir(cipherName(rfs, "dir1"), 0700, &fuse.Context{}); status != fuse.EROFS {
+		t.Errorf("want EROFS, got %v", status)
+	}
+}
+
+// Test that the number of partially written blocks is limited
+func TestReverseWritePendingMax(t *testing.T) {
+	rfs, dir := newTestFS(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, status := rfs.Open(cipherName(rfs, "file1"), syscall.O_WRONLY, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	// The last byte of every block, so none of them is ever complete
+	cipherBS := int64(rfs.contentEnc.CipherBS())
+	for i := int64(0); i <= pendingMax; i++ {
+		off := contentenc.HeaderLen + (i+1)*cipherBS - 1
+		_, status = f.Write([]byte{0}, off)
+		if i < pendingMax && !status.Ok() {
+			t.Fatalf("block %d: %v", i, status)
+		} else if i == pendingMax && status != fuse.EINVAL {
+			t.Errorf("want EINVAL beyond the limit, got %v", status)
+		}
+	}
+}
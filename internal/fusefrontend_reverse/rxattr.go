@@ -0,0 +1,83 @@
+package fusefrontend_reverse
+
+// FUSE operations on extended attributes
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// isVirtual returns true if "relPath" is a file that does not exist in the
+// plaintext directory, but is generated by ReverseFS.
+func (rfs *ReverseFS) isVirtual(relPath string) bool {
+	return rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath)
+}
+
+// GetXAttr - FUSE call. Returns the encrypted value of the attribute with the
+// encrypted name "cAttr".
+// "relPath" is the relative ciphertext path
+func (rfs *ReverseFS) GetXAttr(relPath string, cAttr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if !rfs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	if rfs.isVirtual(relPath) {
+		return nil, fuse.ENODATA
+	}
+	// The ID that binds the values to the file is derived from the path
+	id := pathiv.Derive(relPath, pathiv.PurposeXattrID)
+	if cAttr == nametransform.XattrIDName {
+		return id, fuse.OK
+	}
+	attr, err := rfs.nameTransform.DecryptXattrName(cAttr)
+	if err != nil {
+		return nil, fuse.ENODATA
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	data, status := rfs.loopbackfs.GetXAttr(pRelPath, attr, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	// Like symlinks, the value is encrypted with a deterministic nonce so that
+	// the ciphertext stays stable across reads.
+	nonce := pathiv.Derive(relPath+"\000"+cAttr, pathiv.PurposeXattrIV)
+	return rfs.contentEnc.EncryptBlockNonce(data, 0, nametransform.XattrValueAD(cAttr, id), nonce), fuse.OK
+}
+
+// ListXAttr - FUSE call. Returns the encrypted names of all attributes and,
+// if there are any, the name of the ID.
+// "relPath" is the relative ciphertext path
+func (rfs *ReverseFS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.Status) {
+	if !rfs.args.Xattr {
+		return nil, fuse.ENOSYS
+	}
+	if rfs.isVirtual(relPath) {
+		return nil, fuse.OK
+	}
+	pRelPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	names, status := rfs.loopbackfs.ListXAttr(pRelPath, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	cNames := make([]string, 0, len(names))
+	for _, name := range names {
+		cName, err := rfs.nameTransform.EncryptXattrName(name)
+		if err != nil {
+			tlog.Warn.Printf("ListXAttr: could not encrypt attribute name %q: %v", name, err)
+			continue
+		}
+		cNames = append(cNames, cName)
+	}
+	if len(cNames) > 0 {
+		cNames = append(cNames, nametransform.XattrIDName)
+	}
+	return cNames, fuse.OK
+}
@@ -2,34 +2,21 @@ package fusefrontend_reverse
 
 import (
 	"log"
+	"path/filepath"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-const (
-	// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv and
-	// *.name). They are always readable, as stated in func Access
-	virtualFileMode = syscall.S_IFREG | 0444
-	// inoBaseDirIV is the start of the inode number range that is used
-	// for virtual gocryptfs.diriv files. inoBaseNameFile is the thing for
-	// *.name files.
-	// The value 10^19 is just below 2^60. A power of 10 has been chosen so the
-	// "ls -li" output (which is base-10) is easy to read.
-	// 10^19 is the largest power of 10 that is smaller than
-	// INT64_MAX (=UINT64_MAX/2). This avoids signedness issues.
-	inoBaseDirIV    = uint64(1000000000000000000)
-	inoBaseNameFile = uint64(2000000000000000000)
-	// inoBaseMin marks the start of the inode number space that is
-	// reserved for virtual files. It is the lowest of the inoBaseXXX values
-	// above.
-	inoBaseMin = inoBaseDirIV
-)
+// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv and
+// *.name). They are always readable, as stated in func Access
+const virtualFileMode = syscall.S_IFREG | 0444
 
 func (rfs *ReverseFS) newDirIVFile(cRelPath string) (nodefs.File, fuse.Status) {
 	cDir := nametransform.Dir(cRelPath)
@@ -37,7 +24,7 @@ func (rfs *ReverseFS) newDirIVFile(cRelPath string) (nodefs.File, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	return rfs.newVirtualFile(pathiv.Derive(cDir, pathiv.PurposeDirIV), absDir, inoBaseDirIV)
+	return rfs.newVirtualFile(pathiv.Derive(cDir, pathiv.PurposeDirIV), absDir, inomap.TagDirIV)
 }
 
 type virtualFile struct {
@@ -47,23 +34,27 @@ type virtualFile struct {
 	content []byte
 	// absolute path to a parent file
 	parentFile string
-	// inode number of a virtual file is inode of parent file plus inoBase
-	inoBase uint64
+	// inode number of a virtual file is the inode number of the parent file,
+	// translated with inoTag
+	inoTag uint8
+	// inoMap translates the inode numbers
+	inoMap *inomap.InoMap
 }
 
 // newVirtualFile creates a new in-memory file that does not have a representation
 // on disk. "content" is the file content. Timestamps and file owner are copied
 // from "parentFile" (absolute plaintext path). For a "gocryptfs.diriv" file, you
 // would use the parent directory as "parentFile".
-func (rfs *ReverseFS) newVirtualFile(content []byte, parentFile string, inoBase uint64) (nodefs.File, fuse.Status) {
-	if inoBase < inoBaseMin {
-		log.Panicf("BUG: virtual inode number base %d is below reserved space", inoBase)
+func (rfs *ReverseFS) newVirtualFile(content []byte, parentFile string, inoTag uint8) (nodefs.File, fuse.Status) {
+	if inoTag == inomap.TagReal {
+		log.Panicf("BUG: virtual file uses the inode tag of real files")
 	}
 	return &virtualFile{
 		File:       nodefs.NewDefaultFile(),
 		content:    content,
 		parentFile: parentFile,
-		inoBase:    inoBase,
+		inoTag:     inoTag,
+		inoMap:     rfs.inoMap,
 	}, fuse.OK
 }
 
@@ -87,12 +78,22 @@ func (f *virtualFile) GetAttr(a *fuse.Attr) fuse.Status {
 		tlog.Debug.Printf("GetAttr: Lstat %q: %v\n", f.parentFile, err)
 		return fuse.ToStatus(err)
 	}
-	if st.Ino > inoBaseMin {
-		tlog.Warn.Printf("virtualFile.GetAttr: parent file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
-			st.Ino, inoBaseMin)
-		return fuse.ToStatus(syscall.EOVERFLOW)
+	isDir := st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	if f.inoTag == inomap.TagNameFile && !isDir && st.Nlink > 1 {
+		// The hard links of a file each have their own .name file, so the
+		// parent file does not identify the .name file. Use the name in
+		// the directory instead.
+		var dirSt syscall.Stat_t
+		dir := filepath.Dir(f.parentFile)
+		err = syscall.Lstat(dir, &dirSt)
+		if err != nil {
+			tlog.Debug.Printf("GetAttr: Lstat %q: %v\n", dir, err)
+			return fuse.ToStatus(err)
+		}
+		st.Ino = f.inoMap.TranslateNamed(inomap.QInoFromStat(&dirSt, f.inoTag), filepath.Base(f.parentFile))
+	} else {
+		f.inoMap.TranslateStat(&st, f.inoTag)
 	}
-	st.Ino = st.Ino + f.inoBase
 	st.Size = int64(len(f.content))
 	st.Mode = virtualFileMode
 	st.Nlink = 1
@@ -0,0 +1,154 @@
+// Package inomap translates (Dev, Tag, Ino) tuples to unique uint64
+// inode numbers. It is used by reverse mode, where the inode numbers of
+// backing files from several devices and of virtual files have to share the
+// inode number space of a single FUSE mount.
+//
+// Format of the returned inode numbers:
+//
+//   [spill bit = 0][2 bit tag][13 bit namespace id][48 bit passthru inode number]
+//   [spill bit = 1][63 bit spill inode number                                   ]
+//
+// Each device gets a namespace id assigned, in the order the devices are seen.
+// The backing inode number is then passed through in the lower 48 bits. As
+// the root directory is always seen first, the inode numbers of a tree that
+// lives on a single device are the same across mounts.
+//
+// If the namespace ids are exhausted, or the backing inode number is larger
+// than 48 bits, the whole (Dev, Tag, Ino) tuple gets mapped in the spill map,
+// and the spill bit is set to 1. Spill inode numbers are only stable for the
+// lifetime of the InoMap.
+package inomap
+
+import (
+	"sync"
+	"syscall"
+)
+
+const (
+	// TagReal marks a real (backing) file
+	TagReal = 0
+	// TagDirIV marks the virtual gocryptfs.diriv file of a directory
+	TagDirIV = 1
+	// TagNameFile marks the virtual .name file of a file with a long name
+	TagNameFile = 2
+
+	// bit position of the tag
+	tagShift = 61
+	// bit position of the namespace id
+	namespaceShift = 48
+	// max value of the 13 bit namespace id
+	maxNamespaceID = 1<<13 - 1
+	// max value of the 48 bit passthru inode number
+	maxPassthruIno = 1<<48 - 1
+	// the spill bit
+	spillBit = 1 << 63
+)
+
+// QIno identifies a file through the device number, a tag that separates
+// virtual files from real files, and the inode number.
+type QIno struct {
+	Dev uint64
+	Tag uint8
+	Ino uint64
+}
+
+// QInoFromStat fills a new QIno struct with the passed Stat_t info and "tag".
+func QInoFromStat(st *syscall.Stat_t, tag uint8) QIno {
+	return QIno{
+		// Explicit casts for the architectures that use 32-bit values
+		Dev: uint64(st.Dev),
+		Tag: tag,
+		Ino: uint64(st.Ino),
+	}
+}
+
+// namedQIno identifies a virtual file through its directory and its name.
+type namedQIno struct {
+	dir  QIno
+	name string
+}
+
+// InoMap stores the namespace ids and the spill map.
+type InoMap struct {
+	sync.Mutex
+	// namespaceMap keeps the namespace id of each device
+	namespaceMap map[uint64]uint64
+	// namespaceNext is the next unused namespace id
+	namespaceNext uint64
+	// spillMap keeps the inode numbers that could not be passed through
+	spillMap map[QIno]uint64
+	// namedMap keeps the inode numbers assigned by TranslateNamed
+	namedMap map[namedQIno]uint64
+	// spillNext is the next unused spill inode number
+	spillNext uint64
+}
+
+// New returns a new InoMap.
+func New() *InoMap {
+	return &InoMap{
+		namespaceMap: make(map[uint64]uint64),
+		spillMap:     make(map[QIno]uint64),
+		namedMap:     make(map[namedQIno]uint64),
+	}
+}
+
+// Translate maps "in" to a unique inode number. The same tuple always gets
+// the same number, so hard links keep sharing their inode number.
+func (m *InoMap) Translate(in QIno) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	// Tags that do not fit in the tag bits are spilled as well
+	if in.Ino > maxPassthruIno || in.Tag > TagNameFile {
+		return m.spill(in)
+	}
+	ns, found := m.namespaceMap[in.Dev]
+	if !found {
+		if m.namespaceNext > maxNamespaceID {
+			return m.spill(in)
+		}
+		ns = m.namespaceNext
+		m.namespaceMap[in.Dev] = ns
+		m.namespaceNext++
+	}
+	return uint64(in.Tag)<<tagShift | ns<<namespaceShift | in.Ino
+}
+
+// TranslateNamed maps the virtual file "name" in directory "dir" to a unique
+// inode number. This is used for virtual files that cannot be identified
+// through the inode number of a single backing file.
+func (m *InoMap) TranslateNamed(dir QIno, name string) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	key := namedQIno{dir: dir, name: name}
+	if out, found := m.namedMap[key]; found {
+		return out
+	}
+	out := m.nextSpill()
+	m.namedMap[key] = out
+	return out
+}
+
+// TranslateStat overwrites st.Ino with the translated inode number of the
+// file, tagged with "tag".
+func (m *InoMap) TranslateStat(st *syscall.Stat_t, tag uint8) {
+	st.Ino = m.Translate(QInoFromStat(st, tag))
+}
+
+// spill maps "in" in the spill map.
+// Caller must hold the lock.
+func (m *InoMap) spill(in QIno) uint64 {
+	if out, found := m.spillMap[in]; found {
+		return out
+	}
+	out := m.nextSpill()
+	m.spillMap[in] = out
+	return out
+}
+
+// nextSpill returns the next unused spill inode number.
+// Caller must hold the lock.
+func (m *InoMap) nextSpill() uint64 {
+	out := m.spillNext | spillBit
+	m.spillNext++
+	return out
+}
@@ -0,0 +1,83 @@
+package inomap
+
+import (
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	m := New()
+	q := QIno{Dev: 10, Ino: 123}
+	out := m.Translate(q)
+	// The first device gets namespace 0, so the inode number is passed through
+	if out != 123 {
+		t.Errorf("expected passthru, got %d", out)
+	}
+	// Hard links must keep sharing their inode number
+	if out2 := m.Translate(q); out2 != out {
+		t.Errorf("unstable mapping: %d vs %d", out, out2)
+	}
+	// Same inode number on a different device
+	q2 := QIno{Dev: 11, Ino: 123}
+	if out2 := m.Translate(q2); out2 == out {
+		t.Errorf("collision between devices: %d", out)
+	}
+	// Same inode number with a different tag
+	q3 := QIno{Dev: 10, Tag: TagDirIV, Ino: 123}
+	if out3 := m.Translate(q3); out3 == out {
+		t.Errorf("collision between tags: %d", out)
+	}
+}
+
+func TestTranslateSpill(t *testing.T) {
+	m := New()
+	var q QIno
+	q.Ino = maxPassthruIno + 1
+	out := m.Translate(q)
+	if out&spillBit == 0 {
+		t.Errorf("spill bit not set: %x", out)
+	}
+	if out2 := m.Translate(q); out2 != out {
+		t.Errorf("unstable spill mapping: %x vs %x", out, out2)
+	}
+	// Large backing inode numbers must not collide with each other, or with
+	// a small inode number that happens to match the lower bits
+	q.Ino++
+	if out2 := m.Translate(q); out2 == out {
+		t.Errorf("spill collision: %x", out)
+	}
+	q.Ino = 1
+	if out2 := m.Translate(q); out2 == out || out2&spillBit != 0 {
+		t.Errorf("passthru went wrong: %x", out2)
+	}
+}
+
+func TestNamespaceExhaustion(t *testing.T) {
+	m := New()
+	seen := make(map[uint64]bool)
+	for dev := uint64(0); dev <= maxNamespaceID+10; dev++ {
+		out := m.Translate(QIno{Dev: dev, Ino: 1})
+		if seen[out] {
+			t.Fatalf("collision for dev %d: %x", dev, out)
+		}
+		seen[out] = true
+		if dev > maxNamespaceID && out&spillBit == 0 {
+			t.Errorf("dev %d: expected spill, got %x", dev, out)
+		}
+	}
+}
+
+func TestTranslateNamed(t *testing.T) {
+	m := New()
+	dir := QIno{Dev: 1, Tag: TagNameFile, Ino: 5}
+	a := m.TranslateNamed(dir, "a")
+	b := m.TranslateNamed(dir, "b")
+	if a == b {
+		t.Errorf("collision between names: %x", a)
+	}
+	if a2 := m.TranslateNamed(dir, "a"); a2 != a {
+		t.Errorf("unstable mapping: %x vs %x", a, a2)
+	}
+	if c := m.Translate(QIno{Dev: 1, Ino: maxPassthruIno + 1}); c == a || c == b {
+		t.Errorf("collision with the spill map: %x", c)
+	}
+}
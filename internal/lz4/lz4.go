@@ -0,0 +1,185 @@
+// Package lz4 implements the LZ4 block format, which "-compress" uses for
+// file content blocks.
+//
+// Only single blocks are supported, there is no frame format, checksum or
+// dictionary. The output can be decoded by any LZ4 block decoder.
+// See https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md .
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// minMatch is the shortest match that the format can express
+	minMatch = 4
+	// The last match must start at least mfLimit bytes before the end of
+	// the input, and the last lastLiterals bytes are always literals.
+	mfLimit      = 12
+	lastLiterals = 5
+	// maxOffset is the largest match offset (two bytes)
+	maxOffset = 65535
+	// hashLog is the log2 of the number of entries in the match finder
+	// hash table
+	hashLog = 12
+)
+
+// ErrCorrupt is returned by Decompress for input that is not a valid LZ4
+// block.
+var ErrCorrupt = errors.New("lz4: corrupt input")
+
+// ErrTooLong is returned by Decompress if the output does not fit into the
+// destination buffer.
+var ErrTooLong = errors.New("lz4: output too long")
+
+func hash(u uint32) uint32 {
+	return (u * 2654435761) >> (32 - hashLog)
+}
+
+// Compress appends the LZ4 block encoding of "src" to "dst" and returns the
+// result. Incompressible data gets slightly larger, the caller decides if
+// the result is worth storing.
+func Compress(dst []byte, src []byte) []byte {
+	// Positions plus one, zero means empty
+	var table [1 << hashLog]int32
+	anchor := 0
+	limit := len(src) - mfLimit
+	for i := 0; i < limit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		matchEnd := i + minMatch
+		for matchEnd < len(src)-lastLiterals && src[matchEnd] == src[ref+matchEnd-i] {
+			matchEnd++
+		}
+		dst = appendSequence(dst, src[anchor:i], i-ref, matchEnd-i)
+		i = matchEnd
+		anchor = i
+	}
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+// appendSequence appends "literals" followed by a match of "matchLen" bytes
+// at distance "offset". The last sequence has no match and passes offset 0.
+func appendSequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	ml := matchLen - minMatch
+	if offset > 0 {
+		if ml >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = appendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if offset == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if ml >= 15 {
+		dst = appendLength(dst, ml-15)
+	}
+	return dst
+}
+
+// appendLength appends the extra length bytes for "n".
+func appendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// Decompress decodes the LZ4 block "src" into "dst" and returns the number
+// of bytes written. It never writes more than len(dst) bytes, longer output
+// is reported as ErrTooLong.
+func Decompress(dst []byte, src []byte) (int, error) {
+	si, di := 0, 0
+	for {
+		if si >= len(src) {
+			return 0, ErrCorrupt
+		}
+		token := src[si]
+		si++
+		lit := int(token >> 4)
+		if lit == 15 {
+			var err error
+			lit, si, err = readLength(src, si, lit)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if lit > len(src)-si {
+			return 0, ErrCorrupt
+		}
+		if lit > len(dst)-di {
+			return 0, ErrTooLong
+		}
+		di += copy(dst[di:], src[si:si+lit])
+		si += lit
+		if si == len(src) {
+			// The last sequence has no match
+			return di, nil
+		}
+		if len(src)-si < 2 {
+			return 0, ErrCorrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, ErrCorrupt
+		}
+		ml := int(token & 15)
+		if ml == 15 {
+			var err error
+			ml, si, err = readLength(src, si, ml)
+			if err != nil {
+				return 0, err
+			}
+		}
+		ml += minMatch
+		if ml > len(dst)-di {
+			return 0, ErrTooLong
+		}
+		if offset >= ml {
+			di += copy(dst[di:di+ml], dst[di-offset:])
+			continue
+		}
+		// The match overlaps the output, which repeats the last "offset"
+		// bytes. Copy byte by byte.
+		for end := di + ml; di < end; di++ {
+			dst[di] = dst[di-offset]
+		}
+	}
+}
+
+// readLength adds the extra length bytes at src[si:] to "n" and returns
+// the new length and position.
+func readLength(src []byte, si int, n int) (int, int, error) {
+	for {
+		if si >= len(src) {
+			return 0, 0, ErrCorrupt
+		}
+		b := src[si]
+		si++
+		n += int(b)
+		if b != 255 {
+			return n, si, nil
+		}
+	}
+}
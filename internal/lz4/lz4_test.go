@@ -0,0 +1,73 @@
+package lz4
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func roundtrip(t *testing.T, in []byte) []byte {
+	c := Compress(nil, in)
+	out := make([]byte, len(in))
+	n, err := Decompress(out, c)
+	if err != nil {
+		t.Fatalf("len=%d: %v", len(in), err)
+	}
+	if !bytes.Equal(out[:n], in) {
+		t.Fatalf("len=%d: roundtrip mismatch", len(in))
+	}
+	return c
+}
+
+func TestRoundtrip(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 65536; i++ {
+		fmt.Fprintf(&text, "{\"line\": %d, \"level\": \"info\"}\n", i)
+	}
+	// Lengths around mfLimit and the 15/255 length encoding boundaries
+	for _, l := range []int{0, 1, 5, 12, 13, 14, 30, 270, 300, 4096, 65536} {
+		roundtrip(t, text.Bytes()[:l])
+		roundtrip(t, make([]byte, l))
+		roundtrip(t, cryptocore.RandBytes(l))
+	}
+	if c := roundtrip(t, text.Bytes()); len(c) > text.Len()/3 {
+		t.Errorf("text compressed poorly: %d -> %d bytes", text.Len(), len(c))
+	}
+}
+
+// Hand-encoded according to the block format description
+func TestReference(t *testing.T) {
+	in := "abcabcabcabcabcabcabcabcabc"
+	// Three literals, a match of 19 bytes at offset 3 and the last five
+	// bytes as literals
+	ref := []byte{0x3f, 'a', 'b', 'c', 3, 0, 0, 0x50, 'b', 'c', 'a', 'b', 'c'}
+	if c := Compress(nil, []byte(in)); !bytes.Equal(c, ref) {
+		t.Errorf("Compress: have %x, want %x", c, ref)
+	}
+	out := make([]byte, len(in))
+	n, err := Decompress(out, ref)
+	if err != nil || string(out[:n]) != in {
+		t.Errorf("Decompress: have %q, err=%v", out[:n], err)
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	c := Compress(nil, bytes.Repeat([]byte("0123456789"), 100))
+	// Output buffer too small
+	if _, err := Decompress(make([]byte, 999), c); err != ErrTooLong {
+		t.Errorf("want ErrTooLong, have %v", err)
+	}
+	// Truncated input must not panic. It may decode to a shorter block
+	// when cut right after the literals of a sequence.
+	for i := 0; i < len(c); i++ {
+		if n, err := Decompress(make([]byte, 1000), c[:i]); err == nil && n == 1000 {
+			t.Errorf("truncated to %d bytes: decoded completely", i)
+		}
+	}
+	// Offset pointing before the start of the output
+	if _, err := Decompress(make([]byte, 100), []byte{0x10, 'a', 2, 0, 0x00}); err != ErrCorrupt {
+		t.Errorf("want ErrCorrupt, have %v", err)
+	}
+}
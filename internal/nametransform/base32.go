@@ -0,0 +1,43 @@
+package nametransform
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// nameEncoding converts the binary EME output to a file name and back.
+// Implemented by *base64.Encoding and base32Lower.
+type nameEncoding interface {
+	EncodeToString(src []byte) string
+	DecodeString(s string) ([]byte, error)
+}
+
+// base32LowerEncoding is base32 (RFC 4648) with a lower-case alphabet
+var base32LowerEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567")
+
+// base32Lower encodes names as unpadded, lower-case base32. The names only
+// contain [a-z2-7], so they survive case-insensitive filesystems like exFAT,
+// default APFS or SMB shares from Windows unchanged.
+//
+// The shortest name (16 bytes of EME output) takes 26 characters and there
+// are no dots, so a name can never be one of the reserved Windows device
+// names (CON, PRN, AUX, NUL, COM1-9, LPT1-9, with or without an extension).
+type base32Lower struct{}
+
+// EncodeToString returns the unpadded base32 encoding of "src".
+func (base32Lower) EncodeToString(src []byte) string {
+	// Go 1.5 has no base32.NoPadding, strip the padding ourselves
+	return strings.TrimRight(base32LowerEncoding.EncodeToString(src), "=")
+}
+
+// DecodeString decodes the unpadded base32 string "s".
+func (base32Lower) DecodeString(s string) ([]byte, error) {
+	if strings.Contains(s, "=") {
+		return nil, errors.New("base32 name must not be padded")
+	}
+	if pad := len(s) % 8; pad != 0 {
+		s += strings.Repeat("=", 8-pad)
+	}
+	return base32LowerEncoding.DecodeString(s)
+}
@@ -0,0 +1,76 @@
+package nametransform
+
+import (
+	"crypto/aes"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/eme"
+)
+
+func newTestNameTransformBase32(t *testing.T) *NameTransform {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(eme.New(bc), true, 0, true, false, true)
+}
+
+func TestBase32Roundtrip(t *testing.T) {
+	var enc base32Lower
+	for i := 0; i < 40; i++ {
+		in := make([]byte, i)
+		for j := range in {
+			in[j] = byte(i * j)
+		}
+		s := enc.EncodeToString(in)
+		if strings.Trim(s, "abcdefghijklmnopqrstuvwxyz234567") != "" {
+			t.Errorf("len=%d: invalid characters in %q", i, s)
+		}
+		out, err := enc.DecodeString(s)
+		if err != nil {
+			t.Fatalf("len=%d: %v", i, err)
+		}
+		if string(out) != string(in) {
+			t.Errorf("len=%d: roundtrip failed", i)
+		}
+	}
+	if _, err := enc.DecodeString("MZXW6==="); err == nil {
+		t.Error("padded or upper-case input should be rejected")
+	}
+	if _, err := enc.DecodeString("MZXW6"); err == nil {
+		t.Error("upper-case input should be rejected")
+	}
+}
+
+// TestBase32Names checks that encrypted and hashed names only use lower-case
+// characters, and that ShortNameMax is right for both encodings.
+func TestBase32Names(t *testing.T) {
+	iv := make([]byte, 16)
+	for _, n := range []*NameTransform{newTestNameTransform(t), newTestNameTransformBase32(t)} {
+		limit := n.ShortNameMax()
+		if len(n.EncryptName(strings.Repeat("x", limit), iv)) > syscall.NAME_MAX {
+			t.Errorf("name of ShortNameMax=%d bytes is too long when encrypted", limit)
+		}
+		if len(n.EncryptName(strings.Repeat("x", limit+1), iv)) <= syscall.NAME_MAX {
+			t.Errorf("ShortNameMax=%d is too small", limit)
+		}
+	}
+	n := newTestNameTransformBase32(t)
+	if n.ShortNameMax() != 143 {
+		t.Errorf("wrong ShortNameMax %d", n.ShortNameMax())
+	}
+	cName := n.EncryptName("foo", iv)
+	if strings.ToLower(cName) != cName {
+		t.Errorf("name is not lower-case: %q", cName)
+	}
+	pName, err := n.DecryptName(cName, iv)
+	if err != nil || pName != "foo" {
+		t.Errorf("decrypt failed: %q, %v", pName, err)
+	}
+	hName := n.HashLongName(cName)
+	if strings.ToLower(hName) != hName || NameType(hName) != LongNameContent {
+		t.Errorf("bad long name %q", hName)
+	}
+}
@@ -99,10 +99,10 @@ func WriteDirIV(dir string) error {
 }
 
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
-// too long.
+// longer than LongNameMax.
 func (be *NameTransform) encryptAndHashName(name string, iv []byte) string {
 	cName := be.EncryptName(name, iv)
-	if be.longNames && len(cName) > syscall.NAME_MAX {
+	if be.longNames && len(cName) > be.longNameMax {
 		return be.HashLongName(cName)
 	}
 	return cName
@@ -110,7 +110,7 @@ func (be *NameTransform) encryptAndHashName(name string, iv []byte) string {
 
 // EncryptPathDirIV - encrypt relative plaintext path "plainPath" using EME with
 // DirIV. "rootDir" is the backing storage root directory.
-// Components that are longer than 255 bytes are hashed if be.longnames == true.
+// Components that are longer than LongNameMax bytes are hashed if be.longnames == true.
 func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (string, error) {
 	var err error
 	// Empty string means root directory
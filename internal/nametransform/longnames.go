@@ -23,11 +23,12 @@ const (
 )
 
 // HashLongName - take the hash of a long string "name" and return
-// "gocryptfs.longname.[sha256]"
+// "gocryptfs.longname.[sha256]". The hash uses the same encoding as the
+// names, which makes it 71 instead of 62 characters long with base32.
 func (n *NameTransform) HashLongName(name string) string {
 	hashBin := sha256.Sum256([]byte(name))
-	hashBase64 := n.B64.EncodeToString(hashBin[:])
-	return longNamePrefix + hashBase64
+	hashEncoded := n.nameEnc.EncodeToString(hashBin[:])
+	return longNamePrefix + hashEncoded
 }
 
 // Values returned by IsLongName
@@ -71,8 +72,9 @@ func ReadLongName(path string) (string, error) {
 		return "", err
 	}
 	defer fd.Close()
-	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
-	lim := 344
+	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA==",
+	// unpadded base32 takes 410 bytes
+	lim := 410
 	// Allocate a bigger buffer so we see whether the file is too big
 	buf := make([]byte, lim+1)
 	n, err := fd.ReadAt(buf, 0)
@@ -1,7 +1,11 @@
 package nametransform
 
 import (
+	"crypto/aes"
+	"strings"
 	"testing"
+
+	"github.com/rfjakob/eme"
 )
 
 func TestIsLongName(t *testing.T) {
@@ -20,3 +24,46 @@ func TestIsLongName(t *testing.T) {
 		t.Errorf("False positive")
 	}
 }
+
+func TestLongNameMax(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, 16)
+	n := New(eme.New(bc), true, 100, true, false, false)
+	if n.LongNameMax() != 100 {
+		t.Errorf("wrong LongNameMax %d", n.LongNameMax())
+	}
+	for _, l := range []int{1, n.ShortNameMax(), n.ShortNameMax() + 1, 200} {
+		name := strings.Repeat("x", l)
+		cName := n.encryptAndHashName(name, iv)
+		if len(cName) > 100 {
+			t.Errorf("len=%d: encrypted name %q is too long", l, cName)
+		}
+		if isLong := NameType(cName) == LongNameContent; isLong != (l > n.ShortNameMax()) {
+			t.Errorf("len=%d: long name=%v, ShortNameMax=%d", l, isLong, n.ShortNameMax())
+		}
+	}
+}
+
+func TestCheckLongNameMax(t *testing.T) {
+	testCases := []struct {
+		longNameMax int
+		base32      bool
+		ok          bool
+	}{
+		{66, false, false},
+		{67, false, true},
+		{75, true, false},
+		{76, true, true},
+		{255, false, true},
+		{256, false, false},
+	}
+	for _, tc := range testCases {
+		err := CheckLongNameMax(tc.longNameMax, tc.base32)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d, base32=%v: unexpected result %v", tc.longNameMax, tc.base32, err)
+		}
+	}
+}
@@ -4,10 +4,13 @@ package nametransform
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
 	"syscall"
 
 	"github.com/rfjakob/eme"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -18,28 +21,93 @@ type NameTransform struct {
 	emeCipher  *eme.EMECipher
 	longNames  bool
 	DirIVCache dirivcache.DirIVCache
+	// nfc is true if plaintext names are normalized to Unicode NFC before
+	// encryption. Corresponds to the NFC feature flag.
+	nfc bool
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depeding
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// nameEnc encodes the encrypted names. Either B64 or base32Lower,
+	// depending on the Base32 feature flag. Symlink targets always use B64.
+	nameEnc nameEncoding
+	// longNameMax is the longest encrypted name that is stored as it is.
+	// Longer names are hashed into a long name. NAME_MAX by default.
+	longNameMax int
+	// shortNameMax is the longest plaintext name that does not have to be
+	// hashed into a long name
+	shortNameMax int
 }
 
-// New returns a new NameTransform instance.
-func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
+// New returns a new NameTransform instance. Encrypted names longer than
+// "longNameMax" are hashed into long names. Zero means NAME_MAX.
+func New(e *eme.EMECipher, longNames bool, longNameMax int, raw64 bool, nfc bool, useBase32 bool) *NameTransform {
 	b64 := base64.URLEncoding
 	if raw64 {
 		b64 = base64.RawURLEncoding
 	}
+	var nameEnc nameEncoding = b64
+	if useBase32 {
+		nameEnc = base32Lower{}
+	}
+	if longNameMax == 0 {
+		longNameMax = syscall.NAME_MAX
+	}
 	return &NameTransform{
-		emeCipher: e,
-		longNames: longNames,
-		B64:       b64,
+		emeCipher:    e,
+		longNames:    longNames,
+		B64:          b64,
+		nameEnc:      nameEnc,
+		longNameMax:  longNameMax,
+		shortNameMax: computeShortNameMax(nameEnc, longNameMax),
+		nfc:          nfc,
+	}
+}
+
+// computeShortNameMax returns the longest plaintext name that still fits into
+// "longNameMax" when encrypted and encoded with "enc". The plaintext is always
+// padded, so a name of 16*k bytes takes 16*(k+1) bytes after encryption.
+// Returns -1 if even the shortest name does not fit.
+func computeShortNameMax(enc nameEncoding, longNameMax int) int {
+	padded := 0
+	for len(enc.EncodeToString(make([]byte, padded+16))) <= longNameMax {
+		padded += 16
 	}
+	return padded - 1
+}
+
+// CheckLongNameMax returns an error if "longNameMax" is too short to hold the
+// names of the long name files, "gocryptfs.longname.[sha256].name", or
+// longer than NAME_MAX.
+func CheckLongNameMax(longNameMax int, useBase32 bool) error {
+	var nameEnc nameEncoding = base64.RawURLEncoding
+	if useBase32 {
+		nameEnc = base32Lower{}
+	}
+	hashLen := len(nameEnc.EncodeToString(make([]byte, sha256.Size)))
+	lower := len(longNamePrefix) + hashLen + len(LongNameSuffix)
+	if longNameMax < lower || longNameMax > syscall.NAME_MAX {
+		return fmt.Errorf("long name threshold %d is out of range, must be %d to %d",
+			longNameMax, lower, syscall.NAME_MAX)
+	}
+	return nil
+}
+
+// LongNameMax returns the longest encrypted name that is not hashed into a
+// long name.
+func (n *NameTransform) LongNameMax() int {
+	return n.longNameMax
+}
+
+// ShortNameMax returns the longest plaintext name that is not hashed into a
+// long name. It is shorter for the base32 encoding and a lower LongNameMax.
+func (n *NameTransform) ShortNameMax() int {
+	return n.shortNameMax
 }
 
 // DecryptName decrypts a base64-encoded encrypted filename "cipherName" using the
 // initialization vector "iv".
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
-	bin, err := n.B64.DecodeString(cipherName)
+	bin, err := n.nameEnc.DecodeString(cipherName)
 	if err != nil {
 		return "", err
 	}
@@ -69,16 +137,23 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 	return plain, err
 }
 
-// EncryptName encrypts "plainName", returns a base64-encoded "cipherName64".
+// EncryptName encrypts "plainName", returns a base64- or base32-encoded
+// "cipherName64".
 // Used internally by EncryptPathDirIV().
 // The encryption is either CBC or EME, depending on "useEME".
 //
 // This function is exported because fusefrontend needs access to the full (not hashed)
 // name if longname is used. Otherwise you should use EncryptPathDirIV()
+//
+// With NFC normalization enabled, all Unicode normalization forms of a name
+// (like the NFD names created on macOS) encrypt to the same "cipherName64".
 func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 string) {
+	if n.nfc {
+		plainName = norm.NFC.String(plainName)
+	}
 	bin := []byte(plainName)
 	bin = pad16(bin)
 	bin = n.emeCipher.Encrypt(iv, bin)
-	cipherName64 = n.B64.EncodeToString(bin)
+	cipherName64 = n.nameEnc.EncodeToString(bin)
 	return cipherName64
 }
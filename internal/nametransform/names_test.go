@@ -49,3 +49,27 @@ func TestUnpad16Garbage(t *testing.T) {
 		}
 	}
 }
+
+// TestEncryptNameNFC - with NFC normalization, the NFC and NFD forms of a name
+// must encrypt to the same ciphertext, and decrypt to the NFC form.
+func TestEncryptNameNFC(t *testing.T) {
+	nfcName := "caf\u00e9"
+	nfdName := "café"
+	iv := make([]byte, 16)
+	n := newTestNameTransform(t)
+	if n.EncryptName(nfcName, iv) == n.EncryptName(nfdName, iv) {
+		t.Error("NFC and NFD names collide without normalization")
+	}
+	n.nfc = true
+	cName := n.EncryptName(nfcName, iv)
+	if n.EncryptName(nfdName, iv) != cName {
+		t.Error("NFC and NFD names encrypt differently with normalization")
+	}
+	plainName, err := n.DecryptName(cName, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainName != nfcName {
+		t.Errorf("want %q, got %q", nfcName, plainName)
+	}
+}
@@ -0,0 +1,50 @@
+package nametransform
+
+import (
+	"strings"
+	"syscall"
+)
+
+// XattrPrefix is prepended to the encrypted name of every extended attribute
+// that gocryptfs stores on a backing file. Using the "user." namespace means
+// that unprivileged users can set the attributes.
+const XattrPrefix = "user.gocryptfs."
+
+// XattrIDName is the name of the attribute that holds the random ID of a file.
+// The values of all other attributes are bound to the file by including the
+// ID in their associated data. The ID is stored unencrypted. Encrypted names
+// are at least 22 characters long, so they cannot clash with it.
+const XattrIDName = XattrPrefix + "id"
+
+// XattrIDLen is the length of the ID stored in XattrIDName, in bytes
+const XattrIDLen = 16
+
+// xattrNameIV is the IV used for the encryption of extended attribute names.
+// Attribute names are not bound to a directory, so we use a fixed IV. This
+// means that identical attribute names encrypt to the same ciphertext on
+// every file, which is the same leak that an unencrypted name would have.
+var xattrNameIV = []byte("xattr_name_iv_xx")
+
+// EncryptXattrName encrypts the extended attribute name "attr" and returns
+// the name that is stored on the backing file.
+func (n *NameTransform) EncryptXattrName(attr string) (cAttr string, err error) {
+	if attr == "" {
+		return "", syscall.EINVAL
+	}
+	return XattrPrefix + n.EncryptName(attr, xattrNameIV), nil
+}
+
+// DecryptXattrName decrypts an extended attribute name that has been
+// encrypted by EncryptXattrName.
+func (n *NameTransform) DecryptXattrName(cAttr string) (attr string, err error) {
+	if !strings.HasPrefix(cAttr, XattrPrefix) {
+		return "", syscall.EINVAL
+	}
+	return n.DecryptName(cAttr[len(XattrPrefix):], xattrNameIV)
+}
+
+// XattrValueAD returns the associated data for the encryption of the value of
+// the attribute "cAttr" (encrypted name) on the file with the ID "id".
+func XattrValueAD(cAttr string, id []byte) []byte {
+	return append([]byte(cAttr), id...)
+}
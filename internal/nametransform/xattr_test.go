@@ -0,0 +1,47 @@
+package nametransform
+
+import (
+	"crypto/aes"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/eme"
+)
+
+func newTestNameTransform(t *testing.T) *NameTransform {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(eme.New(bc), true, 0, true, false, false)
+}
+
+func TestXattrNameRoundtrip(t *testing.T) {
+	n := newTestNameTransform(t)
+	for _, attr := range []string{"user.foo", "user.mime_type", "trusted.x", strings.Repeat("x", 200)} {
+		cAttr, err := n.EncryptXattrName(attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(cAttr, XattrPrefix) || cAttr == XattrIDName {
+			t.Errorf("%q: wrong encrypted name %q", attr, cAttr)
+		}
+		attr2, err := n.DecryptXattrName(cAttr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr2 != attr {
+			t.Errorf("roundtrip mismatch: %q != %q", attr, attr2)
+		}
+	}
+}
+
+func TestXattrNameInvalid(t *testing.T) {
+	n := newTestNameTransform(t)
+	if _, err := n.EncryptXattrName(""); err == nil {
+		t.Error("empty name should be rejected")
+	}
+	if _, err := n.DecryptXattrName("user.foo"); err == nil {
+		t.Error("name without prefix should be rejected")
+	}
+}
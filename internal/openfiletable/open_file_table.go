@@ -42,13 +42,17 @@ func init() {
 }
 
 type table struct {
-	// writeOpCount counts entry.ContentLock.Lock() calls. As every operation that
-	// modifies a file should
-	// call it, this effectively serves as a write-operation counter.
+	// writeOpCount counts entry.ContentLock.Lock() and LockRange() calls. As
+	// every operation that modifies a file should
+	// call one of them, this effectively serves as a write-operation counter.
 	// The variable is accessed without holding any locks so atomic operations
 	// must be used. It must be the first element of the struct to guarantee
 	// 64-bit alignment.
 	writeOpCount uint64
+	// readOpCount counts CountReadOp() calls. Together with writeOpCount, it
+	// tells if the filesystem has been accessed. Accessed atomically, like
+	// writeOpCount.
+	readOpCount uint64
 	// Protects map access
 	sync.Mutex
 	// Table entries
@@ -57,11 +61,16 @@ type table struct {
 
 // Entry is an entry in the open file table
 type Entry struct {
+	// contentGen is incremented by ContentChanged(). It is accessed
+	// atomically and must be the first element of the struct to guarantee
+	// 64-bit alignment.
+	contentGen uint64
 	// Reference count
 	refCount int
 	// ContentLock guards the file content from concurrent writes. Every writer
-	// must take this lock before modifying the file content.
-	ContentLock countingMutex
+	// must take this lock before modifying the file content, either for the
+	// whole file (Lock) or for the blocks it writes to (LockRange).
+	ContentLock rangeLock
 	// HeaderLock guards the file ID (in this struct) and the file header (on
 	// disk). Take HeaderLock.RLock() to make sure the file ID does not change
 	// behind your back. If you modify the file ID, you must take
@@ -99,18 +108,47 @@ func Unregister(qi QIno) {
 	}
 }
 
-// countingMutex incrementes t.writeLockCount on each Lock() call.
-type countingMutex struct {
-	sync.Mutex
+// ContentGen returns the content generation of the file. It changes every
+// time ContentChanged() is called. Readers that cache file content compare
+// the values from before and after reading to detect concurrent changes.
+func (e *Entry) ContentGen() uint64 {
+	return atomic.LoadUint64(&e.contentGen)
+}
+
+// ContentChanged increments the content generation of the file. Writers
+// call it after the file content has been modified on disk.
+func (e *Entry) ContentChanged() {
+	atomic.AddUint64(&e.contentGen, 1)
+}
+
+// CountOpenFiles returns the number of files (identified by QIno) that are
+// currently registered in the table.
+func CountOpenFiles() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.entries)
+}
+
+// CountReadOp increments the read operation counter. Call it on every read of
+// file contents.
+func CountReadOp() {
+	atomic.AddUint64(&t.readOpCount, 1)
+}
+
+// ReadOpCount returns the read operation counter value.
+func ReadOpCount() uint64 {
+	return atomic.LoadUint64(&t.readOpCount)
 }
 
-func (c *countingMutex) Lock() {
-	c.Mutex.Lock()
+// CountWriteOp increments the write operation counter. Call it on every write
+// of file contents that does not go through ContentLock.
+func CountWriteOp() {
 	atomic.AddUint64(&t.writeOpCount, 1)
 }
 
 // WriteOpCount returns the write lock counter value. This value is encremented
-// each time writeLock.Lock() on a file table entry is called.
+// each time ContentLock.Lock() or ContentLock.LockRange() on a file table
+// entry is called, and by CountWriteOp().
 func WriteOpCount() uint64 {
 	return atomic.LoadUint64(&t.writeOpCount)
 }
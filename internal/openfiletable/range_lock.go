@@ -0,0 +1,120 @@
+package openfiletable
+
+import (
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// blockRange is a range of blocks, first and last block included
+type blockRange struct {
+	first uint64
+	last  uint64
+}
+
+func (r blockRange) overlaps(o blockRange) bool {
+	return r.first <= o.last && o.first <= r.last
+}
+
+// wholeFile is the range that Lock() takes
+var wholeFile = blockRange{0, math.MaxUint64}
+
+// rangeLock locks block ranges of a file against concurrent writes.
+// Writers to non-overlapping ranges can hold the lock at the same time.
+// Lock() locks the whole file.
+//
+// Each Lock() and LockRange() call increments t.writeOpCount.
+type rangeLock struct {
+	mu sync.Mutex
+	// cond is signalled when a range is released. Initialized on first use,
+	// so the zero value of rangeLock is usable.
+	cond *sync.Cond
+	// held are the ranges that are currently locked
+	held []blockRange
+	// wholeWaiting is the number of goroutines waiting in Lock(). New range
+	// locks are not granted while it is non-zero, so that Lock() does not
+	// starve.
+	wholeWaiting int
+}
+
+// Lock locks the whole file.
+func (l *rangeLock) Lock() {
+	l.lockWhole()
+	atomic.AddUint64(&t.writeOpCount, 1)
+}
+
+// Unlock releases the lock taken by Lock().
+func (l *rangeLock) Unlock() {
+	l.unlock(wholeFile)
+}
+
+// LockRange locks blocks "first" to "last", both included.
+func (l *rangeLock) LockRange(first uint64, last uint64) {
+	r := blockRange{first, last}
+	l.mu.Lock()
+	l.init()
+	for l.wholeWaiting > 0 || l.conflicts(r) {
+		l.cond.Wait()
+	}
+	l.held = append(l.held, r)
+	l.mu.Unlock()
+	atomic.AddUint64(&t.writeOpCount, 1)
+}
+
+// UnlockRange releases the lock taken by LockRange(first, last).
+func (l *rangeLock) UnlockRange(first uint64, last uint64) {
+	l.unlock(blockRange{first, last})
+}
+
+// UpgradeRange releases the lock taken by LockRange(first, last) and locks
+// the whole file instead. This is not atomic, other writers may get the lock
+// in between. As the upgrade belongs to the same write operation, the write
+// operation counter is not incremented again.
+func (l *rangeLock) UpgradeRange(first uint64, last uint64) {
+	l.unlock(blockRange{first, last})
+	l.lockWhole()
+}
+
+func (l *rangeLock) lockWhole() {
+	l.mu.Lock()
+	l.init()
+	l.wholeWaiting++
+	for len(l.held) > 0 {
+		l.cond.Wait()
+	}
+	l.wholeWaiting--
+	l.held = append(l.held, wholeFile)
+	l.mu.Unlock()
+}
+
+func (l *rangeLock) unlock(r blockRange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, h := range l.held {
+		if h == r {
+			l.held = append(l.held[:i], l.held[i+1:]...)
+			l.cond.Broadcast()
+			return
+		}
+	}
+	log.Panicf("BUG: unlock of unlocked block range %d-%d", r.first, r.last)
+}
+
+// conflicts returns true if "r" overlaps a range that is currently held.
+// Caller must hold l.mu.
+func (l *rangeLock) conflicts(r blockRange) bool {
+	for _, h := range l.held {
+		if h.overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// init initializes l.cond. Caller must hold l.mu.
+func (l *rangeLock) init() {
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+}
@@ -0,0 +1,67 @@
+package openfiletable
+
+import (
+	"testing"
+	"time"
+)
+
+// locked returns true if "lockFn" does not return within 100ms
+func locked(lockFn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		lockFn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return false
+	case <-time.After(100 * time.Millisecond):
+		return true
+	}
+}
+
+func TestRangeLock(t *testing.T) {
+	var l rangeLock
+	l.LockRange(0, 1)
+	// Disjoint ranges can be locked at the same time
+	if locked(func() { l.LockRange(2, 5) }) {
+		t.Fatal("disjoint range is blocked")
+	}
+	// Overlapping ones cannot
+	if !locked(func() { l.LockRange(5, 5); l.UnlockRange(5, 5) }) {
+		t.Fatal("overlapping range is not blocked")
+	}
+	if !locked(func() { l.Lock(); l.Unlock() }) {
+		t.Fatal("whole-file lock is not blocked")
+	}
+	l.UnlockRange(0, 1)
+	l.UnlockRange(2, 5)
+	// The waiters above can now run and finish
+	time.Sleep(100 * time.Millisecond)
+	l.Lock()
+	if !locked(func() { l.LockRange(100, 100); l.UnlockRange(100, 100) }) {
+		t.Fatal("range is not blocked by whole-file lock")
+	}
+	l.Unlock()
+}
+
+// Each write operation must increment the write operation counter exactly
+// once
+func TestRangeLockWriteOpCount(t *testing.T) {
+	var l rangeLock
+	c0 := WriteOpCount()
+	l.LockRange(0, 0)
+	if c := WriteOpCount(); c != c0+1 {
+		t.Errorf("LockRange: want count %d, got %d", c0+1, c)
+	}
+	l.UpgradeRange(0, 0)
+	if c := WriteOpCount(); c != c0+1 {
+		t.Errorf("UpgradeRange: want count %d, got %d", c0+1, c)
+	}
+	l.Unlock()
+	l.Lock()
+	if c := WriteOpCount(); c != c0+2 {
+		t.Errorf("Lock: want count %d, got %d", c0+2, c)
+	}
+	l.Unlock()
+}
@@ -20,6 +20,12 @@ const (
 	PurposeSymlinkIV Purpose = "SYMLINKIV"
 	// PurposeBlock0IV means the value will be used as the IV of ciphertext block #0.
 	PurposeBlock0IV Purpose = "BLOCK0IV"
+	// PurposeXattrIV means the value will be used as the IV for the
+	// encryption of an extended attribute value
+	PurposeXattrIV Purpose = "XATTRIV"
+	// PurposeXattrID means the value will be used as the ID that binds the
+	// extended attribute values to a file
+	PurposeXattrID Purpose = "XATTRID"
 )
 
 // Derive derives an IV from an encrypted path by hashing it with sha256
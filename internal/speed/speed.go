@@ -5,6 +5,7 @@
 package speed
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -12,6 +13,10 @@ import (
 	"log"
 	"testing"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
 	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -27,9 +32,12 @@ func Run() {
 		{name: "AES-GCM-256-OpenSSL", f: bStupidGCM, preferred: prefer_openssl.PreferOpenSSL()},
 		{name: "AES-GCM-256-Go", f: bGoGCM, preferred: !prefer_openssl.PreferOpenSSL()},
 		{name: "AES-SIV-512-Go", f: bAESSIV, preferred: false},
+		{name: "XChaCha20-Poly1305-Go", f: bXChaCha20Poly1305, preferred: false},
+		{name: "AES-GCM-Go+lz4-enc", f: bLZ4Encrypt, preferred: false},
+		{name: "AES-GCM-Go+lz4-dec", f: bLZ4Decrypt, preferred: false},
 	}
 	for _, b := range bTable {
-		fmt.Printf("%-20s\t", b.name)
+		fmt.Printf("%-21s\t", b.name)
 		mbs := mbPerSec(testing.Benchmark(b.f))
 		if mbs > 0 {
 			fmt.Printf("%7.2f MB/s", mbs)
@@ -119,3 +127,71 @@ func bAESSIV(b *testing.B) {
 		gGCM.Seal(iv, iv, in, authData)
 	}
 }
+
+func bXChaCha20Poly1305(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(chacha20poly1305.NonceSizeX)
+	in := make([]byte, blockSize)
+	b.SetBytes(int64(len(in)))
+	c, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Encrypt and append to nonce
+		c.Seal(iv, iv, in, authData)
+	}
+}
+
+// compressibleBlock returns a block of log-like text, the kind of data
+// "-compress" is meant for.
+func compressibleBlock() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < blockSize; i++ {
+		fmt.Fprintf(&buf, "2006-01-02T15:04:05 INFO request %d served in %d ms\n", i, i%97)
+	}
+	return buf.Bytes()[:blockSize]
+}
+
+// newLZ4ContentEnc returns a ContentEnc that compresses blocks with LZ4
+// and encrypts them with AES-GCM.
+func newLZ4ContentEnc() *contentenc.ContentEnc {
+	key := randBytes(cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	return contentenc.New(cc, blockSize, false, true)
+}
+
+// bLZ4Encrypt measures the throughput of compressing and encrypting
+// a compressible block ("-compress").
+func bLZ4Encrypt(b *testing.B) {
+	ce := newLZ4ContentEnc()
+	fileID := randBytes(16)
+	in := compressibleBlock()
+	b.SetBytes(int64(len(in)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ce.EncryptContentBlock(in, uint64(i), fileID, false)
+	}
+}
+
+// bLZ4Decrypt measures the throughput of decrypting and decompressing
+// a compressible block ("-compress").
+func bLZ4Decrypt(b *testing.B) {
+	ce := newLZ4ContentEnc()
+	fileID := randBytes(16)
+	in := compressibleBlock()
+	b.SetBytes(int64(len(in)))
+	c := ce.EncryptContentBlock(in, 0, fileID, false)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ce.DecryptContentBlock(c, 0, fileID, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
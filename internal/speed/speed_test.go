@@ -27,3 +27,15 @@ func BenchmarkGoGCM(b *testing.B) {
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
+
+func BenchmarkXChaCha20Poly1305(b *testing.B) {
+	bXChaCha20Poly1305(b)
+}
+
+func BenchmarkLZ4Encrypt(b *testing.B) {
+	bLZ4Encrypt(b)
+}
+
+func BenchmarkLZ4Decrypt(b *testing.B) {
+	bLZ4Decrypt(b)
+}
@@ -8,6 +8,9 @@ import (
 	"syscall"
 )
 
+// XattrCreate makes Setxattr fail with EEXIST if the attribute already exists
+const XattrCreate = 0x2
+
 // Sorry, fallocate is not available on OSX at all and
 // fcntl F_PREALLOCATE is not accessible from Go.
 // See https://github.com/rfjakob/gocryptfs/issues/18 if you want to help.
@@ -131,3 +134,30 @@ func Dup3(oldfd int, newfd int, flags int) (err error) {
 	}
 	return syscall.Dup2(oldfd, newfd)
 }
+
+// Listxattr is not implemented on Darwin and always returns ENOTSUP. The
+// syscall package does not wrap the xattr calls on this platform.
+func Listxattr(path string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// Getxattr is not implemented on Darwin and always returns ENOTSUP.
+func Getxattr(path string, attr string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// Setxattr is not implemented on Darwin and always returns ENOTSUP.
+func Setxattr(path string, attr string, data []byte, flags int) error {
+	return syscall.ENOTSUP
+}
+
+// Removexattr is not implemented on Darwin and always returns ENOTSUP.
+func Removexattr(path string, attr string) error {
+	return syscall.ENOTSUP
+}
+
+// StatTimes returns the atime and the mtime from "st" in the format that
+// syscall.UtimesNano expects.
+func StatTimes(st *syscall.Stat_t) [2]syscall.Timespec {
+	return [2]syscall.Timespec{st.Atimespec, st.Mtimespec}
+}
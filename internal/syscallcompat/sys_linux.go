@@ -2,6 +2,7 @@
 package syscallcompat
 
 import (
+	"bytes"
 	"sync"
 	"syscall"
 
@@ -10,6 +11,9 @@ import (
 
 const _FALLOC_FL_KEEP_SIZE = 0x01
 
+// XattrCreate makes Setxattr fail with EEXIST if the attribute already exists
+const XattrCreate = 0x1
+
 var preallocWarn sync.Once
 
 // EnospcPrealloc preallocates ciphertext space without changing the file
@@ -68,3 +72,53 @@ func Mknodat(dirfd int, path string, mode uint32, dev int) (err error) {
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	return syscall.Dup3(oldfd, newfd, flags)
 }
+
+// Listxattr returns the names of the extended attributes of "path".
+func Listxattr(path string) ([]string, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, n := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(n) > 0 {
+			names = append(names, string(n))
+		}
+	}
+	return names, nil
+}
+
+// Getxattr returns the value of the extended attribute "attr" of "path".
+func Getxattr(path string, attr string) ([]byte, error) {
+	sz, err := syscall.Getxattr(path, attr, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	sz, err = syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:sz], nil
+}
+
+// Setxattr wraps the Setxattr syscall.
+func Setxattr(path string, attr string, data []byte, flags int) error {
+	return syscall.Setxattr(path, attr, data, flags)
+}
+
+// Removexattr wraps the Removexattr syscall.
+func Removexattr(path string, attr string) error {
+	return syscall.Removexattr(path, attr)
+}
+
+// StatTimes returns the atime and the mtime from "st" in the format that
+// syscall.UtimesNano expects.
+func StatTimes(st *syscall.Stat_t) [2]syscall.Timespec {
+	return [2]syscall.Timespec{st.Atim, st.Mtim}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// kdfString describes the password hash parameters of a key for -listkeys.
+func kdfString(s *configfile.ScryptKDF, a *configfile.Argon2idKDF) string {
+	if a != nil {
+		return fmt.Sprintf("argon2id m=%dKiB t=%d p=%d", a.Memory, a.Time, a.Parallelism)
+	}
+	return fmt.Sprintf("N=%d", s.N)
+}
+
+// writeConfOrExit writes the modified config file to disk and exits on
+// failure.
+func writeConfOrExit(confFile *configfile.ConfFile) {
+	err := confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+}
+
+// addKey adds a key slot with a new password to the config file.
+// This is called when you pass the "-addkey" option.
+func addKey(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Please enter the password for the new key slot.")
+	newPw := readpassword.Twice(args.extpass)
+	readpassword.CheckTrailingGarbage()
+	label, err := confFile.AddKeySlot(masterkey, newPw, args.kdf, args.scryptn, args.label)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	writeConfOrExit(confFile)
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q added."+tlog.ColorReset, label)
+	os.Exit(0)
+}
+
+// removeKey deletes the key slot "args.removekey" from the config file.
+// The user has to authenticate with any of the passwords (or the master key)
+// first.
+// This is called when you pass the "-removekey" option.
+func removeKey(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = confFile.RemoveKeySlot(args.removekey)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	writeConfOrExit(confFile)
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q removed."+tlog.ColorReset, args.removekey)
+	os.Exit(0)
+}
+
+// listKeys prints the labels of all key slots. It does not need a password.
+// This is called when you pass the "-listkeys" option.
+func listKeys(args *argContainer) {
+	_, confFile, err := configfile.LoadConfFile(args.config, "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if !confFile.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		fmt.Printf("%s (single key, %s)\n", configfile.DefaultKeySlotLabel,
+			kdfString(&confFile.ScryptObject, confFile.Argon2idObject))
+		os.Exit(0)
+	}
+	for _, slot := range confFile.KeySlots {
+		fmt.Printf("%s (%s)\n", slot.Label, kdfString(&slot.ScryptObject, slot.Argon2idObject))
+	}
+	os.Exit(0)
+}
@@ -67,7 +67,16 @@ func changePassword(args *argContainer) {
 	tlog.Info.Println("Please enter your new password.")
 	newPw := readpassword.Twice(args.extpass)
 	readpassword.CheckTrailingGarbage()
-	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+	// Keep the password hash algorithm and its parameters unless "-kdf" asks
+	// for a different one
+	kdf := confFile.KDF()
+	logN := confFile.ScryptLogN()
+	if args.kdf != "" && args.kdf != kdf {
+		tlog.Info.Printf("Switching password hash from %s to %s", kdf, args.kdf)
+		kdf = args.kdf
+		logN = args.scryptn
+	}
+	confFile.EncryptKey(masterkey, newPw, kdf, logN)
 	if args.masterkey != "" {
 		bak := args.config + ".bak"
 		err = os.Link(args.config, bak)
@@ -228,8 +237,15 @@ func main() {
 		tlog.Debug.Printf("OpenSSL enabled")
 	}
 	// Operation flags
-	if args.info && args.init || args.info && args.passwd || args.passwd && args.init {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd is allowed")
+	nOps := 0
+	for _, op := range []bool{args.info, args.init, args.passwd, args.fsck,
+		args.addkey, args.removekey != "", args.listkeys, args.reencrypt} {
+		if op {
+			nOps++
+		}
+	}
+	if nOps > 1 {
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -addkey, -removekey, -listkeys, -reencrypt is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
@@ -256,6 +272,43 @@ func main() {
 		}
 		changePassword(&args) // does not return
 	}
+	// "-addkey", "-removekey", "-listkeys"
+	if args.addkey || args.removekey != "" || args.listkeys {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -addkey|-removekey LABEL|-listkeys [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.addkey {
+			addKey(&args) // does not return
+		} else if args.removekey != "" {
+			removeKey(&args) // does not return
+		}
+		listKeys(&args) // does not return
+	}
+	// "-fsck"
+	if args.fsck {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -fsck [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-fsck is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		fsck(&args) // does not return
+	}
+	// "-reencrypt"
+	if args.reencrypt {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -reencrypt [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-reencrypt is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		reencrypt(&args) // does not return
+	}
 	// Default operation: mount.
 	if flagSet.NArg() != 2 {
 		prettyArgs := prettyArgs()
@@ -140,6 +140,10 @@ func doMount(args *argContainer) int {
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
 	handleSigint(srv, args.mountpoint)
+	// Unmount after "-idle" without activity
+	if args.idle > 0 {
+		go idleMonitor(args.idle, srv, args.mountpoint)
+	}
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
@@ -180,37 +184,96 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 	if args.aessiv {
 		cryptoBackend = cryptocore.BackendAESSIV
 	}
+	if args.xchacha {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+	}
 	// forceOwner implies allow_other, as documented.
 	// Set this early, so args.allow_other can be relied on below this point.
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		CryptoBackend:  cryptoBackend,
-		ConfigCustom:   args._configCustom,
-		Raw64:          args.raw64,
-		NoPrealloc:     args.noprealloc,
-		HKDF:           args.hkdf,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
+		Cipherdir:       args.cipherdir,
+		PlaintextNames:  args.plaintextnames,
+		LongNames:       args.longnames,
+		LongNameMax:     args.longnamemax,
+		CryptoBackend:   cryptoBackend,
+		ConfigCustom:    args._configCustom,
+		Raw64:           args.raw64,
+		NFC:             args.nfc,
+		Base32:          args.base32,
+		NoPrealloc:      args.noprealloc,
+		HKDF:            args.hkdf,
+		Xattr:           args.xattr,
+		SerializeReads:  args.serialize_reads,
+		ForceDecode:     args.forcedecode,
+		ForceOwner:      args._forceOwner,
+		Exclude:         args.exclude,
+		ExcludeFrom:     args.excludeFrom,
+		ReverseWrite:    args.reversewrite && !args.ro,
+		BlockSize:       args._blockSize,
+		Compress:        args.compress,
+		LastBlockMarker: args.lastblockmarker,
+		DirManifest:     args.dirmanifest,
+		DecryptWorkers:  args.decryptworkers,
+		CacheSize:       uint64(args.cachesize) * 1024 * 1024,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		frontendArgs.Raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
+		frontendArgs.NFC = confFile.IsFeatureFlagSet(configfile.FlagNFC)
+		frontendArgs.Base32 = confFile.IsFeatureFlagSet(configfile.FlagBase32)
+		frontendArgs.LongNameMax = confFile.NameMax()
+		if frontendArgs.NFC && args.reverse {
+			tlog.Fatal.Printf("NFC normalization is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
 		frontendArgs.HKDF = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		frontendArgs.Xattr = confFile.IsFeatureFlagSet(configfile.FlagXattr)
+		frontendArgs.BlockSize = confFile.PlainBS()
+		frontendArgs.Compress = confFile.IsFeatureFlagSet(configfile.FlagCompression)
+		if frontendArgs.Compress && (args.reverse || args.forcedecode) {
+			tlog.Fatal.Printf("Compressed filesystems do not support reverse mode or -forcedecode")
+			os.Exit(exitcodes.Usage)
+		}
+		frontendArgs.LastBlockMarker = confFile.IsFeatureFlagSet(configfile.FlagLastBlockMarker)
+		if frontendArgs.LastBlockMarker && args.reverse {
+			tlog.Fatal.Printf("The last-block marker is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		frontendArgs.DirManifest = confFile.IsFeatureFlagSet(configfile.FlagDirManifest)
+		if frontendArgs.DirManifest && args.reverse {
+			tlog.Fatal.Printf("Directory manifests are not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			frontendArgs.CryptoBackend = cryptocore.BackendAESSIV
+		} else if confFile.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+			if args.reverse {
+				tlog.Fatal.Printf("AES-SIV is required by reverse mode, but the config file selects XChaCha20-Poly1305")
+				os.Exit(exitcodes.Usage)
+			}
+			if args.forcedecode {
+				tlog.Fatal.Printf("-forcedecode is not supported for XChaCha20-Poly1305 filesystems")
+				os.Exit(exitcodes.Usage)
+			}
+			frontendArgs.CryptoBackend = cryptocore.BackendXChaCha20Poly1305
 		} else if args.reverse {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
+		} else if args.openssl {
+			frontendArgs.CryptoBackend = cryptocore.BackendOpenSSL
+		} else {
+			// "-aessiv" or "-xchacha" on a GCM filesystem
+			frontendArgs.CryptoBackend = cryptocore.BackendGoGCM
 		}
 	}
+	if frontendArgs.DirManifest && !frontendArgs.HKDF {
+		tlog.Fatal.Printf("Directory manifests require HKDF")
+		os.Exit(exitcodes.Usage)
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
@@ -288,8 +351,8 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 	}
 
 	// The kernel enforces read-only operation, we just have to pass "ro".
-	// Reverse mounts are always read-only.
-	if args.ro || args.reverse {
+	// Reverse mounts are read-only unless "-reversewrite" is passed.
+	if args.ro || (args.reverse && !args.reversewrite) {
 		mOpts.Options = append(mOpts.Options, "ro")
 	}
 	// Add additional mount options (if any) after the stock ones, so the user has
@@ -323,18 +386,24 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		err := srv.Unmount()
-		if err != nil {
-			tlog.Warn.Print(err)
-			if runtime.GOOS == "linux" {
-				// MacOSX does not support lazy unmount
-				tlog.Info.Printf("Trying lazy unmount")
-				cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Run()
-			}
-		}
+		unmount(srv, mountpoint)
 		os.Exit(exitcodes.SigInt)
 	}()
 }
+
+// unmount tries to unmount "mountpoint" cleanly and falls back to a lazy
+// unmount if that fails (for example, because the mountpoint is busy).
+func unmount(srv *fuse.Server, mountpoint string) {
+	err := srv.Unmount()
+	if err != nil {
+		tlog.Warn.Print(err)
+		if runtime.GOOS == "linux" {
+			// MacOSX does not support lazy unmount
+			tlog.Info.Printf("Trying lazy unmount")
+			cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Run()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package vault
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// maxChunk is the largest read or write that is passed to the frontend in
+// one go. The frontend's buffer pools are sized for the largest request the
+// kernel can send.
+const maxChunk = fuse.MAX_KERNEL_WRITE
+
+// File is an open file in a Vault. It implements io.ReaderAt, io.WriterAt
+// and io.Closer. Like os.File, it is safe for concurrent use.
+type File struct {
+	// name is the path that was passed to Open, for error messages
+	name     string
+	fuseFile nodefs.File
+	// closeOnce makes Close idempotent
+	closeOnce sync.Once
+	// closed is set by Close. Protected by closeLock.
+	closed    bool
+	closeLock sync.RWMutex
+}
+
+var _ io.ReaderAt = &File{}
+var _ io.WriterAt = &File{}
+var _ io.Closer = &File{}
+
+// Name returns the name of the file as passed to Open.
+func (f *File) Name() string {
+	return f.name
+}
+
+// ReadAt reads len(p) plaintext bytes starting at offset "off". It returns
+// io.EOF if fewer bytes were read because the end of the file was reached.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, pathError("read", f.name, fuse.EINVAL)
+	}
+	f.closeLock.RLock()
+	defer f.closeLock.RUnlock()
+	if f.closed {
+		return 0, ErrClosed
+	}
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		res, status := f.fuseFile.Read(chunk, off+int64(n))
+		if !status.Ok() {
+			return n, pathError("read", f.name, status)
+		}
+		data, status := res.Bytes(chunk)
+		if !status.Ok() {
+			return n, pathError("read", f.name, status)
+		}
+		// "data" may or may not share memory with "chunk"
+		copy(chunk, data)
+		n += len(data)
+		res.Done()
+		if len(data) < len(chunk) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes len(p) plaintext bytes starting at offset "off". Writing
+// past the end of the file creates a hole, which reads back as zeros.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, pathError("write", f.name, fuse.EINVAL)
+	}
+	f.closeLock.RLock()
+	defer f.closeLock.RUnlock()
+	if f.closed {
+		return 0, ErrClosed
+	}
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		written, status := f.fuseFile.Write(chunk, off+int64(n))
+		n += int(written)
+		if !status.Ok() {
+			return n, pathError("write", f.name, status)
+		}
+		if written == 0 {
+			// Do not loop forever if the frontend makes no progress
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Truncate changes the plaintext size of the file to "size".
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return pathError("truncate", f.name, fuse.EINVAL)
+	}
+	f.closeLock.RLock()
+	defer f.closeLock.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if status := f.fuseFile.Truncate(uint64(size)); !status.Ok() {
+		return pathError("truncate", f.name, status)
+	}
+	return nil
+}
+
+// Stat returns information about the open file.
+func (f *File) Stat() (os.FileInfo, error) {
+	f.closeLock.RLock()
+	defer f.closeLock.RUnlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	var a fuse.Attr
+	if status := f.fuseFile.GetAttr(&a); !status.Ok() {
+		return nil, pathError("stat", f.name, status)
+	}
+	return newFileInfo(baseName(f.name), &a), nil
+}
+
+// Sync commits the ciphertext to stable storage.
+func (f *File) Sync() error {
+	f.closeLock.RLock()
+	defer f.closeLock.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if status := f.fuseFile.Fsync(0); !status.Ok() {
+		return pathError("sync", f.name, status)
+	}
+	return nil
+}
+
+// Close closes the file. Calling Close more than once is allowed.
+func (f *File) Close() error {
+	f.closeOnce.Do(func() {
+		f.closeLock.Lock()
+		f.closed = true
+		f.closeLock.Unlock()
+		f.fuseFile.Release()
+	})
+	return nil
+}
+
+// Size returns the plaintext size of the file.
+func (f *File) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,346 @@
+// Package vault gives Go programs read and write access to a gocryptfs
+// CIPHERDIR without mounting it. It needs neither FUSE nor root privileges.
+//
+// A Vault uses the same code as a forward-mode gocryptfs mount, so files
+// and directories created through it are indistinguishable from files
+// created through a mount, and vice versa. Do not modify a CIPHERDIR through
+// a Vault while it is mounted.
+//
+// Paths are slash-separated and relative to the root of the CIPHERDIR.
+// A leading slash is ignored, and "" or "/" refer to the root directory.
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+)
+
+// ErrClosed is returned when a File is used after Close.
+var ErrClosed = errors.New("vault: file already closed")
+
+// Vault is an unlocked CIPHERDIR. It is safe for concurrent use.
+type Vault struct {
+	fs *fusefrontend.FS
+	// context is passed to the fusefrontend methods. It identifies the
+	// calling process like the kernel would for a mount.
+	context *fuse.Context
+}
+
+// Open unlocks the CIPHERDIR "cipherdir" with "password". The config file
+// is expected at its default location, "cipherdir/gocryptfs.conf".
+func Open(cipherdir string, password string) (*Vault, error) {
+	masterkey, confFile, err := configfile.LoadConfFile(confPath(cipherdir), password)
+	if err != nil {
+		return nil, err
+	}
+	return newVault(cipherdir, masterkey, confFile)
+}
+
+// OpenMasterKey unlocks the CIPHERDIR "cipherdir" with the 32-byte master
+// key "masterkey". The config file is still needed for the feature flags,
+// but the password is not.
+func OpenMasterKey(cipherdir string, masterkey []byte) (*Vault, error) {
+	if len(masterkey) != cryptocore.KeyLen {
+		return nil, syscall.EINVAL
+	}
+	_, confFile, err := configfile.LoadConfFile(confPath(cipherdir), "")
+	if err != nil {
+		return nil, err
+	}
+	// The frontend purges the key it is given, the caller's copy stays
+	// intact.
+	key := make([]byte, len(masterkey))
+	copy(key, masterkey)
+	return newVault(cipherdir, key, confFile)
+}
+
+// confPath returns the default config file path for "cipherdir".
+func confPath(cipherdir string) string {
+	return filepath.Join(cipherdir, configfile.ConfDefaultName)
+}
+
+// newVault sets up the filesystem like a forward-mode mount of "cipherdir"
+// would, and purges "masterkey" from memory.
+func newVault(cipherdir string, masterkey []byte, confFile *configfile.ConfFile) (*Vault, error) {
+	cipherdir, err := filepath.Abs(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	args := fusefrontend.Args{
+		Cipherdir:       cipherdir,
+		CryptoBackend:   cryptocore.BackendGoGCM,
+		PlaintextNames:  confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:       confFile.IsFeatureFlagSet(configfile.FlagLongNames),
+		LongNameMax:     confFile.NameMax(),
+		Raw64:           confFile.IsFeatureFlagSet(configfile.FlagRaw64),
+		NFC:             confFile.IsFeatureFlagSet(configfile.FlagNFC),
+		Base32:          confFile.IsFeatureFlagSet(configfile.FlagBase32),
+		HKDF:            confFile.IsFeatureFlagSet(configfile.FlagHKDF),
+		Xattr:           confFile.IsFeatureFlagSet(configfile.FlagXattr),
+		BlockSize:       confFile.PlainBS(),
+		Compress:        confFile.IsFeatureFlagSet(configfile.FlagCompression),
+		LastBlockMarker: confFile.IsFeatureFlagSet(configfile.FlagLastBlockMarker),
+		DirManifest:     confFile.IsFeatureFlagSet(configfile.FlagDirManifest),
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		args.CryptoBackend = cryptocore.BackendAESSIV
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		args.CryptoBackend = cryptocore.BackendXChaCha20Poly1305
+	}
+	fs := fusefrontend.NewFS(masterkey, args)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	context := &fuse.Context{}
+	context.Uid = uint32(os.Getuid())
+	context.Gid = uint32(os.Getgid())
+	context.Pid = uint32(os.Getpid())
+	return &Vault{fs: fs, context: context}, nil
+}
+
+// cleanPath converts "name" to the relative path format the frontend
+// expects. Returns ok=false if "name" points outside of the CIPHERDIR.
+func cleanPath(name string) (relPath string, ok bool) {
+	relPath = ctlsock.SanitizePath(name)
+	if relPath == "" {
+		// SanitizePath returns "" both for the root directory and for paths
+		// that point above it.
+		clean := filepath.Clean("/" + name)
+		return "", clean == "/"
+	}
+	return relPath, true
+}
+
+// baseName returns the last element of the path "name", or "." for the root
+// directory.
+func baseName(name string) string {
+	relPath, _ := cleanPath(name)
+	if relPath == "" {
+		return "."
+	}
+	return filepath.Base(relPath)
+}
+
+// pathError wraps the FUSE status "status" into an *os.PathError, so that
+// os.IsNotExist() and friends work.
+func pathError(op string, name string, status fuse.Status) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.Errno(status)}
+}
+
+// Open opens the file "name" for reading.
+func (v *Vault) Open(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates the file "name" with mode 0666 (before umask), truncating
+// it if it already exists. The returned file can be read and written.
+func (v *Vault) Create(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile is the generalized open call, like os.OpenFile. "flag" is a
+// combination of os.O_RDONLY, os.O_WRONLY, os.O_RDWR, os.O_CREATE, os.O_EXCL
+// and os.O_TRUNC. os.O_APPEND is not supported.
+func (v *Vault) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	relPath, ok := cleanPath(name)
+	if !ok || relPath == "" {
+		return nil, pathError("open", name, fuse.EINVAL)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, pathError("open", name, fuse.EINVAL)
+	}
+	// Truncation goes through File.Truncate so that the file header is
+	// handled like on a mount.
+	openFlags := uint32(flag &^ (os.O_TRUNC | os.O_CREATE | os.O_EXCL))
+	fuseFile, status := v.fs.Open(relPath, openFlags, v.context)
+	if status == fuse.ENOENT && flag&os.O_CREATE != 0 {
+		createFlags := uint32(flag &^ os.O_TRUNC)
+		fuseFile, status = v.fs.Create(relPath, createFlags, uint32(perm.Perm()), v.context)
+	} else if status.Ok() && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		fuseFile.Release()
+		return nil, pathError("open", name, fuse.Status(syscall.EEXIST))
+	}
+	if !status.Ok() {
+		return nil, pathError("open", name, status)
+	}
+	f := &File{name: name, fuseFile: fuseFile}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Mkdir creates the directory "name" with mode "perm" (before umask).
+func (v *Vault) Mkdir(name string, perm os.FileMode) error {
+	relPath, ok := cleanPath(name)
+	if !ok || relPath == "" {
+		return pathError("mkdir", name, fuse.Status(syscall.EEXIST))
+	}
+	if status := v.fs.Mkdir(relPath, uint32(perm.Perm()), v.context); !status.Ok() {
+		return pathError("mkdir", name, status)
+	}
+	return nil
+}
+
+// Stat returns information about the file, directory or symlink "name".
+// Symlinks are not followed.
+func (v *Vault) Stat(name string) (os.FileInfo, error) {
+	relPath, ok := cleanPath(name)
+	if !ok {
+		return nil, pathError("stat", name, fuse.EINVAL)
+	}
+	a, status := v.fs.GetAttr(relPath, v.context)
+	if !status.Ok() {
+		return nil, pathError("stat", name, status)
+	}
+	return newFileInfo(baseName(relPath), a), nil
+}
+
+// ReadDir reads the directory "name" and returns its entries sorted by
+// name, like ioutil.ReadDir. Entries whose names cannot be decrypted are
+// skipped.
+func (v *Vault) ReadDir(name string) ([]os.FileInfo, error) {
+	relPath, ok := cleanPath(name)
+	if !ok {
+		return nil, pathError("readdir", name, fuse.EINVAL)
+	}
+	entries, status := v.fs.OpenDir(relPath, v.context)
+	if !status.Ok() {
+		return nil, pathError("readdir", name, status)
+	}
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		a, status := v.fs.GetAttr(filepath.Join(relPath, e.Name), v.context)
+		if status == fuse.ENOENT {
+			// Deleted concurrently
+			continue
+		}
+		if !status.Ok() {
+			return nil, pathError("readdir", filepath.Join(name, e.Name), status)
+		}
+		list = append(list, newFileInfo(e.Name, a))
+	}
+	sort.Sort(byName(list))
+	return list, nil
+}
+
+// Rename renames (moves) "oldName" to "newName". If "newName" already
+// exists and is not a directory, it is replaced.
+func (v *Vault) Rename(oldName string, newName string) error {
+	oldPath, ok1 := cleanPath(oldName)
+	newPath, ok2 := cleanPath(newName)
+	if !ok1 || !ok2 || oldPath == "" || newPath == "" {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EINVAL}
+	}
+	if status := v.fs.Rename(oldPath, newPath, v.context); !status.Ok() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.Errno(status)}
+	}
+	return nil
+}
+
+// Remove removes the file, symlink or empty directory "name".
+func (v *Vault) Remove(name string) error {
+	relPath, ok := cleanPath(name)
+	if !ok || relPath == "" {
+		return pathError("remove", name, fuse.EINVAL)
+	}
+	a, status := v.fs.GetAttr(relPath, v.context)
+	if !status.Ok() {
+		return pathError("remove", name, status)
+	}
+	if a.IsDir() {
+		status = v.fs.Rmdir(relPath, v.context)
+	} else {
+		status = v.fs.Unlink(relPath, v.context)
+	}
+	if !status.Ok() {
+		return pathError("remove", name, status)
+	}
+	return nil
+}
+
+// byName sorts a list of os.FileInfo by name.
+type byName []os.FileInfo
+
+func (l byName) Len() int           { return len(l) }
+func (l byName) Less(i, j int) bool { return l[i].Name() < l[j].Name() }
+func (l byName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// fileInfo implements os.FileInfo on top of a fuse.Attr.
+type fileInfo struct {
+	name string
+	attr *fuse.Attr
+}
+
+func newFileInfo(name string, a *fuse.Attr) *fileInfo {
+	return &fileInfo{name: name, attr: a}
+}
+
+// Name returns the plaintext base name.
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the plaintext size in bytes.
+func (fi *fileInfo) Size() int64 {
+	return int64(fi.attr.Size)
+}
+
+// Mode returns the file mode bits.
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.attr.Mode & 0777)
+	switch fi.attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	if fi.attr.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.attr.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.attr.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// ModTime returns the modification time.
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attr.Mtime), int64(fi.attr.Mtimensec))
+}
+
+// IsDir is short for Mode().IsDir().
+func (fi *fileInfo) IsDir() bool {
+	return fi.attr.IsDir()
+}
+
+// Sys returns nil. The ciphertext file attributes are not exposed.
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
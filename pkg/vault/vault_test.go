@@ -0,0 +1,191 @@
+package vault
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newTestVault creates a new CIPHERDIR with the password "test" and opens it.
+func newTestVault(t *testing.T) (*Vault, string) {
+	return newTestVaultBS(t, 0)
+}
+
+// newTestVaultBS is like newTestVault but uses the plaintext block size
+// "blockSize".
+func newTestVaultBS(t *testing.T, blockSize uint64) (*Vault, string) {
+	dir, err := ioutil.TempDir("", "vault_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:  filepath.Join(dir, configfile.ConfDefaultName),
+		Password:  "test",
+		LogN:      10,
+		Creator:   "vault_test",
+		BlockSize: blockSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(dir); err != nil {
+		t.Fatal(err)
+	}
+	v, err := Open(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, dir
+}
+
+func TestWrongPassword(t *testing.T) {
+	_, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, "wrong"); err == nil {
+		t.Error("opening with a wrong password should fail")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	v, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	if err := v.Mkdir("dir1", 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.Create("dir1/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Larger than one FUSE request, not block-aligned
+	content := make([]byte, 300000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if n, err := f.WriteAt(content, 0); err != nil || n != len(content) {
+		t.Fatalf("WriteAt: n=%d err=%v", n, err)
+	}
+	// Write past the end to create a hole
+	if _, err = f.WriteAt([]byte("end"), 400000); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = v.Open("/dir1/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if sz, err := f.Size(); err != nil || sz != 400003 {
+		t.Errorf("Size: sz=%d err=%v", sz, err)
+	}
+	buf := make([]byte, len(content))
+	if n, err := f.ReadAt(buf, 0); err != nil || n != len(content) {
+		t.Fatalf("ReadAt: n=%d err=%v", n, err)
+	}
+	if !bytes.Equal(buf, content) {
+		t.Error("content mismatch")
+	}
+	buf = make([]byte, 10)
+	n, err := f.ReadAt(buf, 399995)
+	if err != io.EOF || n != 8 || string(buf[:n]) != "\000\000\000\000\000end" {
+		t.Errorf("ReadAt at the end: n=%d err=%v buf=%q", n, err, buf[:n])
+	}
+	// The ciphertext must not contain the plaintext name
+	cEntries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range cEntries {
+		if e.Name() == "dir1" {
+			t.Error("file name is not encrypted")
+		}
+	}
+}
+
+// Reads and writes that are not aligned to large blocks touch one block more
+// than fits into a FUSE request
+func TestBlockSize(t *testing.T) {
+	v, dir := newTestVaultBS(t, 65536)
+	defer os.RemoveAll(dir)
+	f, err := v.Create("file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content := make([]byte, 300000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if _, err = f.WriteAt(content[4096:], 4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(content[:4096], 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(content)-4096)
+	if n, err := f.ReadAt(buf, 4096); err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: n=%d err=%v", n, err)
+	}
+	if !bytes.Equal(buf, content[4096:]) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestDirOps(t *testing.T) {
+	v, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	long := strings.Repeat("x", 255)
+	for _, name := range []string{"a", "b", long} {
+		f, err := v.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte(name), 0)
+		f.Close()
+	}
+	list, err := v.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Name() != "a" || list[1].Name() != "b" || list[2].Name() != long {
+		t.Fatalf("wrong ReadDir result: %v", list)
+	}
+	if list[2].Size() != 255 || !list[2].Mode().IsRegular() {
+		t.Errorf("wrong size or mode: %d %v", list[2].Size(), list[2].Mode())
+	}
+	if err = v.Rename(long, "c"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := v.Stat("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "c" || fi.Size() != 255 {
+		t.Errorf("wrong Stat result: %q %d", fi.Name(), fi.Size())
+	}
+	if _, err = v.Stat(long); !os.IsNotExist(err) {
+		t.Errorf("old name should be gone, got %v", err)
+	}
+	if err = v.Mkdir("d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err = v.Remove(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if list, err = v.ReadDir("/"); err != nil || len(list) != 0 {
+		t.Errorf("directory should be empty: %v %v", list, err)
+	}
+	if _, err = v.Open("../foo"); err == nil {
+		t.Error("paths outside of the CIPHERDIR must be rejected")
+	}
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/ciphertree"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// reencryptJournalSuffix is appended to the config file name to get the
+	// name of the journal file.
+	reencryptJournalSuffix = ".reencrypt"
+	// reencryptTmpName is the name of temporary files that replace symlinks
+	// and gocryptfs.diriv files. The dot "." is not used in base64url, so it
+	// cannot clash with an encrypted name.
+	reencryptTmpName = "gocryptfs.reencrypt.tmp"
+)
+
+// journalRecord is one line of the re-encryption journal.
+//
+// Paths in the journal are relative ciphertext paths as they were before
+// any name was re-encrypted. Directories are processed bottom-up, so these
+// paths stay valid until the record is no longer needed.
+type journalRecord struct {
+	// Op is one of:
+	// "key"      - Key = new master key, encrypted with a hash of the
+	//              password the config file is rewritten with
+	// "file"     - Data = new file ID of the file at Path, Mode and Times =
+	//              the original permissions and timestamps
+	// "contents" - all file contents, symlinks and xattrs are done
+	// "diriv"    - Data = new directory IV of the directory at Path,
+	//              Names = the new names of all entries in it
+	// "dir"      - all names in the directory at Path are done
+	// "complete" - everything is done, the config file is being rewritten
+	Op    string
+	Path  string              `json:",omitempty"`
+	Key   *configfile.KeySlot `json:",omitempty"`
+	Data  []byte              `json:",omitempty"`
+	Names []string            `json:",omitempty"`
+	Mode  uint32              `json:",omitempty"`
+	Times []syscall.Timespec  `json:",omitempty"`
+}
+
+// reencryptJournal records the progress of "-reencrypt" so that an
+// interrupted run can be resumed.
+type reencryptJournal struct {
+	fd *os.File
+	// key is the new master key, encrypted with a hash of the password
+	key *configfile.KeySlot
+	// files maps file paths to their "file" record
+	files map[string]*journalRecord
+	// dirIVs maps directory paths to their new directory IV
+	dirIVs map[string][]byte
+	// newNames maps directory paths to the set of new entry names
+	newNames map[string]map[string]bool
+	// dirsDone contains the directories whose names are re-encrypted
+	dirsDone map[string]bool
+	// contentsDone is set once the "contents" record has been written
+	contentsDone bool
+	// complete is set once the "complete" record has been written
+	complete bool
+}
+
+// openJournal opens (or creates) the journal file "path" and replays the
+// records that are already in it. A partially written last record is
+// discarded.
+func openJournal(path string) (*reencryptJournal, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := reencryptJournal{
+		fd:       fd,
+		files:    make(map[string]*journalRecord),
+		dirIVs:   make(map[string][]byte),
+		newNames: make(map[string]map[string]bool),
+		dirsDone: make(map[string]bool),
+	}
+	content, err := ioutil.ReadAll(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	// Every record is one line. A record without the terminating newline
+	// has not been written completely.
+	var goodOffset int64
+	for {
+		i := bytes.IndexByte(content[goodOffset:], '\n')
+		if i < 0 {
+			break
+		}
+		var rec journalRecord
+		line := content[goodOffset : goodOffset+int64(i)]
+		if err = json.Unmarshal(line, &rec); err != nil {
+			break
+		}
+		goodOffset += int64(i) + 1
+		j.replay(&rec)
+	}
+	if goodOffset != int64(len(content)) {
+		tlog.Warn.Printf("reencrypt: discarding incomplete journal record at offset %d", goodOffset)
+	}
+	// Cut off garbage and position the file offset for appending
+	if err = fd.Truncate(goodOffset); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if _, err = fd.Seek(goodOffset, os.SEEK_SET); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &j, nil
+}
+
+// replay applies the record "rec" to the in-memory state.
+func (j *reencryptJournal) replay(rec *journalRecord) {
+	switch rec.Op {
+	case "key":
+		j.key = rec.Key
+	case "file":
+		j.files[rec.Path] = rec
+	case "contents":
+		j.contentsDone = true
+	case "diriv":
+		j.dirIVs[rec.Path] = rec.Data
+		j.newNames[rec.Path] = make(map[string]bool)
+		for _, name := range rec.Names {
+			j.newNames[rec.Path][name] = true
+		}
+	case "dir":
+		j.dirsDone[rec.Path] = true
+	case "complete":
+		j.complete = true
+	}
+}
+
+// add appends "rec" to the journal and applies it. If "sync" is set, the
+// record is flushed to disk before add returns.
+func (j *reencryptJournal) add(rec journalRecord, sync bool) error {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = j.fd.Write(append(js, '\n'))
+	if err != nil {
+		return err
+	}
+	j.replay(&rec)
+	if sync {
+		return j.fd.Sync()
+	}
+	return nil
+}
+
+// reencrypter holds the old and the new crypto helpers of a running
+// re-encryption.
+type reencrypter struct {
+	// old and new are the CIPHERDIR with the old and the new master key
+	old     *ciphertree.Tree
+	new     *ciphertree.Tree
+	journal *reencryptJournal
+	// Progress counters
+	nFiles, nNames int
+}
+
+// makeWritable adds owner read and write permissions to "absPath" if it does
+// not have them yet. Call the returned function to restore the old mode and
+// the timestamps.
+func makeWritable(absPath string, st *syscall.Stat_t) (restore func(), err error) {
+	return makeWritableTimes(absPath, st.Mode, syscallcompat.StatTimes(st))
+}
+
+// makeWritableTimes is like makeWritable, but takes the original "stMode"
+// and "times" explicitly.
+func makeWritableTimes(absPath string, stMode uint32, times [2]syscall.Timespec) (restore func(), err error) {
+	mode := os.FileMode(stMode & 07777)
+	want := mode | 0600
+	if stMode&syscall.S_IFMT == syscall.S_IFDIR {
+		want |= 0100
+	}
+	if want != mode {
+		if err = os.Chmod(absPath, want); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		if want != mode {
+			os.Chmod(absPath, mode)
+		}
+		// The mtime of the ciphertext is the mtime of the plaintext
+		syscall.UtimesNano(absPath, times[:])
+	}, nil
+}
+
+// contents re-encrypts the file contents, symlink targets and extended
+// attributes in "cDir" and below. No names are changed.
+func (r *reencrypter) contents(cDir string) error {
+	return r.old.Walk(cDir, func(cPath string, st *syscall.Stat_t) error {
+		var err error
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFREG:
+			err = r.file(cPath, st)
+		case syscall.S_IFLNK:
+			err = r.symlink(cPath, st)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", cPath, err)
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			if err = r.xattrs(cPath, st); err != nil {
+				return fmt.Errorf("%s: xattr: %v", cPath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// file re-encrypts the header and all blocks of the regular file "cPath" in
+// place. Blocks that already decrypt with the new key are left alone, which
+// makes this safe to repeat after an interruption.
+func (r *reencrypter) file(cPath string, st *syscall.Stat_t) error {
+	absPath := r.old.Abs(cPath)
+	stMode, times := st.Mode, syscallcompat.StatTimes(st)
+	rec := r.journal.files[cPath]
+	if rec != nil && len(rec.Times) == 2 {
+		// We have been interrupted while working on this file. The
+		// timestamps on disk are no longer the original ones.
+		stMode = rec.Mode
+		times = [2]syscall.Timespec{rec.Times[0], rec.Times[1]}
+	}
+	restore, err := makeWritableTimes(absPath, stMode, times)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	f, err := os.OpenFile(absPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := f.ReadAt(buf, 0)
+	if err == io.EOF && n == 0 {
+		// Empty files have no header
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return err
+	}
+	cipherBS := int(r.old.ContentEnc.CipherBS())
+	cBlock := make([]byte, cipherBS)
+	allZero := make([]byte, cipherBS)
+	var newID []byte
+	if rec != nil {
+		newID = rec.Data
+	} else {
+		// Already done? This happens for hard links and for the file that
+		// was finished right before an interruption. Holes tell us nothing,
+		// look at the first block that contains data.
+		for blockNo := uint64(0); ; blockNo++ {
+			n, _ = f.ReadAt(cBlock, int64(r.old.ContentEnc.BlockNoToCipherOff(blockNo)))
+			if n == 0 {
+				break
+			}
+			if bytes.Equal(cBlock[:n], allZero[:n]) {
+				continue
+			}
+			last := int64(r.old.ContentEnc.BlockNoToCipherOff(blockNo))+int64(n) >= st.Size
+			if _, err = r.new.ContentEnc.DecryptContentBlock(cBlock[:n], blockNo, h.ID, last); err == nil {
+				return nil
+			}
+			break
+		}
+		newID = contentenc.RandomHeader().ID
+		err = r.journal.add(journalRecord{Op: "file", Path: cPath, Data: newID,
+			Mode: stMode, Times: times[:]}, true)
+		if err != nil {
+			return err
+		}
+	}
+	for blockNo := uint64(0); ; blockNo++ {
+		off := int64(r.old.ContentEnc.BlockNoToCipherOff(blockNo))
+		n, err = f.ReadAt(cBlock, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		block := cBlock[:n]
+		if bytes.Equal(block, allZero[:n]) {
+			// File hole, stays a hole
+			continue
+		}
+		last := off+int64(n) >= st.Size
+		plain, err := r.old.ContentEnc.DecryptContentBlock(block, blockNo, h.ID, last)
+		if err != nil {
+			if _, err2 := r.new.ContentEnc.DecryptContentBlock(block, blockNo, newID, last); err2 == nil {
+				continue
+			}
+			return fmt.Errorf("block #%d: %v", blockNo, err)
+		}
+		if _, err = f.WriteAt(r.new.ContentEnc.EncryptContentBlock(plain, blockNo, newID, last), off); err != nil {
+			return err
+		}
+		if n < cipherBS {
+			break
+		}
+	}
+	newHeader := contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: newID}
+	if _, err = f.WriteAt(newHeader.Pack(), 0); err != nil {
+		return err
+	}
+	r.nFiles++
+	return f.Sync()
+}
+
+// symlink re-encrypts the target of the symlink "cPath" by atomically
+// replacing the symlink. The mtime of the symlink itself is not preserved.
+func (r *reencrypter) symlink(cPath string, st *syscall.Stat_t) error {
+	if r.old.PlaintextNames {
+		// Symlink targets are not encrypted
+		return nil
+	}
+	absPath := r.old.Abs(cPath)
+	cTarget, err := os.Readlink(absPath)
+	if err != nil {
+		return err
+	}
+	target, err := r.old.DecryptSymlinkTarget(cTarget)
+	if err != nil {
+		if _, err2 := r.new.DecryptSymlinkTarget(cTarget); err2 == nil {
+			return nil
+		}
+		return err
+	}
+	newTarget := r.new.EncryptSymlinkTarget(target)
+	absDir := filepath.Dir(absPath)
+	var dirSt syscall.Stat_t
+	if err = syscall.Lstat(absDir, &dirSt); err != nil {
+		return err
+	}
+	restore, err := makeWritable(absDir, &dirSt)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	tmp := filepath.Join(absDir, reencryptTmpName)
+	os.Remove(tmp)
+	if err = os.Symlink(newTarget, tmp); err != nil {
+		return err
+	}
+	// Best effort, only works as root
+	os.Lchown(tmp, int(st.Uid), int(st.Gid))
+	return os.Rename(tmp, absPath)
+}
+
+// xattrs re-encrypts the names and values of the extended attributes of
+// "cPath". The ID that binds the values to the file does not depend on the
+// key and is kept.
+func (r *reencrypter) xattrs(cPath string, st *syscall.Stat_t) error {
+	if !r.old.Xattr {
+		return nil
+	}
+	absPath := r.old.Abs(cPath)
+	cAttrs, err := syscallcompat.Listxattr(absPath)
+	if err != nil || len(cAttrs) == 0 {
+		return err
+	}
+	restore, err := makeWritable(absPath, st)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	var id []byte
+	for _, cAttr := range cAttrs {
+		if !strings.HasPrefix(cAttr, nametransform.XattrPrefix) || cAttr == nametransform.XattrIDName {
+			continue
+		}
+		if id == nil {
+			if id, err = syscallcompat.Getxattr(absPath, nametransform.XattrIDName); err != nil {
+				return fmt.Errorf("%s: %v", nametransform.XattrIDName, err)
+			}
+		}
+		cData, err := syscallcompat.Getxattr(absPath, cAttr)
+		if err != nil {
+			return err
+		}
+		// The value is authenticated with the attribute name, so this tells
+		// us reliably which key the attribute is encrypted with.
+		attr, err := r.old.NameTransform.DecryptXattrName(cAttr)
+		var data []byte
+		if err == nil {
+			data, err = r.old.ContentEnc.DecryptBlock(cData, 0, nametransform.XattrValueAD(cAttr, id))
+		}
+		if err != nil {
+			if _, err2 := r.new.NameTransform.DecryptXattrName(cAttr); err2 == nil {
+				if _, err2 = r.new.ContentEnc.DecryptBlock(cData, 0, nametransform.XattrValueAD(cAttr, id)); err2 == nil {
+					continue
+				}
+			}
+			return fmt.Errorf("%s: %v", cAttr, err)
+		}
+		newCAttr, err := r.new.NameTransform.EncryptXattrName(attr)
+		if err != nil {
+			return err
+		}
+		newCData := r.new.ContentEnc.EncryptBlock(data, 0, nametransform.XattrValueAD(newCAttr, id))
+		err = syscallcompat.Setxattr(absPath, newCAttr, newCData, 0)
+		if err != nil {
+			return err
+		}
+		if err = syscallcompat.Removexattr(absPath, cAttr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptAndHashName encrypts "name" with "nt" and "iv" and hashes the
+// result if it is too long. Returns the name on disk and the full encrypted
+// name.
+func (r *reencrypter) encryptAndHashName(nt *nametransform.NameTransform, name string, iv []byte) (diskName string, cName string) {
+	cName = nt.EncryptName(name, iv)
+	if r.old.LongNames && len(cName) > nt.LongNameMax() {
+		return nt.HashLongName(cName), cName
+	}
+	return cName, cName
+}
+
+// writeTmpAndRename atomically replaces the file "absPath" with "content".
+func writeTmpAndRename(absPath string, content []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(absPath), reencryptTmpName)
+	os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(content)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, absPath)
+}
+
+// names re-encrypts the names in "cDir" and below with a new directory IV.
+// Subdirectories are processed first, so the paths in the journal stay valid.
+// The new names of a directory are recorded in the journal before the first
+// rename, so that renamed and not yet renamed entries can be told apart
+// reliably when resuming.
+func (r *reencrypter) names(cDir string) error {
+	absDir := r.old.Abs(cDir)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(absDir, &st); err != nil {
+		return err
+	}
+	oldIV, err := nametransform.ReadDirIV(absDir)
+	if err != nil {
+		return err
+	}
+	entries, err := r.old.ReadDir(cDir)
+	if err != nil {
+		return err
+	}
+	newIV := r.journal.dirIVs[cDir]
+	if newIV == nil {
+		// Plan the renames
+		newIV = cryptocore.RandBytes(nametransform.DirIVLen)
+		rec := journalRecord{Op: "diriv", Path: cDir, Data: newIV}
+		for _, name := range entries {
+			plain, err := r.old.DecryptNameIV(cDir, name, oldIV)
+			if err != nil {
+				return fmt.Errorf("%s: could not decrypt name: %v", filepath.Join(cDir, name), err)
+			}
+			diskName, _ := r.encryptAndHashName(r.new.NameTransform, plain, newIV)
+			rec.Names = append(rec.Names, diskName)
+		}
+		if err = r.journal.add(rec, true); err != nil {
+			return err
+		}
+	}
+	newNames := r.journal.newNames[cDir]
+	// Bottom-up: handle the subdirectories first
+	for _, name := range entries {
+		if newNames[name] {
+			// Already renamed, which means that it is done
+			continue
+		}
+		cPath := filepath.Join(cDir, name)
+		if r.journal.dirsDone[cPath] {
+			continue
+		}
+		var st2 syscall.Stat_t
+		if err = syscall.Lstat(r.old.Abs(cPath), &st2); err != nil {
+			return err
+		}
+		if st2.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err = r.names(cPath); err != nil {
+				return err
+			}
+		}
+	}
+	restore, err := makeWritable(absDir, &st)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	for _, name := range entries {
+		if newNames[name] {
+			continue
+		}
+		plain, err := r.old.DecryptNameIV(cDir, name, oldIV)
+		if err != nil {
+			return fmt.Errorf("%s: could not decrypt name: %v", filepath.Join(cDir, name), err)
+		}
+		diskName, cName := r.encryptAndHashName(r.new.NameTransform, plain, newIV)
+		newPath := filepath.Join(absDir, diskName)
+		if _, err = os.Lstat(newPath); err == nil {
+			return fmt.Errorf("%s: new name %q already exists", filepath.Join(cDir, name), diskName)
+		}
+		if diskName != cName {
+			err = writeTmpAndRename(newPath+nametransform.LongNameSuffix, []byte(cName), 0600)
+			if err != nil {
+				return err
+			}
+		}
+		if err = os.Rename(filepath.Join(absDir, name), newPath); err != nil {
+			return err
+		}
+		if nametransform.IsLongContent(name) {
+			os.Remove(filepath.Join(absDir, name+nametransform.LongNameSuffix))
+		}
+		r.nNames++
+	}
+	// Remove ".name" files left behind by an interruption
+	names, err := os.Open(absDir)
+	if err != nil {
+		return err
+	}
+	all, err := names.Readdirnames(-1)
+	names.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range all {
+		if nametransform.NameType(name) != nametransform.LongNameFilename {
+			continue
+		}
+		content := strings.TrimSuffix(name, nametransform.LongNameSuffix)
+		if _, err = os.Lstat(filepath.Join(absDir, content)); os.IsNotExist(err) {
+			os.Remove(filepath.Join(absDir, name))
+		}
+	}
+	// gocryptfs.diriv should never be modified after creation, hence 0400
+	err = writeTmpAndRename(filepath.Join(absDir, nametransform.DirIVFilename), newIV, 0400)
+	if err != nil {
+		return err
+	}
+	return r.journal.add(journalRecord{Op: "dir", Path: cDir}, true)
+}
+
+// reencrypt re-encrypts the whole CIPHERDIR with a new random master key.
+// The old key is taken from the password or from "-masterkey". Progress is
+// recorded in a journal next to the config file, so that an interrupted run
+// can be resumed by running "-reencrypt" again with the old credentials.
+// This is called when you pass the "-reencrypt" option.
+func reencrypt(args *argContainer) {
+	var oldKey []byte
+	var confFile *configfile.ConfFile
+	var err error
+	pw := ""
+	if args.masterkey != "" {
+		oldKey = parseMasterKey(args.masterkey)
+		_, confFile, err = configfile.LoadConfFile(args.config, "")
+	} else {
+		pw = readpassword.Once(args.extpass)
+		tlog.Info.Println("Decrypting master key")
+		oldKey, confFile, err = configfile.LoadConfFile(args.config, pw)
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagDirManifest) {
+		tlog.Fatal.Printf("reencrypt: filesystems with directory manifests are not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagXattr) && runtime.GOOS == "darwin" {
+		// syscallcompat cannot access the attributes on Darwin, so they
+		// would keep the old key
+		tlog.Fatal.Printf("reencrypt: filesystems with extended attributes are not supported on Darwin")
+		os.Exit(exitcodes.Usage)
+	}
+	if pw == "" {
+		tlog.Info.Println("Please enter the password for the re-encrypted filesystem.")
+		pw = readpassword.Twice(args.extpass)
+	}
+	readpassword.CheckTrailingGarbage()
+	journalPath := args.config + reencryptJournalSuffix
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		tlog.Fatal.Printf("reencrypt: could not open journal: %v", err)
+		os.Exit(exitcodes.ReencryptError)
+	}
+	backend := ciphertree.CryptoBackend(confFile, args.openssl)
+	r := reencrypter{
+		old:     ciphertree.New(args.cipherdir, oldKey, confFile, backend, false),
+		journal: journal,
+	}
+	for _, p := range []string{args.config, journalPath} {
+		if filepath.Dir(p) == args.cipherdir {
+			r.old.AddMetadata(filepath.Base(p), true)
+		}
+	}
+	r.old.AddMetadata(reencryptTmpName, false)
+	// The new master key is stored in the journal, encrypted with a hash of
+	// the new password like in the config file. It must not depend on the
+	// old key, which may be the reason for the re-encryption.
+	var newKey []byte
+	if journal.key == nil {
+		newKey = cryptocore.RandBytes(cryptocore.KeyLen)
+		slot := confFile.WrapKey(newKey, pw, confFile.KDF(), confFile.ScryptLogN())
+		err = journal.add(journalRecord{Op: "key", Key: &slot}, true)
+		if err != nil {
+			tlog.Fatal.Printf("reencrypt: could not write journal: %v", err)
+			os.Exit(exitcodes.ReencryptError)
+		}
+	} else {
+		tlog.Info.Printf("Resuming interrupted re-encryption")
+		newKey, err = confFile.UnwrapKey(journal.key, pw)
+		if err != nil {
+			tlog.Fatal.Printf("reencrypt: could not decrypt the journal %q: %v", journalPath, err)
+			tlog.Fatal.Printf("Enter the same new password as in the interrupted run.")
+			os.Exit(exitcodes.ReencryptError)
+		}
+		if journal.complete && bytes.Equal(oldKey, newKey) {
+			// We were interrupted after the config file was rewritten. The
+			// "old" key is actually the new one.
+			os.Remove(journalPath)
+			tlog.Info.Println(tlog.ColorGreen + "Re-encryption complete." + tlog.ColorReset)
+			os.Exit(0)
+		}
+	}
+	r.new = ciphertree.New(args.cipherdir, newKey, confFile, backend, false)
+	for i := range oldKey {
+		oldKey[i] = 0
+	}
+	// DecryptBlock logs every failure as a warning, but failures are expected
+	// when we probe for already re-encrypted data.
+	tlog.Warn.Enabled = false
+	if !journal.contentsDone {
+		tlog.Info.Printf("Re-encrypting file contents...")
+		var st syscall.Stat_t
+		err = syscall.Lstat(args.cipherdir, &st)
+		if err == nil {
+			err = r.contents("")
+		}
+		if err == nil {
+			err = r.xattrs("", &st)
+		}
+		if err == nil {
+			err = journal.add(journalRecord{Op: "contents"}, true)
+		}
+	}
+	if err == nil && !r.old.PlaintextNames && !journal.complete {
+		tlog.Info.Printf("Re-encrypting file names...")
+		err = r.names("")
+	}
+	if err == nil && !journal.complete {
+		err = journal.add(journalRecord{Op: "complete"}, true)
+	}
+	tlog.Warn.Enabled = true
+	if err != nil {
+		tlog.Fatal.Printf("reencrypt: %v", err)
+		tlog.Fatal.Printf("Fix the problem and run -reencrypt again to resume.")
+		os.Exit(exitcodes.ReencryptError)
+	}
+	tlog.Info.Printf("Re-encrypted %d files and %d names", r.nFiles, r.nNames)
+	// Swap in the new key
+	if removed := confFile.DropOtherKeySlots(); len(removed) > 0 {
+		tlog.Warn.Printf("reencrypt: removed key slots %s, add them again using -addkey",
+			strings.Join(removed, ", "))
+	}
+	confFile.EncryptKey(newKey, pw, confFile.KDF(), confFile.ScryptLogN())
+	for i := range newKey {
+		newKey[i] = 0
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	journal.fd.Close()
+	os.Remove(journalPath)
+	tlog.Info.Println(tlog.ColorGreen + "Re-encryption complete. The old master key is no longer valid." +
+		tlog.ColorReset)
+	os.Exit(0)
+}
@@ -3,9 +3,11 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -96,6 +98,316 @@ func testPasswd(t *testing.T, dir string, extraArgs ...string) {
 	}
 }
 
+// Test -init with -xchacha
+func TestInitXChaCha(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xchacha")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag should be set but is not")
+	}
+	// Reverse mode needs AES-SIV
+	mnt := dir + ".mnt"
+	err = test_helpers.Mount(dir, mnt, false, "-reverse", "-config", dir+"/"+configfile.ConfDefaultName,
+		"-extpass", "echo test")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("reverse mount of an XChaCha20-Poly1305 config should fail")
+	}
+}
+
+// Test -init with -nfc. The NFC and the NFD form of a name must open the same
+// file.
+func TestInitNFC(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-nfc")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagNFC) {
+		t.Error("NFC flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	nfcName := "caf\u00e9"
+	nfdName := "cafe\u0301"
+	err = ioutil.WriteFile(mnt+"/"+nfdName, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(mnt + "/" + nfcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "foo" {
+		t.Errorf("wrong content %q", content)
+	}
+	fis, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != nfcName {
+		t.Errorf("want only %q, got %d entries", nfcName, len(fis))
+	}
+}
+
+// Test -init with -base32. All names in CIPHERDIR must be lower-case.
+func TestInitBase32(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-base32")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagBase32) {
+		t.Error("Base32 flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, name := range []string{"foo", "FOO", test_helpers.X255} {
+		err = ioutil.WriteFile(mnt+"/"+name, []byte(name), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if strings.ToLower(fi.Name()) != fi.Name() {
+			t.Errorf("name %q is not lower-case", fi.Name())
+		}
+	}
+}
+
+// Test -init with -compress. Compressible data must read back the same.
+func TestInitCompress(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-compress", "-blocksize", "64K")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagCompression) {
+		t.Error("Compression flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content := []byte(strings.Repeat("{\"level\": \"info\", \"msg\": \"compress me\"}\n", 10000))
+	fn := mnt + "/log.json"
+	err = ioutil.WriteFile(fn, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite the middle of a compressed block
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("XXXX"), 70000)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(content[70000:], "XXXX")
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Error("content mismatch")
+	}
+}
+
+// Test -init with -lastblockmarker. Cutting the last block off a file in
+// CIPHERDIR must make reads fail.
+func TestInitLastBlockMarker(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-lastblockmarker", "-plaintextnames")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagLastBlockMarker) {
+		t.Error("LastBlockMarker flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content := bytes.Repeat([]byte("x"), 3*4096)
+	err = ioutil.WriteFile(mnt+"/file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append, so the previous last block is unmarked
+	f, err := os.OpenFile(mnt+"/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("appended"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, "appended"...)
+	have, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("content mismatch, err=%v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Drop the last block
+	fi, err := os.Stat(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(dir+"/file", fi.Size()-(int64(len("appended"))+32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	_, err = ioutil.ReadFile(mnt + "/file")
+	if err == nil {
+		t.Error("reading a truncated file should have failed")
+	}
+}
+
+// Test -init with -dirmanifest. Swapping two files in CIPHERDIR must be
+// detected.
+func TestInitDirManifest(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-dirmanifest")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagDirManifest) {
+		t.Error("DirManifest flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, name := range []string{"a", "b"} {
+		err = ioutil.WriteFile(mnt+"/"+name, []byte(name), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(mnt+"/d", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadDir(mnt); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Swap the two files
+	var files []string
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), "gocryptfs.") {
+			files = append(files, dir+"/"+fi.Name())
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("want 2 files, got %v", files)
+	}
+	os.Rename(files[0], dir+"/tmp")
+	os.Rename(files[1], files[0])
+	os.Rename(dir+"/tmp", files[1])
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	_, err = ioutil.ReadFile(mnt + "/a")
+	if err == nil {
+		t.Error("reading a swapped file should have failed")
+	}
+}
+
+// -dirmanifest needs HKDF for the manifest key
+func TestInitDirManifestNoHKDF(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+		"-scryptn=10", "-dirmanifest", "-hkdf=false", dir)
+	if cmd.Run() == nil {
+		t.Error("-init -dirmanifest -hkdf=false should have failed")
+	}
+}
+
+// Test -init with -longnamemax. No name in CIPHERDIR may be longer than the
+// threshold.
+func TestInitLongNameMax(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-longnamemax", "100")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	name := strings.Repeat("x", 80)
+	err := ioutil.WriteFile(mnt+"/"+name, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != name {
+		t.Errorf("want only %q, got %d entries", name, len(fis))
+	}
+	test_helpers.UnmountPanic(mnt)
+	fis, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if len(fi.Name()) > 100 {
+			t.Errorf("name %q is longer than 100 bytes", fi.Name())
+		}
+	}
+}
+
+// Test -init with -kdf argon2id
+func TestInitArgon2id(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-kdf", "argon2id")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagArgon2id) || c.Argon2idObject == nil {
+		t.Error("argon2id should be used but is not")
+	}
+}
+
+// Test that -passwd can switch the password hash between scrypt and argon2id
+func TestPasswdArgon2id(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	testPasswd(t, dir, "-kdf", "argon2id")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "newpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.KDF() != configfile.KDFArgon2id {
+		t.Errorf("wrong KDF %q after switching to argon2id", c.KDF())
+	}
+	// Without -kdf, the password hash is kept
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-extpass", "echo newpasswd", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "newpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.KDF() != configfile.KDFArgon2id {
+		t.Errorf("wrong KDF %q after -passwd without -kdf", c.KDF())
+	}
+}
+
 // Test -passwd flag
 func TestPasswd(t *testing.T) {
 	// Create FS
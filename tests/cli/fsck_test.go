@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// runFsck runs "gocryptfs -fsck" on "dir" and returns the exit code.
+func runFsck(t *testing.T, dir string) int {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fsck", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+// Test -fsck on a healthy and on a corrupted filesystem
+func TestFsck(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := os.Mkdir(mnt+"/dir1", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir1/file1", make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/"+test_helpers.X255, []byte("longname"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/foo/bar", mnt+"/symlink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	if code := runFsck(t, dir); code != 0 {
+		t.Fatalf("fsck on a healthy filesystem: want exit code 0, got %d", code)
+	}
+	// Flip a byte in the second block of every regular file
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() < 5000 {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.WriteAt([]byte{0xff}, 4200)
+		return err
+	})
+	if code := runFsck(t, dir); code != exitcodes.FsckErrors {
+		t.Errorf("fsck on a corrupted filesystem: want exit code %d, got %d", exitcodes.FsckErrors, code)
+	}
+}
+
+// Test that -fsck finds names that only differ in Unicode normalization
+func TestFsckNormalizationConflict(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	// NFC and NFD form of the same name
+	for _, name := range []string{"caf\u00e9", "cafe\u0301"} {
+		err := ioutil.WriteFile(mnt+"/"+name, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	if code := runFsck(t, dir); code != exitcodes.FsckErrors {
+		t.Errorf("want exit code %d, got %d", exitcodes.FsckErrors, code)
+	}
+}
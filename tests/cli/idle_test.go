@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// isMounted checks /proc/mounts for "mnt"
+func isMounted(t *testing.T, mnt string) bool {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Skip(err)
+	}
+	return strings.Contains(string(mounts), " "+mnt+" ")
+}
+
+// Test that "-idle" unmounts the filesystem, but not while a file is open
+func TestIdle(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-idle", "2s")
+	err := ioutil.WriteFile(mnt+"/file1", []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(mnt + "/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Second)
+	if !isMounted(t, mnt) {
+		t.Fatal("filesystem was unmounted while a file was open")
+	}
+	f.Close()
+	for i := 0; i < 100; i++ {
+		if !isMounted(t, mnt) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	test_helpers.UnmountPanic(mnt)
+	t.Error("filesystem was not unmounted after the idle time")
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Test -addkey, -listkeys and -removekey
+func TestKeySlots(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	// Add a key slot with the password "second". The old and the new password
+	// are read from stdin.
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-addkey", "-label", "second", dir)
+	cmd.Stdin = strings.NewReader("test\nsecond\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-q", "-listkeys", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "default") || !strings.Contains(string(out), "second") {
+		t.Errorf("unexpected -listkeys output: %q", out)
+	}
+	// -info prints the key slots and everything after them
+	out, err = exec.Command(test_helpers.GocryptfsBinary, "-info", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "KeySlot:") || !strings.Contains(string(out), "BlockSize:") {
+		t.Errorf("unexpected -info output: %q", out)
+	}
+	// Both passwords work
+	mnt := dir + ".mnt"
+	for _, pw := range []string{"test", "second"} {
+		test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo "+pw)
+		test_helpers.UnmountPanic(mnt)
+	}
+	// Revoke the original password
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-removekey", "default", "-extpass", "echo second", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := test_helpers.Mount(dir, mnt, false, "-extpass", "echo test"); err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("mounting with a removed password should fail")
+	}
+	// The last key slot cannot be removed
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-removekey", "second", "-extpass", "echo second", dir)
+	if err := cmd.Run(); err == nil {
+		t.Error("removing the last key slot should fail")
+	}
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Test that -reencrypt changes all ciphertext names and keeps the plaintext
+func TestReencrypt(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err := os.Mkdir(mnt+"/dir1", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir1/file1", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/"+test_helpers.X255, []byte("longname"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/foo/bar", mnt+"/symlink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	oldNames := make(map[string]bool)
+	fd, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names {
+		oldNames[n] = true
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reencrypt", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	fd, err = os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names {
+		if n == configfile.ConfDefaultName || n == nametransform.DirIVFilename {
+			continue
+		}
+		if oldNames[n] {
+			t.Errorf("ciphertext name %q was not changed", n)
+		}
+	}
+	if _, err = os.Stat(dir + "/" + configfile.ConfDefaultName + ".reencrypt"); !os.IsNotExist(err) {
+		t.Errorf("journal file was not removed: %v", err)
+	}
+	if code := runFsck(t, dir); code != 0 {
+		t.Fatalf("fsck after -reencrypt: want exit code 0, got %d", code)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	have, err := ioutil.ReadFile(mnt + "/dir1/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Error("file content changed")
+	}
+	have, err = ioutil.ReadFile(mnt + "/" + test_helpers.X255)
+	if err != nil || string(have) != "longname" {
+		t.Errorf("long name file: content=%q err=%v", have, err)
+	}
+	target, err := os.Readlink(mnt + "/symlink1")
+	if err != nil || target != "/foo/bar" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// xrayBinary is the assumed path to the gocryptfs-xray build.
+const xrayBinary = "../../gocryptfs-xray/gocryptfs-xray"
+
+// runXray runs gocryptfs-xray with "args" and the password "test" and
+// returns true if it exited successfully.
+func runXray(args ...string) bool {
+	args = append([]string{"-extpass", "echo test"}, args...)
+	cmd := exec.Command(xrayBinary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run() == nil
+}
+
+// Test that "gocryptfs-xray -encrypt" and "-decrypt" round-trip a directory
+// tree without mounting
+func TestXrayEncryptDecrypt(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".src"
+	content := make([]byte, 300001)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err := os.MkdirAll(src+"/dir1", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(src+"/dir1/file1", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(src+"/"+test_helpers.X255, []byte("longname"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/foo/bar", src+"/symlink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !runXray("-encrypt", src, dir) {
+		t.Fatal("-encrypt failed")
+	}
+	if code := runFsck(t, dir); code != 0 {
+		t.Fatalf("fsck after -encrypt: want exit code 0, got %d", code)
+	}
+	out := dir + ".out"
+	if !runXray("-decrypt", dir, out) {
+		t.Fatal("-decrypt failed")
+	}
+	name := filepath.Base(src)
+	have, err := ioutil.ReadFile(out + "/" + name + "/dir1/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Error("file content changed")
+	}
+	have, err = ioutil.ReadFile(out + "/" + name + "/" + test_helpers.X255)
+	if err != nil || string(have) != "longname" {
+		t.Errorf("long name file: content=%q err=%v", have, err)
+	}
+	target, err := os.Readlink(out + "/" + name + "/symlink1")
+	if err != nil || target != "/foo/bar" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+	// Flip a byte in the second block of every large file. The damaged file
+	// must be left out.
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() < 5000 {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.WriteAt([]byte{0xff}, 4200)
+		return err
+	})
+	out2 := dir + ".out2"
+	if runXray("-decrypt", dir, out2) {
+		t.Error("-decrypt of a corrupt file should fail")
+	}
+	if _, err = os.Stat(out2 + "/" + name + "/dir1/file1"); !os.IsNotExist(err) {
+		t.Errorf("corrupt file should not be written out, got %v", err)
+	}
+	have, err = ioutil.ReadFile(out2 + "/" + name + "/" + test_helpers.X255)
+	if err != nil || string(have) != "longname" {
+		t.Errorf("intact files should still be decrypted: content=%q err=%v", have, err)
+	}
+}
@@ -1,6 +1,7 @@
 package defaults
 
 import (
+	"io/ioutil"
 	"os"
 	"syscall"
 	"testing"
@@ -96,3 +97,53 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// Test the "Stats" operation
+func TestCtlSockStats(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	err := ioutil.WriteFile(pDir+"/file1", make([]byte, 1000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(pDir + "/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 1000)
+	if _, err = f.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Op: ctlsock.OpStats})
+	s := response.Stats
+	if response.ErrNo != 0 || s == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if s.Version != ctlsock.StatsVersion {
+		t.Errorf("wrong version %d", s.Version)
+	}
+	if s.BytesWritten < 1000 || s.BytesRead < 1000 {
+		t.Errorf("BytesWritten=%d BytesRead=%d, want at least 1000 each", s.BytesWritten, s.BytesRead)
+	}
+	if s.WriteOpCount == 0 {
+		t.Error("WriteOpCount is zero")
+	}
+	if s.OpenFiles != 1 {
+		t.Errorf("OpenFiles=%d, want 1", s.OpenFiles)
+	}
+	if s.AuthFailures != 0 {
+		t.Errorf("AuthFailures=%d, want 0", s.AuthFailures)
+	}
+	if s.Backend == "" {
+		t.Error("Backend is empty")
+	}
+	// Unknown operations must fail
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Op: "xyz"})
+	if response.ErrNo == 0 || response.Stats != nil {
+		t.Errorf("unknown Op should fail: %+v", response)
+	}
+}
@@ -34,6 +34,23 @@ func BenchmarkStreamWrite(t *testing.B) {
 }
 
 func BenchmarkStreamRead(t *testing.B) {
+	streamRead(t)
+}
+
+// BenchmarkStreamReadWorkers1 and BenchmarkStreamReadWorkers4 show how much
+// parallel decryption gains compared to BenchmarkStreamRead.
+func BenchmarkStreamReadWorkers1(t *testing.B) {
+	streamRead(t, "-decryptworkers=1")
+}
+
+func BenchmarkStreamReadWorkers4(t *testing.B) {
+	streamRead(t, "-decryptworkers=4")
+}
+
+// streamRead reads the file written by BenchmarkStreamWrite in 1MiB chunks.
+// If "extraArgs" are passed, the file is read through a second mount of the
+// default filesystem that uses these options.
+func streamRead(t *testing.B, extraArgs ...string) {
 	buf := make([]byte, 1024*1024)
 	t.SetBytes(int64(len(buf)))
 
@@ -63,6 +80,17 @@ func BenchmarkStreamRead(t *testing.B) {
 		f2.Close()
 	}
 
+	if len(extraArgs) > 0 {
+		mnt := test_helpers.TmpDir + "/streamRead"
+		extraArgs = append([]string{"-zerokey"}, extraArgs...)
+		err = test_helpers.Mount(test_helpers.DefaultCipherDir, mnt, true, extraArgs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer test_helpers.UnmountPanic(mnt)
+		fn = mnt + "/BenchmarkWrite"
+	}
+
 	file, err := os.Open(fn)
 	if err != nil {
 		t.FailNow()
@@ -0,0 +1,129 @@
+package defaults
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// listXattr returns the attribute names of "path".
+func listXattr(t *testing.T, path string) []string {
+	buf := make([]byte, 4096)
+	sz, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, n := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(n) > 0 {
+			names = append(names, string(n))
+		}
+	}
+	return names
+}
+
+// Set, get, list and remove an extended attribute on a filesystem created with
+// "-xattr" and check that it is stored encrypted in CIPHERDIR.
+func TestXattr(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xattr")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	fn := mnt + "/TestXattr"
+	err := ioutil.WriteFile(fn, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := "user.TestXattr"
+	val := []byte("secret value 123")
+	err = syscall.Setxattr(fn, attr, val, 0)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("backing filesystem does not support user xattrs")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	sz, err := syscall.Getxattr(fn, attr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:sz], val) {
+		t.Errorf("wrong value: %q", buf[:sz])
+	}
+	names := listXattr(t, fn)
+	if len(names) != 1 || names[0] != attr {
+		t.Errorf("wrong attribute list: %v", names)
+	}
+	// Check the backing file
+	var cNames []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		for _, n := range listXattr(t, path) {
+			if strings.Contains(n, attr) {
+				t.Errorf("plaintext attribute name %q on backing file %q", n, path)
+			}
+			if !strings.HasPrefix(n, nametransform.XattrPrefix) || n == nametransform.XattrIDName {
+				continue
+			}
+			cNames = append(cNames, n)
+			sz, err := syscall.Getxattr(path, n, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(buf[:sz], val) {
+				t.Errorf("plaintext attribute value on backing file %q", path)
+			}
+		}
+		return nil
+	})
+	if len(cNames) != 1 {
+		t.Errorf("want one encrypted attribute in CIPHERDIR, got %v", cNames)
+	}
+	err = syscall.Removexattr(fn, attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Getxattr(fn, attr, buf)
+	if err != syscall.ENODATA {
+		t.Errorf("want ENODATA after removal, got %v", err)
+	}
+}
+
+// An attribute value larger than a block must not crash a filesystem
+// created with "-compress".
+func TestXattrLargeCompress(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xattr", "-compress", "-blocksize", "16K")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	fn := mnt + "/TestXattrLargeCompress"
+	err := ioutil.WriteFile(fn, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := "user.TestXattrLargeCompress"
+	val := []byte(strings.Repeat("compressible attribute value\n", 1000))
+	err = syscall.Setxattr(fn, attr, val, 0)
+	if err == syscall.EOPNOTSUPP || err == syscall.E2BIG || err == syscall.ENOSPC {
+		t.Skipf("backing filesystem does not support large user xattrs: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*len(val))
+	sz, err := syscall.Getxattr(fn, attr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:sz], val) {
+		t.Errorf("wrong value, len=%d", sz)
+	}
+}
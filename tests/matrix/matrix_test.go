@@ -1,4 +1,5 @@
-// Tests run for (almost all) combinations of openssl, aessiv, plaintextnames.
+// Tests run for (almost all) combinations of openssl, aessiv, xchacha,
+// plaintextnames, blocksize, cachesize.
 package matrix
 
 // File reading, writing, modification, truncate
@@ -36,21 +37,31 @@ type testcaseMatrix struct {
 	openssl        string
 	aessiv         bool
 	raw64          bool
+	xchacha        bool
+	blocksize      string
+	cachesize      int
 }
 
 var matrix = []testcaseMatrix{
 	// Normal
-	{false, "auto", false, false},
-	{false, "true", false, false},
-	{false, "false", false, false},
+	{false, "auto", false, false, false, "", 0},
+	{false, "true", false, false, false, "", 0},
+	{false, "false", false, false, false, "", 0},
 	// Plaintextnames
-	{true, "true", false, false},
-	{true, "false", false, false},
+	{true, "true", false, false, false, "", 0},
+	{true, "false", false, false, false, "", 0},
 	// AES-SIV (does not use openssl, no need to test permutations)
-	{false, "auto", true, false},
-	{true, "auto", true, false},
+	{false, "auto", true, false, false, "", 0},
+	{true, "auto", true, false, false, "", 0},
 	// Raw64
-	{false, "auto", false, true},
+	{false, "auto", false, true, false, "", 0},
+	// XChaCha20-Poly1305 (does not use openssl either)
+	{false, "auto", false, false, true, "", 0},
+	{true, "auto", false, false, true, "", 0},
+	// Large blocks
+	{false, "auto", false, false, false, "64K", 0},
+	// Block cache
+	{false, "auto", false, false, false, "", 1},
 }
 
 // This is the entry point for the tests
@@ -67,6 +78,11 @@ func TestMain(m *testing.M) {
 		opts = append(opts, fmt.Sprintf("-plaintextnames=%v", testcase.plaintextnames))
 		opts = append(opts, fmt.Sprintf("-aessiv=%v", testcase.aessiv))
 		opts = append(opts, fmt.Sprintf("-raw64=%v", testcase.raw64))
+		opts = append(opts, fmt.Sprintf("-xchacha=%v", testcase.xchacha))
+		if testcase.blocksize != "" {
+			opts = append(opts, "-blocksize="+testcase.blocksize)
+		}
+		opts = append(opts, fmt.Sprintf("-cachesize=%d", testcase.cachesize))
 		test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, opts...)
 		r := m.Run()
 		test_helpers.UnmountPanic(test_helpers.DefaultPlainDir)
@@ -216,11 +232,16 @@ func isWellKnownFS(fn string) bool {
 
 const FALLOC_DEFAULT = 0x00
 const FALLOC_FL_KEEP_SIZE = 0x01
+const FALLOC_FL_PUNCH_HOLE = 0x02
+const FALLOC_FL_ZERO_RANGE = 0x10
 
 func TestFallocate(t *testing.T) {
 	if runtime.GOOS == "darwin" {
 		t.Skipf("OSX does not support fallocate")
 	}
+	if testcase.blocksize != "" {
+		t.Skipf("the expected allocation sizes assume 4096-byte blocks")
+	}
 	fn := test_helpers.DefaultPlainDir + "/fallocate"
 	file, err := os.Create(fn)
 	if err != nil {
@@ -338,6 +359,56 @@ func TestFallocate(t *testing.T) {
 	}
 }
 
+// Test that punching holes and zeroing ranges zeroes exactly the requested
+// range, in full and partial blocks
+func TestFallocatePunchHoleZeroRange(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("OSX does not support fallocate")
+	}
+	fn := test_helpers.DefaultPlainDir + "/TestFallocatePunchHoleZeroRange"
+	want := bytes.Repeat([]byte{0xaa}, 200000)
+	if err := ioutil.WriteFile(fn, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+	check := func(op string) {
+		have, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("%s: wrong content", op)
+		}
+	}
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 10000, 140000)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("backing filesystem does not support hole punching")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	copy(want[10000:150000], make([]byte, 140000))
+	check("punch hole")
+	// Zeroing past the end of the file grows it
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_ZERO_RANGE, 190000, 60000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(want[190000:], make([]byte, 10000))
+	want = append(want, make([]byte, 50000)...)
+	check("zero range")
+	// ...unless we ask it not to
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE, 240000, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("zero range, keep size")
+}
+
 func TestAppend(t *testing.T) {
 	fn := test_helpers.DefaultPlainDir + "/append"
 	file, err := os.Create(fn)
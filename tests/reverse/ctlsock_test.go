@@ -72,3 +72,25 @@ func TestCtlSockCrash(t *testing.T) {
 	req := ctlsock.RequestStruct{DecryptPath: "gocryptfs.longname.XXX_TestCtlSockCrash_XXX.name"}
 	test_helpers.QueryCtlSock(t, sock, req)
 }
+
+// Test the "Stats" operation
+func TestCtlSockStats(t *testing.T) {
+	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := mnt + ".sock"
+	test_helpers.MountOrFatal(t, "ctlsock_reverse_test_fs", mnt, "-reverse", "-extpass", "echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Op: ctlsock.OpStats})
+	s := response.Stats
+	if response.ErrNo != 0 || s == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if s.Backend != "AES-SIV" {
+		t.Errorf("wrong backend %q", s.Backend)
+	}
+	if s.BytesWritten != 0 || s.WriteOpCount != 0 {
+		t.Errorf("reverse mode is read-only, but got %+v", s)
+	}
+}
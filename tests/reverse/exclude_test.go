@@ -0,0 +1,93 @@
+package reverse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// encryptPath asks the control socket "sock" to encrypt "plainPath".
+func encryptPath(t *testing.T, sock string, plainPath string) ctlsock.ResponseStruct {
+	req := ctlsock.RequestStruct{EncryptPath: plainPath}
+	return test_helpers.QueryCtlSock(t, sock, req)
+}
+
+// Excluded files and directories must be invisible in the encrypted view
+func TestExclude(t *testing.T) {
+	dirs := []string{"dir1/build", "dir2", "longdir." + x240}
+	pOk := []string{"file2", "dir1/keep.o", "dir2/file"}
+	pExclude := []string{"file1", "dir1/obj.o", "dir1/build", "dir1/build/file", "longdir." + x240}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(dirA, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range append(pOk, "file1", "dir1/obj.o", "dir1/build/file") {
+		if err := ioutil.WriteFile(filepath.Join(dirA, p), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludeFile := filepath.Join(test_helpers.TmpDir, "TestExclude.patterns")
+	if err := ioutil.WriteFile(excludeFile, []byte("# comment\n*.o\n!keep.o\nbuild/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A reverse mount without exclusions tells us the ciphertext paths
+	mnt1, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock1 := mnt1 + ".sock"
+	test_helpers.MountOrFatal(t, dirA, mnt1, "-reverse", "-extpass", "echo test", "-ctlsock="+sock1)
+	defer test_helpers.UnmountPanic(mnt1)
+	mnt2, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock2 := mnt2 + ".sock"
+	test_helpers.MountOrFatal(t, dirA, mnt2, "-reverse", "-extpass", "echo test", "-ctlsock="+sock2,
+		"-exclude", "file1", "-exclude", "longdir.*", "-exclude-from", excludeFile)
+	defer test_helpers.UnmountPanic(mnt2)
+	for _, p := range pOk {
+		r := encryptPath(t, sock2, p)
+		if r.ErrNo != 0 {
+			t.Errorf("%q: EncryptPath failed: %s", p, r.ErrText)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(mnt2, r.Result)); err != nil {
+			t.Errorf("%q should be visible: %v", p, err)
+		}
+	}
+	for _, p := range pExclude {
+		if r := encryptPath(t, sock2, p); r.ErrNo != int32(syscall.ENOENT) {
+			t.Errorf("%q: EncryptPath should fail with ENOENT, got ErrNo=%d", p, r.ErrNo)
+		}
+		r := encryptPath(t, sock1, p)
+		if r.ErrNo != 0 {
+			t.Fatalf("%q: EncryptPath failed: %s", p, r.ErrText)
+		}
+		if _, err := os.Stat(filepath.Join(mnt2, r.Result)); !os.IsNotExist(err) {
+			t.Errorf("%q should be hidden, got err=%v", p, err)
+		}
+		if _, err := os.Stat(filepath.Join(mnt1, r.Result)); err != nil {
+			t.Errorf("%q should be visible without -exclude: %v", p, err)
+		}
+	}
+	// Check directory listings
+	r := encryptPath(t, sock1, "dir1")
+	entries, err := ioutil.ReadDir(filepath.Join(mnt2, r.Result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 1 // keep.o
+	if !plaintextnames {
+		want++ // gocryptfs.diriv
+	}
+	if len(entries) != want {
+		t.Errorf("dir1 listing: want %d entries, got %d", want, len(entries))
+	}
+}
@@ -0,0 +1,60 @@
+package reverse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Test that a reverse mount created with "-longnamemax" hashes all names
+// longer than the threshold, and that they can still be listed, opened and
+// translated through the control socket.
+func TestLongNameMax(t *testing.T) {
+	if plaintextnames {
+		t.Skip("this only tests encrypted names")
+	}
+	dir := test_helpers.InitFS(t, "-reverse", "-longnamemax", "100")
+	name := strings.Repeat("y", 80)
+	err := ioutil.WriteFile(dir+"/"+name, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	sock := mnt + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+	fis, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cName string
+	for _, fi := range fis {
+		if len(fi.Name()) > 100 {
+			t.Errorf("name %q is longer than 100 bytes", fi.Name())
+		}
+		if nametransform.IsLongContent(fi.Name()) {
+			cName = fi.Name()
+		}
+	}
+	if cName == "" {
+		t.Fatal("no long name found")
+	}
+	if _, err = os.Stat(mnt + "/" + cName); err != nil {
+		t.Error(err)
+	}
+	req := ctlsock.RequestStruct{EncryptPath: name}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 || response.Result != cName {
+		t.Errorf("EncryptPath: want %q, got %q, ErrNo=%d", cName, response.Result, response.ErrNo)
+	}
+	req = ctlsock.RequestStruct{DecryptPath: cName}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 || response.Result != name {
+		t.Errorf("DecryptPath: want %q, got %q, ErrNo=%d", name, response.Result, response.ErrNo)
+	}
+}
@@ -0,0 +1,70 @@
+package reverse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Files copied out of a "-reversewrite" reverse mount can be restored by
+// copying them back. Modified ciphertext must be rejected.
+func TestReverseRw(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirA, "TestReverseRw"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sock := test_helpers.TmpDir + "/TestReverseRw.sock"
+	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dirA, mnt, "-reverse", "-reversewrite", "-extpass", "echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+	r := encryptPath(t, sock, "TestReverseRw")
+	if r.ErrNo != 0 {
+		t.Fatal(r.ErrText)
+	}
+	cPath := filepath.Join(mnt, r.Result)
+	ciphertext, err := ioutil.ReadFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(cPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dirA, "TestReverseRw")); !os.IsNotExist(err) {
+		t.Fatalf("plaintext file was not deleted: %v", err)
+	}
+	if err = ioutil.WriteFile(cPath, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(filepath.Join(dirA, "TestReverseRw"))
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("plaintext was not restored: err=%v", err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 1
+	if err = ioutil.WriteFile(cPath, ciphertext, 0600); err == nil {
+		t.Error("writing modified ciphertext should fail")
+	}
+}
+
+// "-rw", which mount(8) passes for fstab entries, must not make a reverse
+// mount writable.
+func TestReverseRwIgnored(t *testing.T) {
+	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dirA, mnt, "-reverse", "-rw", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if err = os.Mkdir(filepath.Join(mnt, "TestReverseRwIgnored"), 0700); err == nil {
+		t.Error("mkdir in a reverse mount without -reversewrite should fail")
+	}
+}